@@ -0,0 +1,26 @@
+package app
+
+// App represents an application registered with the discovery server. Requests
+// to the discovery API are authenticated with the App's APIKey, and can only
+// access the groups belonging to the App.
+//
+// AnonymousSignaling lets clients join the App's signaling realm without its
+// API key, like Babble nodes which do not support WAMP authentication. They can
+// only relay signaling messages, and not call the discovery procedures.
+type App struct {
+	ID                 string
+	Name               string
+	APIKey             string
+	Revoked            bool
+	Created            int64
+	AnonymousSignaling bool
+}
+
+// NewApp generates a new App. The APIKey is assigned when the App is created in
+// an AppRepository.
+func NewApp(id string, name string) *App {
+	return &App{
+		ID:   id,
+		Name: name,
+	}
+}
@@ -0,0 +1,200 @@
+package app
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// apiKeyLength is the number of random bytes in an API key
+const apiKeyLength = 32
+
+// AppRepository defines an interface for a registry of applications and their
+// API keys. It should be thread safe.
+type AppRepository interface {
+	GetAllApps() (map[string]*App, error)
+	GetApp(appID string) (*App, error)
+	GetAppByAPIKey(apiKey string) (*App, error)
+	CreateApp(app *App) (string, error)
+	RotateAPIKey(appID string) (string, error)
+	RevokeApp(appID string) error
+}
+
+// InmemAppRepository implements the AppRepository interface with an inmem map
+// of apps. It is thread safe.
+type InmemAppRepository struct {
+	sync.Mutex
+	appsByID     map[string]*App // [app ID] => App
+	appsByAPIKey map[string]*App // [API key] => App
+}
+
+// NewInmemAppRepository instantiates a new InmemAppRepository
+func NewInmemAppRepository() *InmemAppRepository {
+	return &InmemAppRepository{
+		appsByID:     make(map[string]*App),
+		appsByAPIKey: make(map[string]*App),
+	}
+}
+
+// GetAllApps implements the AppRepository interface and returns a copy of all
+// the apps, including revoked ones.
+func (iar *InmemAppRepository) GetAllApps() (map[string]*App, error) {
+	iar.Lock()
+	defer iar.Unlock()
+
+	res := make(map[string]*App, len(iar.appsByID))
+	for id, a := range iar.appsByID {
+		ac := *a
+		res[id] = &ac
+	}
+
+	return res, nil
+}
+
+// GetApp implements the AppRepository interface and returns an app by ID
+func (iar *InmemAppRepository) GetApp(id string) (*App, error) {
+	iar.Lock()
+	defer iar.Unlock()
+
+	a, ok := iar.appsByID[id]
+	if !ok {
+		return nil, fmt.Errorf("App %s not found", id)
+	}
+
+	ac := *a
+	return &ac, nil
+}
+
+// GetAppByAPIKey implements the AppRepository interface and returns the app
+// identified by an API key. Keys of revoked apps, and keys that have been
+// rotated, are not found.
+func (iar *InmemAppRepository) GetAppByAPIKey(apiKey string) (*App, error) {
+	iar.Lock()
+	defer iar.Unlock()
+
+	a, ok := iar.appsByAPIKey[apiKey]
+	if !ok {
+		return nil, fmt.Errorf("API key not found")
+	}
+
+	ac := *a
+	return &ac, nil
+}
+
+// CreateApp implements the AppRepository interface and registers a new app
+// with a random API key. If the app's ID is not set, we assign a random one. It
+// is an error to create an app with an ID that is already registered, even if
+// the corresponding app was revoked. In any case we return the ID of the app.
+func (iar *InmemAppRepository) CreateApp(app *App) (string, error) {
+	if app.ID == "" {
+		app.ID = uuid.New().String()
+	}
+
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	iar.Lock()
+	defer iar.Unlock()
+
+	if _, ok := iar.appsByID[app.ID]; ok {
+		return "", fmt.Errorf("App %s already exists", app.ID)
+	}
+
+	app.APIKey = apiKey
+	app.Revoked = false
+	app.Created = time.Now().Unix()
+
+	ac := *app
+	iar.appsByID[app.ID] = &ac
+	iar.appsByAPIKey[apiKey] = &ac
+
+	return app.ID, nil
+}
+
+// RotateAPIKey implements the AppRepository interface and replaces the API key
+// of an app with a new random one. The previous key is invalidated
+// immediately.
+func (iar *InmemAppRepository) RotateAPIKey(id string) (string, error) {
+	apiKey, err := generateAPIKey()
+	if err != nil {
+		return "", err
+	}
+
+	iar.Lock()
+	defer iar.Unlock()
+
+	a, ok := iar.appsByID[id]
+	if !ok {
+		return "", fmt.Errorf("App %s not found", id)
+	}
+
+	if a.Revoked {
+		return "", fmt.Errorf("App %s is revoked", id)
+	}
+
+	delete(iar.appsByAPIKey, a.APIKey)
+	a.APIKey = apiKey
+	iar.appsByAPIKey[apiKey] = a
+
+	return apiKey, nil
+}
+
+// RevokeApp implements the AppRepository interface and invalidates the API key
+// of an app. The app remains in the registry, so that its ID can not be reused.
+func (iar *InmemAppRepository) RevokeApp(id string) error {
+	iar.Lock()
+	defer iar.Unlock()
+
+	a, ok := iar.appsByID[id]
+	if !ok {
+		return fmt.Errorf("App %s not found", id)
+	}
+
+	delete(iar.appsByAPIKey, a.APIKey)
+	a.APIKey = ""
+	a.Revoked = true
+
+	return nil
+}
+
+// restoreApp registers an app as it is, with its API key, like when loading
+// apps that were saved. It is an error to restore an app whose ID or API key is
+// already registered.
+func (iar *InmemAppRepository) restoreApp(app *App) error {
+	iar.Lock()
+	defer iar.Unlock()
+
+	if _, ok := iar.appsByID[app.ID]; ok {
+		return fmt.Errorf("App %s already exists", app.ID)
+	}
+
+	if app.APIKey != "" {
+		if _, ok := iar.appsByAPIKey[app.APIKey]; ok {
+			return fmt.Errorf("API key of app %s is already used", app.ID)
+		}
+	}
+
+	ac := *app
+	iar.appsByID[app.ID] = &ac
+
+	if ac.APIKey != "" {
+		iar.appsByAPIKey[ac.APIKey] = &ac
+	}
+
+	return nil
+}
+
+// generateAPIKey returns a random hex-encoded API key
+func generateAPIKey() (string, error) {
+	key := make([]byte, apiKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("Error generating API key: %v", err)
+	}
+	return hex.EncodeToString(key), nil
+}
@@ -0,0 +1,137 @@
+package app
+
+import (
+	"testing"
+)
+
+// Test creating apps and retrieving them by ID and API key.
+func TestCreateApp(t *testing.T) {
+	repo := NewInmemAppRepository()
+
+	app := NewApp("TestApp", "Test Application")
+
+	appID, err := repo.CreateApp(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if appID != "TestApp" {
+		t.Fatalf("app ID should be TestApp, not %s", appID)
+	}
+
+	if app.APIKey == "" {
+		t.Fatalf("app APIKey should be set")
+	}
+
+	retrievedApp, err := repo.GetAppByAPIKey(app.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retrievedApp.ID != appID {
+		t.Fatalf("app retrieved by API key should be %s, not %s", appID, retrievedApp.ID)
+	}
+
+	// Creating an app with the same ID should fail
+
+	_, err = repo.CreateApp(NewApp("TestApp", "Duplicate"))
+	if err == nil {
+		t.Fatalf("Creating an app with an existing ID should fail")
+	}
+
+	// Creating an app without ID should assign a random one
+
+	app2 := NewApp("", "Another Application")
+
+	app2ID, err := repo.CreateApp(app2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if app2ID == "" || app2ID == appID {
+		t.Fatalf("app2 should have been assigned a new ID, not %q", app2ID)
+	}
+
+	allApps, err := repo.GetAllApps()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(allApps) != 2 {
+		t.Fatalf("Repo should contain 2 apps, not %d", len(allApps))
+	}
+}
+
+// Test that rotating an app's API key invalidates the previous one.
+func TestRotateAPIKey(t *testing.T) {
+	repo := NewInmemAppRepository()
+
+	app := NewApp("TestApp", "Test Application")
+
+	appID, err := repo.CreateApp(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldKey := app.APIKey
+
+	newKey, err := repo.RotateAPIKey(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if newKey == oldKey {
+		t.Fatalf("Rotated API key should be different")
+	}
+
+	if _, err := repo.GetAppByAPIKey(oldKey); err == nil {
+		t.Fatalf("Old API key should not be found")
+	}
+
+	retrievedApp, err := repo.GetAppByAPIKey(newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retrievedApp.ID != appID {
+		t.Fatalf("app retrieved by new API key should be %s, not %s", appID, retrievedApp.ID)
+	}
+}
+
+// Test that revoking an app invalidates its API key, and that its ID can not be
+// reused.
+func TestRevokeApp(t *testing.T) {
+	repo := NewInmemAppRepository()
+
+	app := NewApp("TestApp", "Test Application")
+
+	appID, err := repo.CreateApp(app)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.RevokeApp(appID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.GetAppByAPIKey(app.APIKey); err == nil {
+		t.Fatalf("API key of revoked app should not be found")
+	}
+
+	retrievedApp, err := repo.GetApp(appID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !retrievedApp.Revoked {
+		t.Fatalf("app should be revoked")
+	}
+
+	if _, err := repo.RotateAPIKey(appID); err == nil {
+		t.Fatalf("Rotating the API key of a revoked app should fail")
+	}
+
+	if _, err := repo.CreateApp(NewApp("TestApp", "Test Application")); err == nil {
+		t.Fatalf("Creating an app with the ID of a revoked app should fail")
+	}
+}
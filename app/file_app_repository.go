@@ -0,0 +1,157 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileAppRepository implements the AppRepository interface with an
+// InmemAppRepository, which is saved to a JSON file after every change, so that
+// apps and their API keys survive a restart. It is thread safe.
+//
+// The file contains a map of apps by ID, as returned by GetAllApps. It can also
+// be written by hand to register apps before the server starts: the ID of an
+// app defaults to its key in the map, and apps without APIKey, which are not
+// revoked, are assigned a random one when the file is loaded.
+type FileAppRepository struct {
+	*InmemAppRepository
+
+	// saveLock serializes changes, so that the file is always saved with the
+	// latest state
+	saveLock sync.Mutex
+	path     string
+}
+
+// NewFileAppRepository instantiates a new FileAppRepository, and loads the apps
+// saved in path. The file is created with the first app if it does not exist.
+func NewFileAppRepository(path string) (*FileAppRepository, error) {
+	far := &FileAppRepository{
+		InmemAppRepository: NewInmemAppRepository(),
+		path:               path,
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return far, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading apps file: %v", err)
+	}
+
+	var saved map[string]*App
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return nil, fmt.Errorf("Error parsing apps file: %v", err)
+	}
+
+	seeded := false
+
+	for id, a := range saved {
+		if a == nil {
+			return nil, fmt.Errorf("Error parsing apps file: app %s is null", id)
+		}
+
+		if a.ID == "" {
+			a.ID = id
+		}
+
+		if a.ID != id {
+			return nil, fmt.Errorf("Error parsing apps file: app %s saved as %s", a.ID, id)
+		}
+
+		if a.Revoked {
+			a.APIKey = ""
+		} else if a.APIKey == "" {
+			if a.APIKey, err = generateAPIKey(); err != nil {
+				return nil, err
+			}
+			seeded = true
+		}
+
+		if a.Created == 0 {
+			a.Created = time.Now().Unix()
+			seeded = true
+		}
+
+		if err := far.restoreApp(a); err != nil {
+			return nil, fmt.Errorf("Error loading apps file: %v", err)
+		}
+	}
+
+	// Save the keys and creation times assigned to the apps written by hand
+	if seeded {
+		if err := far.save(); err != nil {
+			return nil, err
+		}
+	}
+
+	return far, nil
+}
+
+// CreateApp implements the AppRepository interface, and saves the new app
+func (far *FileAppRepository) CreateApp(app *App) (string, error) {
+	far.saveLock.Lock()
+	defer far.saveLock.Unlock()
+
+	id, err := far.InmemAppRepository.CreateApp(app)
+	if err != nil {
+		return id, err
+	}
+
+	return id, far.save()
+}
+
+// RotateAPIKey implements the AppRepository interface, and saves the new key
+func (far *FileAppRepository) RotateAPIKey(id string) (string, error) {
+	far.saveLock.Lock()
+	defer far.saveLock.Unlock()
+
+	apiKey, err := far.InmemAppRepository.RotateAPIKey(id)
+	if err != nil {
+		return "", err
+	}
+
+	return apiKey, far.save()
+}
+
+// RevokeApp implements the AppRepository interface, and saves the revocation
+func (far *FileAppRepository) RevokeApp(id string) error {
+	far.saveLock.Lock()
+	defer far.saveLock.Unlock()
+
+	if err := far.InmemAppRepository.RevokeApp(id); err != nil {
+		return err
+	}
+
+	return far.save()
+}
+
+// save writes all the apps to the file. The file is replaced atomically, so
+// that it is never left half-written. It is only readable by its owner,
+// because it contains the API keys.
+func (far *FileAppRepository) save() error {
+	apps, err := far.GetAllApps()
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.MarshalIndent(apps, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := far.path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("Error writing apps file: %v", err)
+	}
+
+	if err := os.Rename(tmp, far.path); err != nil {
+		return fmt.Errorf("Error writing apps file: %v", err)
+	}
+
+	return nil
+}
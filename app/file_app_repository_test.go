@@ -0,0 +1,149 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test that the apps of a FileAppRepository, and the changes of their API keys,
+// are restored from its file.
+func TestFileAppRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disco-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "apps.json")
+
+	repo, err := NewFileAppRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app1 := NewApp("TestApp1", "Test Application 1")
+	if _, err := repo.CreateApp(app1); err != nil {
+		t.Fatal(err)
+	}
+
+	app2 := NewApp("TestApp2", "Test Application 2")
+	if _, err := repo.CreateApp(app2); err != nil {
+		t.Fatal(err)
+	}
+
+	app3 := NewApp("TestApp3", "Test Application 3")
+	if _, err := repo.CreateApp(app3); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := repo.RotateAPIKey("TestApp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.RevokeApp("TestApp3"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload the file, like after a restart
+
+	restored, err := NewFileAppRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := restored.GetAppByAPIKey(app1.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a.ID != "TestApp1" || a.Name != "Test Application 1" || a.Created != app1.Created {
+		t.Fatalf("Restored app should be TestApp1, not %v", a)
+	}
+
+	if _, err := restored.GetAppByAPIKey(app2.APIKey); err == nil {
+		t.Fatalf("Rotated API key should not be restored")
+	}
+
+	if a, err := restored.GetAppByAPIKey(newKey); err != nil || a.ID != "TestApp2" {
+		t.Fatalf("New API key should be restored for TestApp2, not %v, %v", a, err)
+	}
+
+	if _, err := restored.GetAppByAPIKey(app3.APIKey); err == nil {
+		t.Fatalf("API key of revoked app should not be restored")
+	}
+
+	if _, err := restored.CreateApp(NewApp("TestApp3", "Reused")); err == nil {
+		t.Fatalf("Creating an app with the ID of a restored revoked app should fail")
+	}
+}
+
+// Test loading a file written by hand, whose apps are assigned API keys which
+// are saved to the file.
+func TestFileAppRepositorySeed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disco-apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "apps.json")
+
+	seed := `{
+		"BabbleChat": {"Name": "Babble Chat"},
+		"Fixed": {"Name": "Fixed Key", "APIKey": "fixed-key"}
+	}`
+
+	if err := ioutil.WriteFile(path, []byte(seed), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	repo, err := NewFileAppRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := repo.GetAppByAPIKey("fixed-key"); err != nil || a.ID != "Fixed" {
+		t.Fatalf("App with a seeded API key should be Fixed, not %v, %v", a, err)
+	}
+
+	chat, err := repo.GetApp("BabbleChat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if chat.APIKey == "" || chat.Created == 0 {
+		t.Fatalf("App without API key should be assigned a key and a creation time, not %v", chat)
+	}
+
+	// The assigned key is saved
+
+	restored, err := NewFileAppRepository(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a, err := restored.GetAppByAPIKey(chat.APIKey); err != nil || a.ID != "BabbleChat" {
+		t.Fatalf("Assigned API key should be saved for BabbleChat, not %v, %v", a, err)
+	}
+
+	// Invalid files are rejected
+
+	invalid := map[string]string{
+		"mismatched ID":     `{"App1": {"ID": "App2"}}`,
+		"duplicate API key": `{"App1": {"APIKey": "key"}, "App2": {"APIKey": "key"}}`,
+		"malformed":         `[`,
+	}
+
+	for name, content := range invalid {
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewFileAppRepository(path); err == nil {
+			t.Fatalf("Loading a file with %s should fail", name)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/group"
+)
+
+const (
+	// PeersFile is the file of a Babble data directory listing the current peers
+	PeersFile = "peers.json"
+	// GenesisPeersFile is the file of a Babble data directory listing the
+	// initial peers
+	GenesisPeersFile = "peers.genesis.json"
+)
+
+// WriteBabblePeers writes the Peers and GenesisPeers of a group to the
+// peers.json and peers.genesis.json files of a Babble data directory, which is
+// created if necessary. If the group has no GenesisPeers, its Peers are used
+// instead. Both lists are validated with group.ValidatePeers before any file is
+// written, and every file is replaced atomically.
+func WriteBabblePeers(g *group.Group, datadir string) error {
+	genesisPeers := g.GenesisPeers
+	if len(genesisPeers) == 0 {
+		genesisPeers = g.Peers
+	}
+
+	if err := group.ValidatePeers(g.Peers); err != nil {
+		return fmt.Errorf("invalid peers in group %s: %v", g.ID, err)
+	}
+
+	if err := group.ValidatePeers(genesisPeers); err != nil {
+		return fmt.Errorf("invalid genesis peers in group %s: %v", g.ID, err)
+	}
+
+	if err := os.MkdirAll(datadir, 0700); err != nil {
+		return err
+	}
+
+	if err := writePeersFile(filepath.Join(datadir, GenesisPeersFile), genesisPeers); err != nil {
+		return err
+	}
+
+	return writePeersFile(filepath.Join(datadir, PeersFile), g.Peers)
+}
+
+// WriteGroupPeers fetches a group and writes its peers to a Babble data
+// directory with WriteBabblePeers. It returns the group.
+func (c *DiscoClient) WriteGroupPeers(ctx context.Context, id string, datadir string) (*group.Group, error) {
+	g, err := c.GetGroupByIDContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := WriteBabblePeers(g, datadir); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+// writePeersFile writes a list of peers to a JSON file in the format of
+// Babble's peers.JSONPeerSet, through a temporary file renamed into place
+func writePeersFile(path string, ps []*peers.Peer) error {
+	data, err := json.MarshalIndent(ps, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mosaicnetworks/babble/src/crypto/keys"
+	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// newTestPeer creates a peer with a new public key
+func newTestPeer(t *testing.T, netAddr string, moniker string) *peers.Peer {
+	key, err := keys.GenerateECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return peers.NewPeer(keys.PublicKeyHex(&key.PublicKey), netAddr, moniker)
+}
+
+// Test that WriteBabblePeers writes files that Babble can read, and does not
+// write anything for invalid groups.
+func TestWriteBabblePeers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disco-babble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	alice := newTestPeer(t, "192.168.1.1:1337", "alice")
+	bob := newTestPeer(t, "192.168.1.2:1337", "bob")
+
+	g := group.NewGroup("group1", "TestGroup", "TestApp", []*peers.Peer{alice})
+	g.Peers = []*peers.Peer{alice, bob}
+
+	datadir := filepath.Join(dir, "babble")
+
+	if err := WriteBabblePeers(g, datadir); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[bool][]*peers.Peer{
+		true:  g.Peers,
+		false: g.GenesisPeers,
+	}
+
+	for current, ps := range expected {
+		peerSet, err := peers.NewJSONPeerSet(datadir, current).PeerSet()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(peerSet.PubKeys(), peers.NewPeerSet(ps).PubKeys()) {
+			t.Fatalf("Peers (current: %v) should be %v, not %v", current, peers.NewPeerSet(ps).PubKeys(), peerSet.PubKeys())
+		}
+	}
+
+	// Invalid groups are rejected before anything is written
+
+	invalidDir := filepath.Join(dir, "invalid")
+
+	g.Peers = []*peers.Peer{peers.NewPeer("pubkey", "", "")}
+
+	if err := WriteBabblePeers(g, invalidDir); err == nil {
+		t.Fatalf("Group with invalid peers should be rejected")
+	}
+
+	if _, err := os.Stat(invalidDir); !os.IsNotExist(err) {
+		t.Fatalf("Nothing should be written for invalid groups")
+	}
+}
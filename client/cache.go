@@ -0,0 +1,84 @@
+package client
+
+import (
+	"net/http"
+	"sync"
+)
+
+// cacheEntry is a cached response body, with the validators used to revalidate
+// it
+type cacheEntry struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// responseCache caches the responses of GET requests by path, so that the
+// groups of an AppID, or a group by ID, are only transferred again when they
+// change. Cached responses are always revalidated with conditional requests. It
+// is thread safe.
+type responseCache struct {
+	sync.Mutex
+	entries map[string]*cacheEntry // [path] => entry
+}
+
+// newResponseCache instantiates an empty responseCache
+func newResponseCache() *responseCache {
+	return &responseCache{
+		entries: make(map[string]*cacheEntry),
+	}
+}
+
+// get returns the cache entry of a path, or nil
+func (rc *responseCache) get(path string) *cacheEntry {
+	rc.Lock()
+	defer rc.Unlock()
+
+	return rc.entries[path]
+}
+
+// put caches a response if it has an ETag or a Last-Modified header
+func (rc *responseCache) put(path string, resp *http.Response, body []byte) {
+	entry := &cacheEntry{
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		body:         body,
+	}
+
+	rc.Lock()
+	defer rc.Unlock()
+
+	if entry.etag == "" && entry.lastModified == "" {
+		delete(rc.entries, path)
+		return
+	}
+
+	rc.entries[path] = entry
+}
+
+// remove removes the entry of a path
+func (rc *responseCache) remove(path string) {
+	rc.Lock()
+	defer rc.Unlock()
+
+	delete(rc.entries, path)
+}
+
+// conditions returns a copy of header with the conditions that make a request
+// return 304 Not Modified if the cached response is still valid
+func (e *cacheEntry) conditions(header http.Header) http.Header {
+	res := make(http.Header)
+	for key, values := range header {
+		res[key] = values
+	}
+
+	if e.etag != "" {
+		res.Set("If-None-Match", e.etag)
+	}
+
+	if e.lastModified != "" {
+		res.Set("If-Modified-Since", e.lastModified)
+	}
+
+	return res
+}
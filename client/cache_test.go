@@ -0,0 +1,141 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Test that cached groups are revalidated with conditional requests, and only
+// transferred again when they change.
+func TestCache(t *testing.T) {
+	var version, full, notModified int32
+	lastModified := time.Now().UTC().Format(http.TimeFormat)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := atomic.LoadInt32(&version)
+
+		if v == 0 {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/groups/group1":
+			// ETag
+			etag := fmt.Sprintf("\"%d\"", v)
+			w.Header().Set("ETag", etag)
+			if r.Header.Get("If-None-Match") == etag {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&full, 1)
+			fmt.Fprintf(w, `{"ID": "group1", "Version": %d}`, v)
+		case "/groups":
+			// Last-Modified
+			w.Header().Set("Last-Modified", lastModified)
+			if r.Header.Get("If-Modified-Since") == lastModified {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			atomic.AddInt32(&full, 1)
+			fmt.Fprintf(w, `{"group1": {"ID": "group1", "Version": %d}}`, v)
+		}
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+
+	config := c.config
+	config.Cache = true
+	c.SetConfig(config)
+
+	reset := func() (int32, int32) {
+		return atomic.SwapInt32(&full, 0), atomic.SwapInt32(&notModified, 0)
+	}
+
+	atomic.StoreInt32(&version, 1)
+
+	// Revalidation with ETag
+
+	for i := 0; i < 3; i++ {
+		g, err := c.GetGroupByID("group1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Version != 1 {
+			t.Fatalf("group Version should be 1, not %d", g.Version)
+		}
+	}
+
+	if f, nm := reset(); f != 1 || nm != 2 {
+		t.Fatalf("Server should send the group once, and 2 Not Modified, not %d and %d", f, nm)
+	}
+
+	// Revalidation with Last-Modified
+
+	for i := 0; i < 3; i++ {
+		groups, err := c.GetGroups("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(groups) != 1 {
+			t.Fatalf("Groups should contain 1 group, not %d", len(groups))
+		}
+	}
+
+	if f, nm := reset(); f != 1 || nm != 2 {
+		t.Fatalf("Server should send the groups once, and 2 Not Modified, not %d and %d", f, nm)
+	}
+
+	// Changed groups are transferred again
+
+	atomic.StoreInt32(&version, 2)
+
+	g, err := c.GetGroupByID("group1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Version != 2 {
+		t.Fatalf("group Version should be 2, not %d", g.Version)
+	}
+
+	if f, _ := reset(); f != 1 {
+		t.Fatalf("Server should send the changed group")
+	}
+
+	// Deleted groups are removed from the cache
+
+	atomic.StoreInt32(&version, 0)
+
+	if _, err := c.GetGroupByID("group1"); err == nil {
+		t.Fatalf("Getting a deleted group should fail")
+	}
+
+	if c.cache.get("/groups/group1") != nil {
+		t.Fatalf("Deleted group should be removed from the cache")
+	}
+
+	// Without cache, requests are not conditional
+
+	atomic.StoreInt32(&version, 1)
+
+	config.Cache = false
+	c.SetConfig(config)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetGroupByID("group1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if f, nm := reset(); f != 2 || nm != 0 {
+		t.Fatalf("Server should send the group twice without cache, not %d times", f)
+	}
+}
@@ -1,35 +1,127 @@
 package client
 
 import (
-	"bytes"
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 
 	"github.com/mosaicnetworks/disco/group"
+	"github.com/mosaicnetworks/disco/ice"
 	"github.com/sirupsen/logrus"
 )
 
-// DiscoClient is a client for the Discovery API
+// DiscoClient is a client for the Discovery API. Every method has a variant
+// taking a context.Context, which can cancel the request and its retries.
 type DiscoClient struct {
-	url      string
+	pool     *serverPool
 	certFile string
+	apiKey   string
+	config   Config
+	cache    *responseCache // nil if the cache is disabled
 	client   *http.Client
 	logger   *logrus.Entry
 }
 
 // NewDiscoClient creates a new DiscoClient for a server hosted at the provided
-// url
-func NewDiscoClient(url string, certFile string, skipVerify bool, logger *logrus.Entry) (*DiscoClient, error) {
+// url. The url defaults to the https scheme, but "http://" can be specified to
+// reach a server running in insecure HTTP mode. Requests are authenticated with
+// the API key of a registered application. If clientCertFile is not empty, the
+// client also presents the certificate loaded from clientCertFile and
+// clientKeyFile to servers that require mutual TLS. A certificate issued to an
+// application can replace the API key. The client uses the DefaultConfig, which
+// can be changed with SetConfig.
+func NewDiscoClient(
+	url string,
+	certFile string,
+	skipVerify bool,
+	apiKey string,
+	clientCertFile string,
+	clientKeyFile string,
+	logger *logrus.Entry,
+) (*DiscoClient, error) {
+	return NewDiscoClientWithServers(
+		[]string{url},
+		certFile,
+		skipVerify,
+		apiKey,
+		clientCertFile,
+		clientKeyFile,
+		logger)
+}
+
+// NewDiscoClientWithServers is like NewDiscoClient, but with several servers.
+// A url of the form "srv://name" is replaced with the targets of the DNS SRV
+// records of name, in order of priority. Requests are sent to the healthy
+// server with the lowest latency, as measured by periodic health checks, and
+// fail over to the other servers when it fails. Until the first health check
+// completes, servers are tried in the order of urls.
+func NewDiscoClientWithServers(
+	urls []string,
+	certFile string,
+	skipVerify bool,
+	apiKey string,
+	clientCertFile string,
+	clientKeyFile string,
+	logger *logrus.Entry,
+) (*DiscoClient, error) {
+	pool, err := newServerPool(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	tlscfg, err := newTLSConfig(certFile, skipVerify, clientCertFile, clientKeyFile, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &DiscoClient{
+		pool:     pool,
+		certFile: certFile,
+		apiKey:   apiKey,
+		client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlscfg,
+			},
+		},
+		logger: logger,
+	}
+
+	res.SetConfig(DefaultConfig())
+
+	return res, nil
+}
+
+// newTLSConfig returns the TLS configuration of the clients. It trusts the
+// certificate in certFile, if it exists, or the platform's trusted certificates,
+// and presents the client certificate loaded from clientCertFile and
+// clientKeyFile, if clientCertFile is not empty.
+func newTLSConfig(
+	certFile string,
+	skipVerify bool,
+	clientCertFile string,
+	clientKeyFile string,
+	logger *logrus.Entry,
+) (*tls.Config, error) {
 	tlscfg := &tls.Config{}
 
+	if clientCertFile != "" {
+		clientCert, err := tls.LoadX509KeyPair(clientCertFile, clientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+
+		tlscfg.Certificates = []tls.Certificate{clientCert}
+	}
+
 	if skipVerify {
 		logger.Debug("Skip Verify. Accepting any certificate provided by signal server.")
 		tlscfg.InsecureSkipVerify = true
@@ -69,44 +161,51 @@ func NewDiscoClient(url string, certFile string, skipVerify bool, logger *logrus
 		tlscfg.ServerName = cert.Subject.CommonName
 	}
 
-	res := &DiscoClient{
-		url:      fmt.Sprintf("https://%s", url),
-		certFile: certFile,
-		client: &http.Client{
-			Transport: &http.Transport{
-				TLSClientConfig: tlscfg,
-			},
-		},
-		logger: logger,
-	}
+	return tlscfg, nil
+}
 
-	return res, nil
+// SetConfig changes the settings of the client. It should be called before the
+// client is used.
+func (c *DiscoClient) SetConfig(config Config) {
+	c.config = config
+	c.client.Timeout = config.Timeout
+
+	switch {
+	case !config.Cache:
+		c.cache = nil
+	case c.cache == nil:
+		c.cache = newResponseCache()
+	}
 }
 
 // GetGroups returns a map of groups indexed by ID. The optional appID parameter
 // is used to query only those groups belonging to a specific applications. If
 // appID is the empty string, all groups, from all applications, are returned.
 func (c *DiscoClient) GetGroups(appID string) (map[string]*group.Group, error) {
-	path := fmt.Sprintf("%s/groups", c.url)
+	return c.GetGroupsContext(context.Background(), appID)
+}
+
+// GetGroupsContext is like GetGroups with a context
+func (c *DiscoClient) GetGroupsContext(ctx context.Context, appID string) (map[string]*group.Group, error) {
+	path := "/groups"
 
 	if appID != "" {
-		query := url.PathEscape(fmt.Sprintf("app-id=%s", appID))
-		path = fmt.Sprintf("%s?%s", path, query)
+		path = fmt.Sprintf("%s?%s", path, url.Values{"app-id": {appID}}.Encode())
 	}
 
-	fmt.Println("path: ", path)
-
-	resp, err := c.client.Get(path)
+	_, body, err := c.send(ctx, request{
+		method:     http.MethodGet,
+		path:       path,
+		idempotent: true,
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 
 	var allGroups map[string]*group.Group
 	err = json.Unmarshal(body, &allGroups)
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing groups: %v\n%s", err, body)
+		return nil, fmt.Errorf("Error parsing groups: %v", err)
 	}
 
 	return allGroups, nil
@@ -114,15 +213,19 @@ func (c *DiscoClient) GetGroups(appID string) (map[string]*group.Group, error) {
 
 // GetGroupByID gets a single group by ID
 func (c *DiscoClient) GetGroupByID(id string) (*group.Group, error) {
-	path := fmt.Sprintf("%s/groups/%s", c.url, id)
-	fmt.Println("path: ", path)
+	return c.GetGroupByIDContext(context.Background(), id)
+}
 
-	resp, err := c.client.Get(path)
+// GetGroupByIDContext is like GetGroupByID with a context
+func (c *DiscoClient) GetGroupByIDContext(ctx context.Context, id string) (*group.Group, error) {
+	_, body, err := c.send(ctx, request{
+		method:     http.MethodGet,
+		path:       groupPath(id),
+		idempotent: true,
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
 
 	var group *group.Group
 	err = json.Unmarshal(body, &group)
@@ -134,23 +237,27 @@ func (c *DiscoClient) GetGroupByID(id string) (*group.Group, error) {
 }
 
 // CreateGroup adds a group to the discovery server. The group's ID field should
-// be empty as it will be set by the server.
+// be empty as it will be set by the server. It is not retried, because it
+// would create duplicate groups.
 func (c *DiscoClient) CreateGroup(group group.Group) (string, error) {
-	path := fmt.Sprintf("%s/group", c.url)
-	fmt.Println("path: ", path)
+	return c.CreateGroupContext(context.Background(), group)
+}
 
+// CreateGroupContext is like CreateGroup with a context
+func (c *DiscoClient) CreateGroupContext(ctx context.Context, group group.Group) (string, error) {
 	jsonValue, err := json.Marshal(group)
 	if err != nil {
 		return "", fmt.Errorf("Error marshalling group: %v", err)
 	}
 
-	resp, err := c.client.Post(path, "application/json", bytes.NewBuffer(jsonValue))
+	_, body, err := c.send(ctx, request{
+		method: http.MethodPost,
+		path:   "/group",
+		body:   jsonValue,
+	})
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-
-	body, err := ioutil.ReadAll(resp.Body)
 
 	var id string
 	err = json.Unmarshal(body, &id)
@@ -161,29 +268,163 @@ func (c *DiscoClient) CreateGroup(group group.Group) (string, error) {
 	return id, nil
 }
 
+// DeleteGroup deletes a group from the discovery server
 func (c *DiscoClient) DeleteGroup(id string) error {
-	path := fmt.Sprintf("%s/groups/%s", c.url, id)
-	fmt.Println("path: ", path)
+	return c.DeleteGroupContext(context.Background(), id)
+}
+
+// DeleteGroupContext is like DeleteGroup with a context
+func (c *DiscoClient) DeleteGroupContext(ctx context.Context, id string) error {
+	_, _, err := c.send(ctx, request{
+		method:     http.MethodDelete,
+		path:       groupPath(id),
+		idempotent: true,
+	})
 
-	// Create request
-	req, err := http.NewRequest(
-		http.MethodDelete,
-		path,
-		nil)
+	return err
+}
+
+// UpdateGroup replaces a group on the discovery server and returns the updated
+// group. If the group's Version is not 0, the group is only replaced if the
+// version on the server is the same, otherwise the error matches
+// group.ErrVersionMismatch. Use the Version of the returned group for
+// subsequent updates.
+func (c *DiscoClient) UpdateGroup(g group.Group) (*group.Group, error) {
+	return c.UpdateGroupContext(context.Background(), g)
+}
+
+// UpdateGroupContext is like UpdateGroup with a context
+func (c *DiscoClient) UpdateGroupContext(ctx context.Context, g group.Group) (*group.Group, error) {
+	jsonValue, err := json.Marshal(g)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling group: %v", err)
+	}
+
+	return c.sendGroupUpdate(ctx, request{
+		method:     http.MethodPut,
+		path:       groupPath(g.ID),
+		body:       jsonValue,
+		header:     ifMatch(g.Version),
+		idempotent: true,
+	})
+}
+
+// PatchGroup applies a JSON Merge Patch (RFC 7396) to a group and returns the
+// updated group. The patch is marshalled to JSON; fields set to nil are removed
+// from the group. If version is not 0, the patch is only applied if the version
+// on the server is the same, otherwise the error matches
+// group.ErrVersionMismatch. Patches are not retried.
+func (c *DiscoClient) PatchGroup(id string, patch interface{}, version uint64) (*group.Group, error) {
+	return c.PatchGroupContext(context.Background(), id, patch, version)
+}
+
+// PatchGroupContext is like PatchGroup with a context
+func (c *DiscoClient) PatchGroupContext(ctx context.Context, id string, patch interface{}, version uint64) (*group.Group, error) {
+	jsonValue, err := json.Marshal(patch)
+	if err != nil {
+		return nil, fmt.Errorf("Error marshalling patch: %v", err)
+	}
+
+	header := ifMatch(version)
+	header.Set("Content-Type", "application/merge-patch+json")
+
+	return c.sendGroupUpdate(ctx, request{
+		method: http.MethodPatch,
+		path:   groupPath(id),
+		body:   jsonValue,
+		header: header,
+	})
+}
+
+// sendGroupUpdate sends a request updating a group, and parses the updated
+// group from the response
+func (c *DiscoClient) sendGroupUpdate(ctx context.Context, r request) (*group.Group, error) {
+	_, body, err := c.send(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+
+	var updatedGroup *group.Group
+	err = json.Unmarshal(body, &updatedGroup)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing group: %v", err)
+	}
+
+	return updatedGroup, nil
+}
+
+// Heartbeat refreshes a group on the discovery server, so that it is not
+// deleted when its TTL expires. Its version is not changed.
+func (c *DiscoClient) Heartbeat(id string) error {
+	return c.HeartbeatContext(context.Background(), id)
+}
+
+// HeartbeatContext is like Heartbeat with a context
+func (c *DiscoClient) HeartbeatContext(ctx context.Context, id string) error {
+	_, _, err := c.send(ctx, request{
+		method:     http.MethodPost,
+		path:       groupPath(id) + "/heartbeat",
+		idempotent: true,
+	})
+
+	return err
+}
+
+// GetICEServers returns the STUN and TURN servers, with credentials, that the
+// application should use to establish WebRTC connections
+func (c *DiscoClient) GetICEServers() ([]*ice.ICEServer, error) {
+	return c.GetICEServersContext(context.Background())
+}
+
+// GetICEServersContext is like GetICEServers with a context
+func (c *DiscoClient) GetICEServersContext(ctx context.Context) ([]*ice.ICEServer, error) {
+	_, body, err := c.send(ctx, request{
+		method:     http.MethodGet,
+		path:       "/ice-servers",
+		idempotent: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var servers []*ice.ICEServer
+	err = json.Unmarshal(body, &servers)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error parsing ICE servers: %v", err)
 	}
 
-	// Fetch Request
-	resp, err := c.client.Do(req)
+	return servers, nil
+}
+
+// newRequest creates an HTTP request authenticated with the client's API key
+func (c *DiscoClient) newRequest(method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, path, body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	// Display Results
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Error deleting group %s: %s", id, resp.Status)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.apiKey))
 	}
 
-	return nil
+	return req, nil
+}
+
+// groupPath returns the path of a group in the discovery API
+func groupPath(id string) string {
+	return "/groups/" + url.PathEscape(id)
+}
+
+// ifMatch returns the headers making a request conditional on the version of a
+// group. There is no condition if version is 0.
+func ifMatch(version uint64) http.Header {
+	header := make(http.Header)
+	if version != 0 {
+		header.Set("If-Match", fmt.Sprintf("\"%d\"", version))
+	}
+	return header
 }
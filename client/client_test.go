@@ -1,45 +1,50 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/discotest"
 	"github.com/mosaicnetworks/disco/group"
-	"github.com/mosaicnetworks/disco/server"
+	"github.com/mosaicnetworks/disco/ice"
 	"github.com/sirupsen/logrus"
 )
 
-func TestSetGroup(t *testing.T) {
-
-	// Init server and client
-
-	server := server.NewDiscoServer(
-		group.NewInmemGroupRepository(),
-		"../test_data/cert.pem",
-		"../test_data/key.pem",
-		logrus.New().WithField("component", "disco-server"),
-	)
-
-	go server.Serve(
-		"localhost:10443",
-		"localhost:20443",
-		"main",
-	)
-
-	time.Sleep(2 * time.Second)
-
-	client, err := NewDiscoClient(
-		"localhost:10443",
-		"",
-		true,
+// newServerClient creates a client for a test server, which trusts the
+// server's certificate
+func newServerClient(t *testing.T, ts *discotest.Server, apiKey string, clientCertFile string, clientKeyFile string) *DiscoClient {
+	c, err := NewDiscoClient(
+		ts.URL,
+		ts.CertFile,
+		false,
+		apiKey,
+		clientCertFile,
+		clientKeyFile,
 		logrus.New().WithField("component", "disco-client"),
 	)
-
 	if err != nil {
 		t.Fatal(err)
 	}
+	return c
+}
+
+func TestSetGroup(t *testing.T) {
+
+	// Init server and clients
+
+	ts := discotest.NewServer()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+	app2 := ts.NewApp("TestApp2")
+
+	client := newServerClient(t, ts, app1.APIKey, "", "")
+	client2 := newServerClient(t, ts, app2.APIKey, "", "")
 
 	// Insert group1
 
@@ -95,20 +100,20 @@ func TestSetGroup(t *testing.T) {
 		},
 	)
 
-	_, err = client.CreateGroup(*group2)
+	group2ID, err := client2.CreateGroup(*group2)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	// Get all groups
+	// Get all groups. Each app only sees its own groups.
 
 	allGroups, err := client.GetGroups("")
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	if len(allGroups) != 2 {
-		t.Fatalf("All groups should contain 2 groups, not %d", len(allGroups))
+	if len(allGroups) != 1 {
+		t.Fatalf("All groups should contain 1 group, not %d", len(allGroups))
 	}
 
 	// Get App1 groups
@@ -124,7 +129,7 @@ func TestSetGroup(t *testing.T) {
 
 	// Get App2 groups
 
-	app2Groups, err := client.GetGroups("TestApp2")
+	app2Groups, err := client2.GetGroups("TestApp2")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -133,6 +138,54 @@ func TestSetGroup(t *testing.T) {
 		t.Fatalf("TestApp2 should contain 1 group, not %d", len(app2Groups))
 	}
 
+	// App1 can not access App2 groups
+
+	if _, err := client.GetGroups("TestApp2"); err == nil {
+		t.Fatalf("App1 should not be able to list App2 groups")
+	}
+
+	if g, err := client.GetGroupByID(group2ID); g != nil || !errors.Is(err, ErrNotFound) {
+		t.Fatalf("App1 should not be able to get App2 group")
+	}
+
+	if err := client.DeleteGroup(group2ID); err == nil {
+		t.Fatalf("App1 should not be able to delete App2 group")
+	}
+
+	// Requests without a valid API key are rejected
+
+	anonClient := newServerClient(t, ts, "", "", "")
+
+	if _, err := anonClient.GetGroups(""); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Requests without API key should return ErrUnauthorized, not %v", err)
+	}
+
+	if _, err := anonClient.GetICEServers(); err == nil {
+		t.Fatalf("Requests without API key should be rejected")
+	}
+
+	// Health check, without API key
+
+	if err := anonClient.CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Get ICE servers
+
+	iceServers, err := client.GetICEServers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedICEServers := []*ice.ICEServer{
+		ice.NewICEServer([]string{"stun:" + ts.TURN.Address}, "", ""),
+		ice.NewICEServer([]string{"turn:" + ts.TURN.Address + "?transport=udp"}, "test", "test"),
+	}
+
+	if !reflect.DeepEqual(iceServers, expectedICEServers) {
+		t.Fatalf("ICE servers should be %#v, not %#v", expectedICEServers, iceServers)
+	}
+
 	// Delete group 1
 
 	err = client.DeleteGroup(group1ID)
@@ -146,3 +199,325 @@ func TestSetGroup(t *testing.T) {
 	}
 
 }
+
+// Test that a server configured with a client CA requires client certificates,
+// and authenticates the application named by the certificate.
+func TestClientCertificate(t *testing.T) {
+	ts := discotest.NewUnstartedServer()
+	ts.TLS.ClientCAFile = "../test_data/client-ca.pem"
+	ts.Start()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+	app2 := ts.NewApp("TestApp2")
+
+	// A client certificate issued to TestApp1 replaces the API key
+
+	certClient := newServerClient(t, ts, "", "../test_data/client-cert.pem", "../test_data/client-key.pem")
+
+	group1 := group.NewGroup(
+		"",
+		"TestGroup1",
+		"TestApp1",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+
+	if _, err := certClient.CreateGroup(*group1); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := certClient.GetGroups("TestApp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 {
+		t.Fatalf("TestApp1 should contain 1 group, not %d", len(groups))
+	}
+
+	// The API key of another application does not match the certificate
+
+	mismatchClient := newServerClient(t, ts, app2.APIKey, "../test_data/client-cert.pem", "../test_data/client-key.pem")
+
+	if _, err := mismatchClient.GetGroups(""); err == nil {
+		t.Fatalf("Requests with a certificate of another app should be rejected")
+	}
+
+	// Clients without a certificate are rejected, even with a valid API key
+
+	noCertClient := newServerClient(t, ts, app1.APIKey, "", "")
+
+	if _, err := noCertClient.GetGroups(""); err == nil {
+		t.Fatalf("Requests without a client certificate should be rejected")
+	}
+
+	// Invalid client certificate files are reported
+
+	if _, err := NewDiscoClient(
+		ts.URL,
+		ts.CertFile,
+		false,
+		"",
+		"../test_data/client-cert.pem",
+		"../test_data/key.pem",
+		logrus.New().WithField("component", "disco-client"),
+	); err == nil {
+		t.Fatalf("Creating a client with a mismatching key should fail")
+	}
+}
+
+// Test that a server in dev mode runs without certificate files, that clients
+// can trust the certificate it writes out, and that the discovery API can be
+// served over plaintext HTTP.
+func TestDevMode(t *testing.T) {
+	devServer := discotest.NewServer()
+	defer devServer.Close()
+
+	app1 := devServer.NewApp("TestApp1")
+
+	httpServer := discotest.NewUnstartedServer()
+	httpServer.TLS.InsecureHTTP = true
+	httpServer.Apps = devServer.Apps
+	httpServer.Start()
+	defer httpServer.Close()
+
+	// The client verifies the development certificate
+
+	devClient := newServerClient(t, devServer, app1.APIKey, "", "")
+
+	if _, err := devClient.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext discovery API
+
+	if !strings.HasPrefix(httpServer.URL, "http://") {
+		t.Fatalf("Server URL should start with http://, not %s", httpServer.URL)
+	}
+
+	httpClient := newServerClient(t, httpServer, app1.APIKey, "", "")
+
+	if _, err := httpClient.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test updating, patching, and refreshing groups, with and without optimistic
+// concurrency.
+func TestUpdateGroup(t *testing.T) {
+	ts := discotest.NewServer()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+	app2 := ts.NewApp("TestApp2")
+
+	newClient := func(apiKey string) *DiscoClient {
+		return newServerClient(t, ts, apiKey, "", "")
+	}
+
+	client := newClient(app1.APIKey)
+	client2 := newClient(app2.APIKey)
+
+	group1 := group.NewGroup(
+		"",
+		"TestGroup1",
+		"TestApp1",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+
+	group1ID, err := client.CreateGroup(*group1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current, err := client.GetGroupByID(group1ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current.Version != 1 {
+		t.Fatalf("group Version should be 1, not %d", current.Version)
+	}
+
+	// Update with the current version
+
+	current.Peers = append(current.Peers, peers.NewPeer("pub2", "net2", "peer2"))
+
+	updated, err := client.UpdateGroup(*current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Version != 2 {
+		t.Fatalf("group Version should be 2, not %d", updated.Version)
+	}
+
+	if !reflect.DeepEqual(updated.Peers, current.Peers) {
+		t.Fatalf("group Peers should be %#v, not %#v", current.Peers, updated.Peers)
+	}
+
+	// Update with a stale version
+
+	if _, err := client.UpdateGroup(*current); !errors.Is(err, group.ErrVersionMismatch) {
+		t.Fatalf("Update with stale version should return ErrVersionMismatch, not %v", err)
+	}
+
+	// Unconditional update
+
+	current.Version = 0
+	current.Name = "Unconditional"
+
+	updated, err = client.UpdateGroup(*current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Name != "Unconditional" || updated.Version != 3 {
+		t.Fatalf("group should be Unconditional version 3, not %s version %d", updated.Name, updated.Version)
+	}
+
+	// Patch with the current version. Other fields are unchanged.
+
+	patched, err := client.PatchGroup(group1ID, map[string]interface{}{"Name": "Patched"}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if patched.Name != "Patched" || patched.Version != 4 {
+		t.Fatalf("group should be Patched version 4, not %s version %d", patched.Name, patched.Version)
+	}
+
+	if !reflect.DeepEqual(patched.Peers, updated.Peers) {
+		t.Fatalf("group Peers should be %#v, not %#v", updated.Peers, patched.Peers)
+	}
+
+	// Patch with a stale version
+
+	if _, err := client.PatchGroup(group1ID, map[string]interface{}{"Name": "Stale"}, 3); !errors.Is(err, group.ErrVersionMismatch) {
+		t.Fatalf("Patch with stale version should return ErrVersionMismatch, not %v", err)
+	}
+
+	// Unconditional patch removing a field
+
+	patched, err = client.PatchGroup(group1ID, map[string]interface{}{"Peers": nil}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(patched.Peers) != 0 {
+		t.Fatalf("group Peers should be removed, not %#v", patched.Peers)
+	}
+
+	// Patches can not change the identity of a group
+
+	if _, err := client.PatchGroup(group1ID, map[string]interface{}{"AppID": "TestApp2"}, 0); err == nil {
+		t.Fatalf("Patch should not change the group AppID")
+	}
+
+	// Heartbeat refreshes the group without changing its version
+
+	if err := client.Heartbeat(group1ID); err != nil {
+		t.Fatal(err)
+	}
+
+	current, err = client.GetGroupByID(group1ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current.Version != patched.Version {
+		t.Fatalf("group Version should be %d, not %d", patched.Version, current.Version)
+	}
+
+	// Cached groups are revalidated, and updates are visible
+
+	cachedClient := newClient(app1.APIKey)
+
+	config := DefaultConfig()
+	config.Cache = true
+	cachedClient.SetConfig(config)
+
+	for i := 0; i < 2; i++ {
+		cached, err := cachedClient.GetGroupByID(group1ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if cached.Version != current.Version {
+			t.Fatalf("Cached group Version should be %d, not %d", current.Version, cached.Version)
+		}
+	}
+
+	if _, err := client.PatchGroup(group1ID, map[string]interface{}{"Name": "Cached"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	cached, err := cachedClient.GetGroupByID(group1ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cached.Name != "Cached" {
+		t.Fatalf("Cached group Name should be Cached, not %s", cached.Name)
+	}
+
+	// Heartbeats between two requests are visible too. LastUpdated has a
+	// resolution of one second.
+
+	cachedGroups, err := cachedClient.GetGroups("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(time.Until(time.Unix(cached.LastUpdated+1, 0)))
+
+	if err := client.Heartbeat(group1ID); err != nil {
+		t.Fatal(err)
+	}
+
+	refreshed, err := cachedClient.GetGroupByID(group1ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refreshed.LastUpdated <= cached.LastUpdated || refreshed.Version != cached.Version {
+		t.Fatalf("Cached group should be refreshed after %d with version %d, not at %d with version %d", cached.LastUpdated, cached.Version, refreshed.LastUpdated, refreshed.Version)
+	}
+
+	refreshedGroups, err := cachedClient.GetGroups("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if refreshedGroups[group1ID].LastUpdated <= cachedGroups[group1ID].LastUpdated {
+		t.Fatalf("Cached groups should be refreshed after %d, not at %d", cachedGroups[group1ID].LastUpdated, refreshedGroups[group1ID].LastUpdated)
+	}
+
+	// Other apps can not update, patch, or refresh the group
+
+	if _, err := client2.UpdateGroup(*current); err == nil {
+		t.Fatalf("App2 should not be able to update App1's group")
+	}
+
+	if _, err := client2.PatchGroup(group1ID, map[string]interface{}{"Name": "Hijacked"}, 0); err == nil {
+		t.Fatalf("App2 should not be able to patch App1's group")
+	}
+
+	if err := client2.Heartbeat(group1ID); err == nil {
+		t.Fatalf("App2 should not be able to refresh App1's group")
+	}
+
+	// Unknown groups
+
+	if _, err := client.PatchGroup("unknown", map[string]interface{}{"Name": "Unknown"}, 0); err == nil {
+		t.Fatalf("Patching an unknown group should fail")
+	}
+
+	if err := client.Heartbeat("unknown"); err == nil {
+		t.Fatalf("Refreshing an unknown group should fail")
+	}
+}
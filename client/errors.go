@@ -0,0 +1,72 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// Errors matching the HTTP status of failed requests, or the corresponding gRPC
+// code. Use errors.Is to test the errors returned by DiscoClient and GRPCClient
+// methods against them.
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrUnavailable  = errors.New("server unavailable")
+)
+
+// Error is returned by DiscoClient methods when the server responds with an
+// unexpected status. It matches the sentinel error corresponding to its status
+// with errors.Is, and group.ErrVersionMismatch for 412 Precondition Failed.
+type Error struct {
+	StatusCode int
+	Status     string
+	Message    string // body of the response
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("disco: %s", e.Status)
+	}
+	return fmt.Sprintf("disco: %s: %s", e.Status, e.Message)
+}
+
+// Is reports whether the error corresponds to target
+func (e *Error) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrUnavailable:
+		return e.StatusCode >= http.StatusInternalServerError
+	case group.ErrVersionMismatch:
+		return e.StatusCode == http.StatusPreconditionFailed
+	}
+	return false
+}
+
+// retryable reports whether a request that failed with this status may succeed
+// if it is sent again
+func retryable(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,247 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/mosaicnetworks/disco/group"
+	pb "github.com/mosaicnetworks/disco/proto"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCClient is a client for the gRPC flavour of the discovery API. It wraps
+// the generated proto.DiscoveryClient, converting its messages to and from
+// groups, and authenticates every call with the API key of an application. Its
+// methods return errors which match the same sentinel errors as DiscoClient's.
+type GRPCClient struct {
+	conn   *grpc.ClientConn
+	client pb.DiscoveryClient
+}
+
+// NewGRPCClient creates a new GRPCClient for a server listening at addr, of the
+// form host:port. Like in NewDiscoClient, "http://" can be prepended to reach a
+// server running in insecure HTTP mode, and the other arguments configure the
+// certificates and the API key. The connection is established in the
+// background; call Close to release it.
+func NewGRPCClient(
+	addr string,
+	certFile string,
+	skipVerify bool,
+	apiKey string,
+	clientCertFile string,
+	clientKeyFile string,
+	logger *logrus.Entry,
+) (*GRPCClient, error) {
+	var transportCreds credentials.TransportCredentials
+
+	if strings.HasPrefix(addr, "http://") {
+		addr = strings.TrimPrefix(addr, "http://")
+		transportCreds = insecure.NewCredentials()
+	} else {
+		tlscfg, err := newTLSConfig(certFile, skipVerify, clientCertFile, clientKeyFile, logger)
+		if err != nil {
+			return nil, err
+		}
+		transportCreds = credentials.NewTLS(tlscfg)
+	}
+
+	opts := []grpc.DialOption{
+		grpc.WithTransportCredentials(transportCreds),
+	}
+
+	if apiKey != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(apiKeyCredentials{
+			apiKey: apiKey,
+			secure: transportCreds.Info().SecurityProtocol == "tls",
+		}))
+	}
+
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GRPCClient{
+		conn:   conn,
+		client: pb.NewDiscoveryClient(conn),
+	}, nil
+}
+
+// Close closes the connection to the server
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// GetGroups returns a map of groups indexed by ID. If appID is not empty, it
+// must be the AppID of the authenticated application.
+func (c *GRPCClient) GetGroups(ctx context.Context, appID string) (map[string]*group.Group, error) {
+	resp, err := c.client.ListGroups(ctx, &pb.ListGroupsRequest{AppID: appID})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return pb.ToGroups(resp.Groups), nil
+}
+
+// GetGroupByID gets a single group by ID
+func (c *GRPCClient) GetGroupByID(ctx context.Context, id string) (*group.Group, error) {
+	g, err := c.client.GetGroup(ctx, &pb.GetGroupRequest{ID: id})
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return pb.ToGroup(g), nil
+}
+
+// CreateGroup adds a group to the discovery server, and returns its ID
+func (c *GRPCClient) CreateGroup(ctx context.Context, g group.Group) (string, error) {
+	resp, err := c.client.CreateGroup(ctx, pb.FromGroup(&g))
+	if err != nil {
+		return "", grpcError(err)
+	}
+
+	return resp.ID, nil
+}
+
+// UpdateGroup replaces a group on the discovery server and returns the updated
+// group. If the group's Version is not 0, the group is only replaced if the
+// version on the server is the same, otherwise the error matches
+// group.ErrVersionMismatch.
+func (c *GRPCClient) UpdateGroup(ctx context.Context, g group.Group) (*group.Group, error) {
+	updatedGroup, err := c.client.UpdateGroup(ctx, pb.FromGroup(&g))
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return pb.ToGroup(updatedGroup), nil
+}
+
+// Heartbeat refreshes a group on the discovery server, so that it is not
+// deleted when its TTL expires. Its version is not changed.
+func (c *GRPCClient) Heartbeat(ctx context.Context, id string) error {
+	_, err := c.client.Heartbeat(ctx, &pb.HeartbeatRequest{ID: id})
+	return grpcError(err)
+}
+
+// DeleteGroup deletes a group from the discovery server
+func (c *GRPCClient) DeleteGroup(ctx context.Context, id string) error {
+	_, err := c.client.DeleteGroup(ctx, &pb.DeleteGroupRequest{ID: id})
+	return grpcError(err)
+}
+
+// WatchGroups calls handler for every existing group of appID, reported as
+// created, and then for every group that is created, updated, or deleted
+// through the server, until ctx is done or the stream fails. Unlike
+// DiscoClient.WatchGroups, events are pushed by the server instead of being
+// polled. It returns the error of the stream, or the error of ctx when it is
+// done.
+func (c *GRPCClient) WatchGroups(ctx context.Context, appID string, handler func(GroupEvent)) error {
+	stream, err := c.client.Watch(ctx, &pb.WatchRequest{AppID: appID})
+	if err != nil {
+		return grpcError(err)
+	}
+
+	for {
+		e, err := stream.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return grpcError(err)
+		}
+
+		handler(GroupEvent{
+			Type:  groupEventTypes[e.Type],
+			Group: pb.ToGroup(e.Group),
+		})
+	}
+}
+
+// groupEventTypes maps the types of protobuf events to GroupEventTypes
+var groupEventTypes = map[pb.GroupEvent_EventType]GroupEventType{
+	pb.GroupEvent_CREATED: GroupCreated,
+	pb.GroupEvent_UPDATED: GroupUpdated,
+	pb.GroupEvent_DELETED: GroupDeleted,
+}
+
+// apiKeyCredentials adds the API key of an application to the metadata of every
+// call
+type apiKeyCredentials struct {
+	apiKey string
+	secure bool
+}
+
+// GetRequestMetadata implements the credentials.PerRPCCredentials interface
+func (ac apiKeyCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{
+		"authorization": fmt.Sprintf("Bearer %s", ac.apiKey),
+	}, nil
+}
+
+// RequireTransportSecurity implements the credentials.PerRPCCredentials
+// interface. The API key is only sent in plaintext to servers in insecure HTTP
+// mode.
+func (ac apiKeyCredentials) RequireTransportSecurity() bool {
+	return ac.secure
+}
+
+// GRPCError is returned by GRPCClient methods when a call fails. It matches the
+// sentinel error corresponding to its gRPC code with errors.Is, and
+// group.ErrVersionMismatch for FAILED_PRECONDITION. Its status can be retrieved
+// with status.FromError.
+type GRPCError struct {
+	status *status.Status
+}
+
+// grpcError wraps the error of a gRPC call in a GRPCError. It returns nil if
+// err is nil.
+func grpcError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &GRPCError{status: status.Convert(err)}
+}
+
+// Error implements the error interface
+func (e *GRPCError) Error() string {
+	return fmt.Sprintf("disco: %s: %s", e.status.Code(), e.status.Message())
+}
+
+// GRPCStatus returns the status of the failed call
+func (e *GRPCError) GRPCStatus() *status.Status {
+	return e.status
+}
+
+// Is reports whether the error corresponds to target
+func (e *GRPCError) Is(target error) bool {
+	code := e.status.Code()
+
+	switch target {
+	case ErrBadRequest:
+		return code == codes.InvalidArgument
+	case ErrUnauthorized:
+		return code == codes.Unauthenticated
+	case ErrForbidden:
+		return code == codes.PermissionDenied
+	case ErrNotFound:
+		return code == codes.NotFound
+	case ErrRateLimited:
+		return code == codes.ResourceExhausted
+	case ErrUnavailable:
+		return code == codes.Unavailable || code == codes.Internal
+	case group.ErrVersionMismatch:
+		return code == codes.FailedPrecondition
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/discotest"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// newGRPCServerClient creates a gRPC client for a test server, which trusts the
+// server's certificate
+func newGRPCServerClient(t *testing.T, ts *discotest.Server, apiKey string, clientCertFile string, clientKeyFile string) *GRPCClient {
+	c, err := NewGRPCClient(
+		ts.GRPCAddr,
+		ts.CertFile,
+		false,
+		apiKey,
+		clientCertFile,
+		clientKeyFile,
+		logrus.New().WithField("component", "disco-client"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// Test the group operations of the gRPC client, and that they share the
+// repository and the authentication of the REST API
+func TestGRPCClient(t *testing.T) {
+	ts := discotest.NewServer()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+	app2 := ts.NewApp("TestApp2")
+
+	client := newGRPCServerClient(t, ts, app1.APIKey, "", "")
+	defer client.Close()
+
+	client2 := newGRPCServerClient(t, ts, app2.APIKey, "", "")
+	defer client2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	group1 := group.NewGroup(
+		"",
+		"TestGroup1",
+		"",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+
+	id, err := client.CreateGroup(ctx, *group1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := client.GetGroupByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Name != "TestGroup1" || g.AppID != "TestApp1" || g.Version != 1 {
+		t.Fatalf("Group should be TestGroup1 of TestApp1 version 1, not %s of %s version %d", g.Name, g.AppID, g.Version)
+	}
+
+	if len(g.Peers) != 1 || g.Peers[0].PubKeyHex != "pub1" || g.Peers[0].NetAddr != "net1" {
+		t.Fatalf("Group peers should be converted, not %v", g.Peers)
+	}
+
+	// Groups created over gRPC are visible in the REST API
+
+	restClient := newServerClient(t, ts, app1.APIKey, "", "")
+
+	restGroup, err := restClient.GetGroupByIDContext(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if restGroup.Name != "TestGroup1" {
+		t.Fatalf("REST group should be TestGroup1, not %s", restGroup.Name)
+	}
+
+	// Updates with the current version succeed, and stale versions fail
+
+	g.Name = "Updated"
+
+	updated, err := client.UpdateGroup(ctx, *g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if updated.Name != "Updated" || updated.Version != 2 {
+		t.Fatalf("Updated group should be Updated version 2, not %s version %d", updated.Name, updated.Version)
+	}
+
+	if _, err := client.UpdateGroup(ctx, *g); !errors.Is(err, group.ErrVersionMismatch) {
+		t.Fatalf("Stale update should fail with ErrVersionMismatch, not %v", err)
+	}
+
+	if err := client.Heartbeat(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	groups, err := client.GetGroups(ctx, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 1 || groups[id] == nil || groups[id].Version != 2 {
+		t.Fatalf("Groups should contain version 2 of the group, not %v", groups)
+	}
+
+	// Other applications can not access the group
+
+	if _, err := client2.GetGroupByID(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Group of another app should not be found, not %v", err)
+	}
+
+	if _, err := client2.GetGroups(ctx, "TestApp1"); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Groups of another app should be forbidden, not %v", err)
+	}
+
+	if err := client2.DeleteGroup(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Deleting group of another app should fail with ErrNotFound, not %v", err)
+	}
+
+	// Calls without a valid API key are rejected
+
+	anonymous := newGRPCServerClient(t, ts, "", "", "")
+	defer anonymous.Close()
+
+	if _, err := anonymous.GetGroups(ctx, ""); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Call without API key should be unauthorized, not %v", err)
+	}
+
+	invalid := newGRPCServerClient(t, ts, "invalid", "", "")
+	defer invalid.Close()
+
+	if _, err := invalid.GetGroups(ctx, ""); !errors.Is(err, ErrUnauthorized) {
+		t.Fatalf("Call with invalid API key should be unauthorized, not %v", err)
+	}
+
+	// Delete
+
+	if err := client.DeleteGroup(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.GetGroupByID(ctx, id); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Deleted group should not be found, not %v", err)
+	}
+}
+
+// Test that the gRPC client authenticates with a client certificate issued to
+// an application, without API key
+func TestGRPCClientCertificate(t *testing.T) {
+	ts := discotest.NewUnstartedServer()
+	ts.TLS.ClientCAFile = "../test_data/client-ca.pem"
+	ts.Start()
+	defer ts.Close()
+
+	ts.NewApp("TestApp1")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	certClient := newGRPCServerClient(t, ts, "", "../test_data/client-cert.pem", "../test_data/client-key.pem")
+	defer certClient.Close()
+
+	id, err := certClient.CreateGroup(ctx, group.Group{Name: "CertGroup"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := certClient.GetGroupByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.AppID != "TestApp1" {
+		t.Fatalf("Group should belong to TestApp1, not %s", g.AppID)
+	}
+
+	// Clients without certificate can not connect
+
+	noCertClient := newGRPCServerClient(t, ts, "", "", "")
+	defer noCertClient.Close()
+
+	if _, err := noCertClient.GetGroups(ctx, ""); err == nil {
+		t.Fatalf("Call without client certificate should fail")
+	}
+}
+
+// Test that WatchGroups reports the existing groups, and then the changes
+// pushed by the server
+func TestGRPCWatchGroups(t *testing.T) {
+	ts := discotest.NewServer()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+	app2 := ts.NewApp("TestApp2")
+
+	client := newGRPCServerClient(t, ts, app1.APIKey, "", "")
+	defer client.Close()
+
+	client2 := newGRPCServerClient(t, ts, app2.APIKey, "", "")
+	defer client2.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	existingID, err := client.CreateGroup(ctx, group.Group{Name: "Existing"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events := make(chan GroupEvent, 10)
+	watchErr := make(chan error, 1)
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+
+	go func() {
+		watchErr <- client.WatchGroups(watchCtx, "", func(e GroupEvent) {
+			events <- e
+		})
+	}()
+
+	next := func() GroupEvent {
+		select {
+		case e := <-events:
+			return e
+		case <-ctx.Done():
+			t.Fatalf("Watch should receive an event")
+		}
+		return GroupEvent{}
+	}
+
+	if e := next(); e.Type != GroupCreated || e.Group.ID != existingID {
+		t.Fatalf("First event should be the creation of the existing group, not %s %v", e.Type, e.Group)
+	}
+
+	// Changes to the groups of other applications are not reported
+
+	if _, err := client2.CreateGroup(ctx, group.Group{Name: "Other"}); err != nil {
+		t.Fatal(err)
+	}
+
+	newID, err := client.CreateGroup(ctx, group.Group{Name: "New"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e := next(); e.Type != GroupCreated || e.Group.ID != newID {
+		t.Fatalf("Event should be the creation of the new group, not %s %v", e.Type, e.Group)
+	}
+
+	// Changes made through the REST API are reported too
+
+	restClient := newServerClient(t, ts, app1.APIKey, "", "")
+
+	if _, err := restClient.PatchGroupContext(ctx, newID, map[string]string{"Name": "Patched"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := next(); e.Type != GroupUpdated || e.Group.Name != "Patched" || e.Group.Version != 2 {
+		t.Fatalf("Event should be the update of the new group, not %s %v", e.Type, e.Group)
+	}
+
+	if err := client.DeleteGroup(ctx, existingID); err != nil {
+		t.Fatal(err)
+	}
+
+	if e := next(); e.Type != GroupDeleted || e.Group.ID != existingID || e.Group.Name != "Existing" {
+		t.Fatalf("Event should be the deletion of the existing group, not %s %v", e.Type, e.Group)
+	}
+
+	stopWatch()
+
+	if err := <-watchErr; err != context.Canceled {
+		t.Fatalf("WatchGroups should return the error of the context, not %v", err)
+	}
+
+	// Watching the groups of another application is forbidden
+
+	err = client2.WatchGroups(ctx, "TestApp1", func(GroupEvent) {})
+	if !errors.Is(err, ErrForbidden) {
+		t.Fatalf("Watching groups of another app should be forbidden, not %v", err)
+	}
+}
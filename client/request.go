@@ -0,0 +1,227 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Config holds the timeout, retry, health check, and cache settings of a
+// DiscoClient
+type Config struct {
+	// Timeout limits the time of every attempt of a request, including reading
+	// the response. There is no timeout if 0. The context passed to the Context
+	// variants of the methods limits the time of all the attempts.
+	Timeout time.Duration
+
+	// MaxRetries is the number of times idempotent requests are retried after a
+	// network error, or a 429, 502, 503 or 504 status. Other requests are never
+	// retried.
+	MaxRetries int
+
+	// Retries wait for an exponential backoff, starting at MinBackoff and capped
+	// at MaxBackoff, with random jitter.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// HealthCheckInterval is the minimum interval between the health checks of
+	// clients with several servers. Health checks run in the background when
+	// requests are sent. They are disabled if 0.
+	HealthCheckInterval time.Duration
+
+	// Cache enables the caching of groups. Cached groups are revalidated with
+	// conditional requests, so the server only sends them again if they have
+	// changed.
+	Cache bool
+}
+
+// DefaultConfig returns the Config of new DiscoClients
+func DefaultConfig() Config {
+	return Config{
+		Timeout:             10 * time.Second,
+		MaxRetries:          3,
+		MinBackoff:          100 * time.Millisecond,
+		MaxBackoff:          2 * time.Second,
+		HealthCheckInterval: 30 * time.Second,
+	}
+}
+
+// backoff returns the time to wait before retry number attempt (starting at 0).
+// It doubles at every attempt, up to MaxBackoff, and half of it is random.
+func (c Config) backoff(attempt int) time.Duration {
+	d := c.MaxBackoff
+	if attempt < 32 && c.MinBackoff<<uint(attempt) < c.MaxBackoff {
+		d = c.MinBackoff << uint(attempt)
+	}
+
+	if d <= 0 {
+		return 0
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// request describes a request to the discovery API
+type request struct {
+	method     string
+	path       string // relative to the server URL
+	body       []byte
+	header     http.Header
+	idempotent bool
+}
+
+// send sends a request authenticated with the client's API key and returns the
+// response, with its body already read. Idempotent requests are retried
+// according to the client's Config. Responses with a status other than 2xx are
+// returned as an *Error. If the cache is enabled, GET requests for cached
+// responses are conditional, and return the cached body if it is still valid.
+func (c *DiscoClient) send(ctx context.Context, r request) (*http.Response, []byte, error) {
+	c.maybeCheckHealth()
+
+	if c.cache == nil || r.method != http.MethodGet {
+		return c.retry(ctx, r)
+	}
+
+	entry := c.cache.get(r.path)
+	if entry != nil {
+		r.header = entry.conditions(r.header)
+	}
+
+	resp, body, err := c.retry(ctx, r)
+
+	switch {
+	case entry != nil && resp != nil && resp.StatusCode == http.StatusNotModified:
+		return resp, entry.body, nil
+	case err == nil:
+		c.cache.put(r.path, resp, body)
+	case errors.Is(err, ErrNotFound):
+		c.cache.remove(r.path)
+	}
+
+	return resp, body, err
+}
+
+// retry sends a request, and retries it if it is idempotent and fails
+func (c *DiscoClient) retry(ctx context.Context, r request) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := c.failover(ctx, r)
+
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+
+		retry := err != nil || retryable(resp.StatusCode)
+		if !retry || !r.idempotent || attempt >= c.config.MaxRetries {
+			if err != nil {
+				return nil, nil, err
+			}
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				return resp, body, &Error{
+					StatusCode: resp.StatusCode,
+					Status:     resp.Status,
+					Message:    strings.TrimSpace(string(body)),
+				}
+			}
+			return resp, body, nil
+		}
+
+		wait := c.config.backoff(attempt)
+
+		if err != nil {
+			c.logger.WithError(err).Debugf("%s %s failed, retrying in %v", r.method, r.path, wait)
+		} else {
+			c.logger.Debugf("%s %s returned %s, retrying in %v", r.method, r.path, resp.Status, wait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// failover sends a request to the preferred server. If the server fails, the
+// request is sent to the next server, and the failed server is marked unhealthy.
+// Idempotent requests fail over on network errors and retryable statuses, while
+// other requests only fail over when the connection to the server fails.
+func (c *DiscoClient) failover(ctx context.Context, r request) (*http.Response, []byte, error) {
+	servers := c.pool.ordered()
+
+	var resp *http.Response
+	var body []byte
+	var err error
+
+	for i, s := range servers {
+		if i > 0 {
+			if err != nil {
+				c.logger.WithError(err).Warnf("Discovery server %s failed, failing over to %s", servers[i-1].url, s.url)
+			} else {
+				c.logger.Warnf("Discovery server %s returned %s, failing over to %s", servers[i-1].url, resp.Status, s.url)
+			}
+		}
+
+		resp, body, err = c.attempt(ctx, s, r)
+
+		if ctx.Err() != nil {
+			return resp, body, err
+		}
+
+		failed := isDialError(err)
+		if r.idempotent {
+			failed = err != nil || retryable(resp.StatusCode)
+		}
+
+		if !failed {
+			if err == nil {
+				c.pool.setHealth(s, true, 0)
+			}
+			return resp, body, err
+		}
+
+		c.pool.setHealth(s, false, 0)
+	}
+
+	return resp, body, err
+}
+
+// attempt sends a request once to a server and reads the response
+func (c *DiscoClient) attempt(ctx context.Context, s *endpoint, r request) (*http.Response, []byte, error) {
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+
+	req, err := c.newRequest(r.method, s.url+r.path, body)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req = req.WithContext(ctx)
+
+	for key, values := range r.header {
+		req.Header[key] = values
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error reading response: %v", err)
+	}
+
+	return resp, respBody, nil
+}
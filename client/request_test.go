@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// newTestClient creates a client for a test server, with short backoffs
+func newTestClient(t *testing.T, url string) *DiscoClient {
+	c, err := NewDiscoClient(url, "", false, "key", "", "", logrus.New().WithField("component", "disco-client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetConfig(Config{
+		Timeout:    time.Second,
+		MaxRetries: 2,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+
+	return c
+}
+
+// Test that idempotent requests are retried on retryable statuses, and other
+// requests are not.
+func TestRetry(t *testing.T) {
+	var requests int32
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1)%3 != 0 {
+			http.Error(w, "Try again", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+
+	// GET succeeds after 2 retries
+
+	if _, err := c.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests != 3 {
+		t.Fatalf("Server should receive 3 requests, not %d", requests)
+	}
+
+	// POST is not retried
+
+	atomic.StoreInt32(&requests, 0)
+
+	_, err := c.CreateGroup(group.Group{})
+	if !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("CreateGroup should return ErrUnavailable, not %v", err)
+	}
+
+	if requests != 1 {
+		t.Fatalf("Server should receive 1 request, not %d", requests)
+	}
+
+	// Retries are limited by MaxRetries
+
+	atomic.StoreInt32(&requests, 0)
+
+	c.config.MaxRetries = 1
+
+	if _, err := c.GetGroups(""); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("GetGroups should return ErrUnavailable, not %v", err)
+	}
+
+	if requests != 2 {
+		t.Fatalf("Server should receive 2 requests, not %d", requests)
+	}
+}
+
+// Test that error statuses are mapped to typed errors, and are not retried.
+func TestErrors(t *testing.T) {
+	var requests int32
+	var status int
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "Failure", status)
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+
+	testCases := []struct {
+		status int
+		err    error
+	}{
+		{http.StatusBadRequest, ErrBadRequest},
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrForbidden},
+		{http.StatusNotFound, ErrNotFound},
+		{http.StatusPreconditionFailed, group.ErrVersionMismatch},
+		{http.StatusInternalServerError, ErrUnavailable},
+	}
+
+	for _, tc := range testCases {
+		status = tc.status
+		atomic.StoreInt32(&requests, 0)
+
+		_, err := c.GetGroupByID("group1")
+
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("Status %d should return %v, not %v", tc.status, tc.err, err)
+		}
+
+		var discoErr *Error
+		if !errors.As(err, &discoErr) || discoErr.StatusCode != tc.status || discoErr.Message != "Failure" {
+			t.Fatalf("Status %d should return an *Error with the status and message, not %#v", tc.status, err)
+		}
+
+		if requests != 1 {
+			t.Fatalf("Status %d should not be retried", tc.status)
+		}
+	}
+}
+
+// Test that contexts and timeouts cancel requests and their retries.
+func TestContext(t *testing.T) {
+	block := make(chan struct{})
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-block:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(block)
+
+	c := newTestClient(t, server.URL)
+
+	// Context deadline
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	if _, err := c.GetGroupsContext(ctx, ""); err != context.DeadlineExceeded {
+		t.Fatalf("GetGroupsContext should return context.DeadlineExceeded, not %v", err)
+	}
+
+	if time.Since(start) > 500*time.Millisecond {
+		t.Fatalf("Request should be cancelled with its context")
+	}
+
+	// Client timeout, for every attempt
+
+	c.SetConfig(Config{Timeout: 20 * time.Millisecond})
+
+	if _, err := c.GetGroups(""); err == nil {
+		t.Fatalf("Request should time out")
+	}
+}
+
+// Test that the backoff grows exponentially up to the maximum, with jitter.
+func TestBackoff(t *testing.T) {
+	config := Config{
+		MinBackoff: 100 * time.Millisecond,
+		MaxBackoff: time.Second,
+	}
+
+	testCases := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{4, time.Second},
+		{100, time.Second},
+	}
+
+	for _, tc := range testCases {
+		for i := 0; i < 10; i++ {
+			d := config.backoff(tc.attempt)
+			if d < tc.max/2 || d > tc.max {
+				t.Fatalf("Backoff of attempt %d should be between %v and %v, not %v", tc.attempt, tc.max/2, tc.max, d)
+			}
+		}
+	}
+
+	if d := (Config{}).backoff(0); d != 0 {
+		t.Fatalf("Backoff should be 0 without MaxBackoff, not %v", d)
+	}
+}
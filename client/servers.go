@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// srvScheme is the prefix of server URLs that are DNS SRV names
+const srvScheme = "srv://"
+
+// lookupSRV resolves DNS SRV records. It is a variable so that tests can
+// replace it.
+var lookupSRV = net.LookupSRV
+
+// endpoint is a discovery server the client can send requests to
+type endpoint struct {
+	url     string
+	healthy bool
+	latency time.Duration // of the last health check
+}
+
+// serverPool holds the discovery servers of a client, and their health. It is
+// thread safe.
+type serverPool struct {
+	sync.Mutex
+	servers   []*endpoint
+	lastCheck time.Time
+	checking  bool
+}
+
+// newServerPool creates a serverPool from a list of URLs. URLs without a scheme
+// default to https, and "srv://name" URLs are resolved to the targets of the
+// DNS SRV records of name, in order of priority.
+func newServerPool(urls []string) (*serverPool, error) {
+	pool := &serverPool{}
+
+	for _, u := range urls {
+		resolved, err := resolveURL(u)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range resolved {
+			pool.servers = append(pool.servers, &endpoint{url: r, healthy: true})
+		}
+	}
+
+	if len(pool.servers) == 0 {
+		return nil, errors.New("no discovery server")
+	}
+
+	return pool, nil
+}
+
+// resolveURL returns the server URLs corresponding to a URL
+func resolveURL(u string) ([]string, error) {
+	if !strings.HasPrefix(u, srvScheme) {
+		if !strings.Contains(u, "://") {
+			u = fmt.Sprintf("https://%s", u)
+		}
+		return []string{u}, nil
+	}
+
+	_, records, err := lookupSRV("", "", strings.TrimPrefix(u, srvScheme))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s: %v", u, err)
+	}
+
+	var res []string
+	for _, r := range records {
+		host := strings.TrimSuffix(r.Target, ".")
+		res = append(res, fmt.Sprintf("https://%s", net.JoinHostPort(host, strconv.Itoa(int(r.Port)))))
+	}
+
+	return res, nil
+}
+
+// ordered returns the servers in order of preference: healthy servers by
+// increasing latency, then unhealthy servers. Servers with the same latency
+// keep the order in which they were configured.
+func (p *serverPool) ordered() []*endpoint {
+	p.Lock()
+	defer p.Unlock()
+
+	res := make([]*endpoint, len(p.servers))
+	copy(res, p.servers)
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].healthy != res[j].healthy {
+			return res[i].healthy
+		}
+		return res[i].latency < res[j].latency
+	})
+
+	return res
+}
+
+// setHealth records the health of a server. The latency is only updated if it
+// is positive.
+func (p *serverPool) setHealth(s *endpoint, healthy bool, latency time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	s.healthy = healthy
+	if latency > 0 {
+		s.latency = latency
+	}
+}
+
+// CheckHealth sends a health check to every server, and records their health
+// and latency, so that subsequent requests are sent to the healthy server with
+// the lowest latency. It returns an error if no server is healthy.
+func (c *DiscoClient) CheckHealth(ctx context.Context) error {
+	c.pool.Lock()
+	servers := make([]*endpoint, len(c.pool.servers))
+	copy(servers, c.pool.servers)
+	c.pool.lastCheck = time.Now()
+	c.pool.Unlock()
+
+	var wg sync.WaitGroup
+	healthy := make(chan bool, len(servers))
+
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *endpoint) {
+			defer wg.Done()
+
+			start := time.Now()
+			err := c.checkServer(ctx, s)
+			latency := time.Since(start)
+
+			if err != nil {
+				c.logger.WithError(err).Debugf("Discovery server %s is unhealthy", s.url)
+				c.pool.setHealth(s, false, 0)
+				healthy <- false
+				return
+			}
+
+			c.pool.setHealth(s, true, latency)
+			healthy <- true
+		}(s)
+	}
+
+	wg.Wait()
+	close(healthy)
+
+	for h := range healthy {
+		if h {
+			return nil
+		}
+	}
+
+	return errors.New("no healthy discovery server")
+}
+
+// checkServer sends a health check to a server
+func (c *DiscoClient) checkServer(ctx context.Context, s *endpoint) error {
+	req, err := http.NewRequest(http.MethodGet, s.url+"/health", nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// maybeCheckHealth starts a health check in the background if the client has
+// several servers and the last check is older than the HealthCheckInterval
+func (c *DiscoClient) maybeCheckHealth() {
+	if c.config.HealthCheckInterval <= 0 {
+		return
+	}
+
+	c.pool.Lock()
+	defer c.pool.Unlock()
+
+	if len(c.pool.servers) < 2 ||
+		c.pool.checking ||
+		time.Since(c.pool.lastCheck) < c.config.HealthCheckInterval {
+		return
+	}
+
+	c.pool.checking = true
+
+	go func() {
+		c.CheckHealth(context.Background())
+
+		c.pool.Lock()
+		c.pool.checking = false
+		c.pool.Unlock()
+	}()
+}
+
+// isDialError reports whether an error occurred while connecting to a server,
+// in which case the request was not sent
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
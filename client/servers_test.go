@@ -0,0 +1,237 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// testServer is a fake discovery server that counts the requests it receives
+type testServer struct {
+	*httptest.Server
+	requests int32
+}
+
+// newTestServer starts a testServer that answers health checks after delay,
+// and other requests with status and a body parsable as the expected result
+func newTestServer(delay time.Duration, status int) *testServer {
+	ts := &testServer{}
+
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			time.Sleep(delay)
+			return
+		}
+
+		atomic.AddInt32(&ts.requests, 1)
+
+		switch {
+		case status != http.StatusOK:
+			http.Error(w, "Failure", status)
+		case r.Method == http.MethodPost:
+			w.Write([]byte(`"id"`))
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}))
+
+	return ts
+}
+
+// count returns the number of requests received by the server, other than
+// health checks, and resets it
+func (ts *testServer) count() int32 {
+	return atomic.SwapInt32(&ts.requests, 0)
+}
+
+// newTestServersClient creates a client for several test servers, with health
+// checks disabled
+func newTestServersClient(t *testing.T, urls ...string) *DiscoClient {
+	c, err := NewDiscoClientWithServers(urls, "", false, "key", "", "", logrus.New().WithField("component", "disco-client"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.SetConfig(Config{
+		Timeout:    time.Second,
+		MinBackoff: time.Millisecond,
+		MaxBackoff: 5 * time.Millisecond,
+	})
+
+	return c
+}
+
+// Test that requests fail over to the next server when the preferred server is
+// down or unavailable.
+func TestFailover(t *testing.T) {
+	down := newTestServer(0, http.StatusOK)
+	down.Close()
+
+	unavailable := newTestServer(0, http.StatusServiceUnavailable)
+	defer unavailable.Close()
+
+	up := newTestServer(0, http.StatusOK)
+	defer up.Close()
+
+	// Idempotent requests fail over on connection errors and retryable statuses
+
+	c := newTestServersClient(t, down.URL, unavailable.URL, up.URL)
+
+	if _, err := c.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := unavailable.count(); n != 1 {
+		t.Fatalf("Unavailable server should receive 1 request, not %d", n)
+	}
+
+	if n := up.count(); n != 1 {
+		t.Fatalf("Healthy server should receive 1 request, not %d", n)
+	}
+
+	// Failed servers are not preferred anymore
+
+	if _, err := c.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := unavailable.count(); n != 0 {
+		t.Fatalf("Failed server should not receive requests, not %d", n)
+	}
+
+	if n := up.count(); n != 1 {
+		t.Fatalf("Healthy server should receive 1 request, not %d", n)
+	}
+
+	// Other requests only fail over on connection errors, because the failed
+	// server may have processed them
+
+	c = newTestServersClient(t, down.URL, unavailable.URL, up.URL)
+
+	if _, err := c.CreateGroup(group.Group{}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("CreateGroup should return ErrUnavailable, not %v", err)
+	}
+
+	if n := up.count(); n != 0 {
+		t.Fatalf("CreateGroup should not fail over after a response, not send %d requests", n)
+	}
+
+	c = newTestServersClient(t, down.URL, up.URL)
+
+	if _, err := c.CreateGroup(group.Group{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that health checks detect unhealthy servers, and that requests are sent
+// to the healthy server with the lowest latency.
+func TestCheckHealth(t *testing.T) {
+	slow := newTestServer(100*time.Millisecond, http.StatusOK)
+	defer slow.Close()
+
+	fast := newTestServer(0, http.StatusOK)
+	defer fast.Close()
+
+	down := newTestServer(0, http.StatusOK)
+	down.Close()
+
+	c := newTestServersClient(t, down.URL, slow.URL, fast.URL)
+
+	if err := c.CheckHealth(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := fast.count(); n != 1 {
+		t.Fatalf("Fastest server should receive 1 request, not %d", n)
+	}
+
+	if n := slow.count(); n != 0 {
+		t.Fatalf("Slow server should not receive requests, not %d", n)
+	}
+
+	// All servers down
+
+	fast.Close()
+	slow.Close()
+
+	if err := c.CheckHealth(context.Background()); err == nil {
+		t.Fatalf("CheckHealth should fail when all servers are down")
+	}
+
+	// Health checks run in the background
+
+	slow2 := newTestServer(50*time.Millisecond, http.StatusOK)
+	defer slow2.Close()
+
+	fast2 := newTestServer(0, http.StatusOK)
+	defer fast2.Close()
+
+	c = newTestServersClient(t, slow2.URL, fast2.URL)
+	c.config.HealthCheckInterval = time.Hour
+
+	// The first request starts a health check, and is sent to the first server
+	if _, err := c.GetGroups(""); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for c.pool.ordered()[0].url != fast2.URL {
+		if time.Now().After(deadline) {
+			t.Fatalf("Background health check should prefer the fastest server")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Test that srv:// URLs are resolved with DNS SRV records.
+func TestSRV(t *testing.T) {
+	defer func(l func(string, string, string) (string, []*net.SRV, error)) { lookupSRV = l }(lookupSRV)
+
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_disco._tcp.example.com" {
+			return "", nil, fmt.Errorf("no such host")
+		}
+		return "", []*net.SRV{
+			{Target: "disco1.example.com.", Port: 1443},
+			{Target: "disco2.example.com.", Port: 1443},
+		}, nil
+	}
+
+	pool, err := newServerPool([]string{"srv://_disco._tcp.example.com", "localhost:1443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"https://disco1.example.com:1443",
+		"https://disco2.example.com:1443",
+		"https://localhost:1443",
+	}
+
+	for i, e := range pool.ordered() {
+		if e.url != expected[i] {
+			t.Fatalf("Server %d should be %s, not %s", i, expected[i], e.url)
+		}
+	}
+
+	if _, err := newServerPool([]string{"srv://unknown.example.com"}); err == nil {
+		t.Fatalf("Unresolvable SRV name should fail")
+	}
+
+	if _, err := newServerPool(nil); err == nil {
+		t.Fatalf("Server pool without servers should fail")
+	}
+}
@@ -0,0 +1,86 @@
+package client
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// GroupEventType is the type of a GroupEvent
+type GroupEventType string
+
+const (
+	// GroupCreated is the type of events for new groups
+	GroupCreated GroupEventType = "created"
+	// GroupUpdated is the type of events for groups whose Version changed
+	GroupUpdated GroupEventType = "updated"
+	// GroupDeleted is the type of events for deleted groups
+	GroupDeleted GroupEventType = "deleted"
+)
+
+// GroupEvent describes a change to a group, detected by WatchGroups
+type GroupEvent struct {
+	Type  GroupEventType
+	Group *group.Group // last known state of deleted groups
+}
+
+// WatchGroups polls the groups of appID every interval, and calls handler for
+// every group that is created, updated, or deleted, until ctx is done. The
+// first poll reports the existing groups as created. With the cache enabled,
+// polls return 304 Not Modified while the groups do not change. It returns the
+// error of the first failed poll, or the error of ctx when it is done.
+func (c *DiscoClient) WatchGroups(ctx context.Context, appID string, interval time.Duration, handler func(GroupEvent)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	known := make(map[string]*group.Group)
+
+	for {
+		groups, err := c.GetGroupsContext(ctx, appID)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range diffGroups(known, groups) {
+			handler(e)
+		}
+
+		known = groups
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// diffGroups returns the events that turn the old groups into the new ones,
+// ordered by group ID
+func diffGroups(old map[string]*group.Group, new map[string]*group.Group) []GroupEvent {
+	var events []GroupEvent
+
+	for id, g := range new {
+		o, ok := old[id]
+		switch {
+		case !ok:
+			events = append(events, GroupEvent{Type: GroupCreated, Group: g})
+		case o.Version != g.Version:
+			events = append(events, GroupEvent{Type: GroupUpdated, Group: g})
+		}
+	}
+
+	for id, g := range old {
+		if _, ok := new[id]; !ok {
+			events = append(events, GroupEvent{Type: GroupDeleted, Group: g})
+		}
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Group.ID < events[j].Group.ID
+	})
+
+	return events
+}
@@ -0,0 +1,69 @@
+package client
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Test that WatchGroups reports the groups that are created, updated, and
+// deleted between polls.
+func TestWatchGroups(t *testing.T) {
+	// Every poll returns the next state, and the last state forever
+	states := []string{
+		`{"g1": {"ID": "g1", "Version": 1}, "g2": {"ID": "g2", "Version": 1}}`,
+		`{"g1": {"ID": "g1", "Version": 1}, "g2": {"ID": "g2", "Version": 2}}`,
+		`{"g2": {"ID": "g2", "Version": 2}, "g3": {"ID": "g3", "Version": 1}}`,
+	}
+
+	var mu sync.Mutex
+	polls := 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		i := polls
+		if i >= len(states) {
+			i = len(states) - 1
+		}
+		polls++
+
+		w.Write([]byte(states[i]))
+	}))
+	defer server.Close()
+
+	c := newTestClient(t, server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var events []string
+
+	err := c.WatchGroups(ctx, "", time.Millisecond, func(e GroupEvent) {
+		events = append(events, string(e.Type)+" "+e.Group.ID)
+		if len(events) == 5 {
+			cancel()
+		}
+	})
+
+	if err != context.Canceled {
+		t.Fatalf("WatchGroups should return context.Canceled, not %v", err)
+	}
+
+	expected := []string{
+		"created g1",
+		"created g2",
+		"updated g2",
+		"deleted g1",
+		"created g3",
+	}
+
+	if !reflect.DeepEqual(events, expected) {
+		t.Fatalf("Events should be %v, not %v", expected, events)
+	}
+}
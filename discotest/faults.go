@@ -0,0 +1,220 @@
+package discotest
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// ErrInjected is a storage failure, for use as the Err of a Fault
+var ErrInjected = errors.New("discotest: injected storage failure")
+
+// Method identifies a method of the GroupRepository interface
+type Method string
+
+// Methods of the GroupRepository interface
+const (
+	MethodGetAllGroups        Method = "GetAllGroups"
+	MethodGetAllGroupsByAppID Method = "GetAllGroupsByAppID"
+	MethodGetGroup            Method = "GetGroup"
+	MethodSetGroup            Method = "SetGroup"
+	MethodTouchGroup          Method = "TouchGroup"
+	MethodDeleteGroup         Method = "DeleteGroup"
+)
+
+// Methods lists all the methods of the GroupRepository interface
+var Methods = []Method{
+	MethodGetAllGroups,
+	MethodGetAllGroupsByAppID,
+	MethodGetGroup,
+	MethodSetGroup,
+	MethodTouchGroup,
+	MethodDeleteGroup,
+}
+
+// Fault describes a failure injected in the calls of a method of a
+// FaultyGroupRepository
+type Fault struct {
+	// Latency delays every affected call
+	Latency time.Duration
+
+	// Err is returned by every affected call, if not nil
+	Err error
+
+	// Partial makes affected calls reach the underlying repository before Err
+	// is returned, like a storage which applies a write but fails to
+	// acknowledge it. Reads return their result along with Err.
+	Partial bool
+
+	// Skip is the number of calls which are not affected, before the fault
+	// applies
+	Skip int
+
+	// Times is the number of calls affected after Skip. All the calls are
+	// affected if 0.
+	Times int
+}
+
+// faultState counts the calls of a method since its fault was injected
+type faultState struct {
+	Fault
+	calls int
+}
+
+// FaultyGroupRepository implements the GroupRepository interface by wrapping
+// another GroupRepository, and injecting faults in the calls of its methods.
+// It is thread safe, and faults can be changed while it is used.
+type FaultyGroupRepository struct {
+	sync.Mutex
+	repo   group.GroupRepository
+	faults map[Method]*faultState
+	calls  map[Method]int
+}
+
+// NewFaultyGroupRepository instantiates a new FaultyGroupRepository wrapping
+// repo, without faults
+func NewFaultyGroupRepository(repo group.GroupRepository) *FaultyGroupRepository {
+	return &FaultyGroupRepository{
+		repo:   repo,
+		faults: make(map[Method]*faultState),
+		calls:  make(map[Method]int),
+	}
+}
+
+// Inject sets the fault of one or more methods, replacing their previous
+// faults. Use Methods to inject a fault in every method.
+func (f *FaultyGroupRepository) Inject(fault Fault, methods ...Method) {
+	f.Lock()
+	defer f.Unlock()
+
+	for _, m := range methods {
+		f.faults[m] = &faultState{Fault: fault}
+	}
+}
+
+// Clear removes the faults of all the methods
+func (f *FaultyGroupRepository) Clear() {
+	f.Lock()
+	defer f.Unlock()
+
+	f.faults = make(map[Method]*faultState)
+}
+
+// Calls returns the number of calls of a method, with or without faults
+func (f *FaultyGroupRepository) Calls(m Method) int {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.calls[m]
+}
+
+// fault records a call of a method, and returns the fault affecting it, if any
+func (f *FaultyGroupRepository) fault(m Method) *Fault {
+	f.Lock()
+	defer f.Unlock()
+
+	f.calls[m]++
+
+	state, ok := f.faults[m]
+	if !ok {
+		return nil
+	}
+
+	state.calls++
+
+	if state.calls <= state.Skip {
+		return nil
+	}
+
+	if state.Times > 0 && state.calls > state.Skip+state.Times {
+		return nil
+	}
+
+	fault := state.Fault
+
+	return &fault
+}
+
+// call runs a call of a method with the fault affecting it, if any
+func (f *FaultyGroupRepository) call(m Method, call func() error) error {
+	fault := f.fault(m)
+	if fault == nil {
+		return call()
+	}
+
+	time.Sleep(fault.Latency)
+
+	if fault.Err == nil {
+		return call()
+	}
+
+	if fault.Partial {
+		call()
+	}
+
+	return fault.Err
+}
+
+// GetAllGroups implements the GroupRepository interface
+func (f *FaultyGroupRepository) GetAllGroups() (map[string]*group.Group, error) {
+	var res map[string]*group.Group
+
+	err := f.call(MethodGetAllGroups, func() (err error) {
+		res, err = f.repo.GetAllGroups()
+		return err
+	})
+
+	return res, err
+}
+
+// GetAllGroupsByAppID implements the GroupRepository interface
+func (f *FaultyGroupRepository) GetAllGroupsByAppID(appID string) (map[string]*group.Group, error) {
+	var res map[string]*group.Group
+
+	err := f.call(MethodGetAllGroupsByAppID, func() (err error) {
+		res, err = f.repo.GetAllGroupsByAppID(appID)
+		return err
+	})
+
+	return res, err
+}
+
+// GetGroup implements the GroupRepository interface
+func (f *FaultyGroupRepository) GetGroup(groupID string) (*group.Group, error) {
+	var res *group.Group
+
+	err := f.call(MethodGetGroup, func() (err error) {
+		res, err = f.repo.GetGroup(groupID)
+		return err
+	})
+
+	return res, err
+}
+
+// SetGroup implements the GroupRepository interface
+func (f *FaultyGroupRepository) SetGroup(g *group.Group) (string, error) {
+	var res string
+
+	err := f.call(MethodSetGroup, func() (err error) {
+		res, err = f.repo.SetGroup(g)
+		return err
+	})
+
+	return res, err
+}
+
+// TouchGroup implements the GroupRepository interface
+func (f *FaultyGroupRepository) TouchGroup(groupID string) error {
+	return f.call(MethodTouchGroup, func() error {
+		return f.repo.TouchGroup(groupID)
+	})
+}
+
+// DeleteGroup implements the GroupRepository interface
+func (f *FaultyGroupRepository) DeleteGroup(groupID string) error {
+	return f.call(MethodDeleteGroup, func() error {
+		return f.repo.DeleteGroup(groupID)
+	})
+}
@@ -0,0 +1,212 @@
+// Package discotest provides a discovery server for integration tests, in the
+// style of net/http/httptest.
+package discotest
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/mosaicnetworks/disco/server"
+	"github.com/sirupsen/logrus"
+)
+
+// turnPortAttempts is the number of free TURN ports tried by Start, in case
+// another process takes a port before the server binds it
+const turnPortAttempts = 5
+
+// Server is a DiscoServer listening on random local ports, with in-memory
+// repositories, and a self-signed certificate generated at startup.
+type Server struct {
+	// URL of the discovery API, of the form https://127.0.0.1:port, or
+	// http://127.0.0.1:port with insecure HTTP
+	URL string
+
+	// SignalAddr is the address of the WebRTC-signaling server
+	SignalAddr string
+
+	// GRPCAddr is the address of the gRPC server, which uses the same
+	// certificate as the discovery API
+	GRPCAddr string
+
+	// CertFile is a PEM file containing the certificate of the server, for
+	// clients to trust
+	CertFile string
+
+	// Repositories of the server. They can be used to register apps, or to
+	// inspect groups. Groups is in-memory by default, and can be replaced
+	// before Start, e.g. by a FaultyGroupRepository.
+	Groups group.GroupRepository
+	Apps   *app.InmemAppRepository
+
+	// Configuration of the server, which can be changed between
+	// NewUnstartedServer and Start. A free TURN port is chosen if the
+	// TURN Address is empty. The certificate settings of TLS are ignored.
+	AdminKey     string
+	TURN         server.TURNConfig
+	TLS          server.TLSConfig
+	TTL          time.Duration
+	TTLHeartbeat time.Duration
+	Logger       *logrus.Entry
+
+	// Disco is the underlying server, created by Start
+	Disco *server.DiscoServer
+
+	dir string
+}
+
+// NewServer starts and returns a new Server, once it is ready to accept
+// connections. The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a new Server, with a default configuration, but
+// doesn't start it. The caller should call Start, and then Close.
+func NewUnstartedServer() *Server {
+	logger := logrus.New()
+	logger.Level = logrus.ErrorLevel
+
+	return &Server{
+		Groups: group.NewInmemGroupRepository(),
+		Apps:   app.NewInmemAppRepository(),
+		TURN: server.TURNConfig{
+			Realm:    "main",
+			Username: "test",
+			Password: "test",
+		},
+		TTL:          5 * time.Minute,
+		TTLHeartbeat: 1 * time.Minute,
+		Logger:       logger.WithField("component", "disco-server"),
+	}
+}
+
+// Start starts a server from NewUnstartedServer, and returns once it is ready
+// to accept connections. It panics if the server fails to start.
+func (s *Server) Start() {
+	if s.Disco != nil {
+		panic("discotest: Server already started")
+	}
+
+	dir, err := ioutil.TempDir("", "discotest")
+	if err != nil {
+		panic(fmt.Sprintf("discotest: failed to create temporary directory: %v", err))
+	}
+	s.dir = dir
+
+	s.CertFile = filepath.Join(dir, "cert.pem")
+
+	tlsConfig := s.TLS
+	tlsConfig.Dev = true
+	tlsConfig.DevCertFile = s.CertFile
+
+	// The TURN server can not bind a random port, because its address is
+	// advertised to clients. If the TURN port is chosen here, and taken by
+	// another process before the server binds it, the server is started again
+	// with another port.
+	pickTURNPort := s.TURN.Address == ""
+
+	for attempt := 1; ; attempt++ {
+		if pickTURNPort {
+			port, err := freeUDPPort()
+			if err != nil {
+				s.Close()
+				panic(fmt.Sprintf("discotest: failed to find a TURN port: %v", err))
+			}
+			s.TURN.Address = net.JoinHostPort("127.0.0.1", port)
+		}
+
+		s.Disco = server.NewDiscoServer(s.Groups,
+			s.Apps,
+			s.AdminKey,
+			s.TURN,
+			tlsConfig,
+			s.Logger)
+
+		err := s.Disco.Start("127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0", s.TTL, s.TTLHeartbeat)
+		if err == nil {
+			break
+		}
+
+		if pickTURNPort && attempt < turnPortAttempts && errors.Is(err, syscall.EADDRINUSE) {
+			continue
+		}
+
+		s.Close()
+		panic(fmt.Sprintf("discotest: failed to start server: %v", err))
+	}
+
+	scheme := "https"
+	if s.TLS.InsecureHTTP {
+		scheme = "http"
+	}
+
+	s.URL = fmt.Sprintf("%s://%s", scheme, s.Disco.Addr())
+	s.SignalAddr = s.Disco.SignalAddr()
+	s.GRPCAddr = s.Disco.GRPCAddr()
+}
+
+// Close shuts down the server, and removes its certificate file
+func (s *Server) Close() {
+	if s.Disco != nil {
+		s.Disco.Close()
+	}
+
+	if s.dir != "" {
+		os.RemoveAll(s.dir)
+	}
+}
+
+// NewApp registers a new application, and returns it with its API key. It
+// panics if the application can not be created.
+func (s *Server) NewApp(id string) *app.App {
+	a := app.NewApp(id, id)
+
+	if _, err := s.Apps.CreateApp(a); err != nil {
+		panic(fmt.Sprintf("discotest: failed to create app %s: %v", id, err))
+	}
+
+	return a
+}
+
+// Client returns an HTTP client which trusts the certificate of the server
+func (s *Server) Client() *http.Client {
+	pool := x509.NewCertPool()
+
+	if pem, err := ioutil.ReadFile(s.CertFile); err == nil {
+		pool.AppendCertsFromPEM(pem)
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	}
+}
+
+// freeUDPPort returns a UDP port which is free on the loopback interface. The
+// port could be taken by another process before it is used, in which case
+// Start tries another one.
+func freeUDPPort() (string, error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, port, err := net.SplitHostPort(conn.LocalAddr().String())
+
+	return port, err
+}
@@ -0,0 +1,59 @@
+package discotest
+
+import (
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// Test that the server is ready when NewServer returns, that clients can trust
+// its certificate, and that Close shuts it down.
+func TestServer(t *testing.T) {
+	s := NewServer()
+
+	a := s.NewApp("TestApp")
+
+	resp, err := s.Client().Get(s.URL + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Health check should return 200, not %d", resp.StatusCode)
+	}
+
+	// Registered apps can use the discovery API
+
+	req, err := http.NewRequest(http.MethodGet, s.URL+"/groups", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+a.APIKey)
+
+	resp, err = s.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Listing groups should return 200, not %d: %s", resp.StatusCode, body)
+	}
+
+	// Closed servers refuse connections, and other servers use other ports
+
+	other := NewServer()
+	defer other.Close()
+
+	if other.URL == s.URL {
+		t.Fatalf("Servers should listen on different ports, not %s", s.URL)
+	}
+
+	s.Close()
+
+	if _, err := s.Client().Get(s.URL + "/health"); err == nil {
+		t.Fatalf("Closed server should refuse connections")
+	}
+}
@@ -0,0 +1,97 @@
+package group
+
+import (
+	"errors"
+	"fmt"
+)
+
+// AppGroupRepository implements the GroupRepository interface by wrapping
+// another GroupRepository and restricting all operations to the groups of a
+// single AppID. It is used to ensure that an authenticated application can not
+// access the groups of other applications.
+type AppGroupRepository struct {
+	repo  GroupRepository
+	appID string
+}
+
+// NewAppGroupRepository instantiates a new AppGroupRepository scoped to appID
+func NewAppGroupRepository(repo GroupRepository, appID string) *AppGroupRepository {
+	return &AppGroupRepository{
+		repo:  repo,
+		appID: appID,
+	}
+}
+
+// GetAllGroups implements the GroupRepository interface and returns all the
+// groups of the AppID
+func (agr *AppGroupRepository) GetAllGroups() (map[string]*Group, error) {
+	return agr.repo.GetAllGroupsByAppID(agr.appID)
+}
+
+// GetAllGroupsByAppID implements the GroupRepository interface. It returns an
+// error if appID is not the repository's AppID.
+func (agr *AppGroupRepository) GetAllGroupsByAppID(appID string) (map[string]*Group, error) {
+	if appID != agr.appID {
+		return nil, fmt.Errorf("%w to AppID %s", ErrAccessDenied, appID)
+	}
+	return agr.repo.GetAllGroupsByAppID(appID)
+}
+
+// GetGroup implements the GroupRepository interface and returns a group by ID.
+// Groups belonging to other AppIDs are reported as not found.
+func (agr *AppGroupRepository) GetGroup(id string) (*Group, error) {
+	g, err := agr.repo.GetGroup(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if g.AppID != agr.appID {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	return g, nil
+}
+
+// SetGroup implements the GroupRepository interface. If the group's AppID is
+// not set, it is set to the repository's AppID. It is an error to set a group
+// with another AppID, or to override a group belonging to another AppID.
+func (agr *AppGroupRepository) SetGroup(group *Group) (string, error) {
+	if group.AppID == "" {
+		group.AppID = agr.appID
+	}
+
+	if group.AppID != agr.appID {
+		return "", fmt.Errorf("%w to AppID %s", ErrAccessDenied, group.AppID)
+	}
+
+	if group.ID != "" {
+		g, err := agr.repo.GetGroup(group.ID)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return "", err
+		}
+		if err == nil && g.AppID != agr.appID {
+			return "", fmt.Errorf("%w to group %s", ErrAccessDenied, group.ID)
+		}
+	}
+
+	return agr.repo.SetGroup(group)
+}
+
+// TouchGroup implements the GroupRepository interface and refreshes the
+// LastUpdated time of a group. Groups belonging to other AppIDs are reported as
+// not found.
+func (agr *AppGroupRepository) TouchGroup(id string) error {
+	if _, err := agr.GetGroup(id); err != nil {
+		return err
+	}
+	return agr.repo.TouchGroup(id)
+}
+
+// DeleteGroup implements the GroupRepository interface and removes a group.
+// Groups belonging to other AppIDs are reported as not found.
+func (agr *AppGroupRepository) DeleteGroup(id string) error {
+	if _, err := agr.GetGroup(id); err != nil {
+		return err
+	}
+	return agr.repo.DeleteGroup(id)
+}
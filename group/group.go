@@ -9,6 +9,7 @@ type Group struct {
 	AppID        string
 	PubKey       string
 	LastUpdated  int64
+	Version      uint64 // incremented by the repository on every update
 	Peers        []*peers.Peer
 	GenesisPeers []*peers.Peer
 }
@@ -1,6 +1,7 @@
 package group
 
 import (
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -8,18 +9,45 @@ import (
 	"github.com/google/uuid"
 )
 
+// ErrVersionMismatch is returned by SetGroup when the group's Version does not
+// match the Version of the group in the repository
+var ErrVersionMismatch = errors.New("Group version mismatch")
+
+// ErrNotFound is wrapped by the errors of GroupRepositories when a group does
+// not exist
+var ErrNotFound = errors.New("Group not found")
+
+// ErrAccessDenied is wrapped by the errors of GroupRepositories when a group
+// belongs to another application
+var ErrAccessDenied = errors.New("Access denied")
+
+// ErrInvalidGroup is wrapped by the errors of SetGroup when a group can not be
+// saved because it is incomplete
+var ErrInvalidGroup = errors.New("Invalid group")
+
 // GroupRepository defines an interface for a repository where groups can be
 // queried, added, and manipulated. It should be thread safe.
+//
+// SetGroup implements optimistic concurrency: if the group's Version is not 0,
+// the repository must contain a group with the same ID and Version, otherwise
+// SetGroup returns ErrVersionMismatch. Every successful SetGroup increments the
+// Version. TouchGroup refreshes LastUpdated without changing the Version.
+//
+// Errors caused by the arguments wrap ErrNotFound, ErrAccessDenied, or
+// ErrInvalidGroup, so that they can be told apart from failures of the
+// underlying storage with errors.Is.
 type GroupRepository interface {
 	GetAllGroups() (map[string]*Group, error)
 	GetAllGroupsByAppID(appID string) (map[string]*Group, error)
 	GetGroup(groupID string) (*Group, error)
 	SetGroup(group *Group) (string, error)
+	TouchGroup(groupID string) error
 	DeleteGroup(groupID string) error
 }
 
 // InmemGroupRepository implements the GroupRepository interface with an inmem
-// map of groups. It is thread safe.
+// map of groups. It is thread safe. The groups it returns are shared, so they
+// are never modified once they are in the map: changes replace them instead.
 type InmemGroupRepository struct {
 	sync.Mutex
 	groupsByID    map[string]*Group   // [group ID] => Group
@@ -40,7 +68,12 @@ func (igr *InmemGroupRepository) GetAllGroups() (map[string]*Group, error) {
 	igr.Lock()
 	defer igr.Unlock()
 
-	return igr.groupsByID, nil
+	res := make(map[string]*Group, len(igr.groupsByID))
+	for id, g := range igr.groupsByID {
+		res[id] = g
+	}
+
+	return res, nil
 }
 
 // GetAllGroupsByAppID implements the GroupRepository interface and returns all
@@ -70,7 +103,7 @@ func (igr *InmemGroupRepository) GetGroup(id string) (*Group, error) {
 
 	g, ok := igr.groupsByID[id]
 	if !ok {
-		return nil, fmt.Errorf("Group %s not found", id)
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
 	}
 	return g, nil
 }
@@ -78,24 +111,37 @@ func (igr *InmemGroupRepository) GetGroup(id string) (*Group, error) {
 // SetGroup implements the GroupRepository interface and inserts or updates a
 // group in the local map. The group's AppID must be set. If the group's ID is
 // already set and the map already contains a corresponding group, then the
-// value is overriden. If the ID is not set, we assign a random one and insert
-// the group in the map. In any case we return the ID of the group.
+// value is overriden, provided the group's Version is 0 or matches the current
+// Version. If the ID is not set, we assign a random one and insert the group in
+// the map. In any case we return the ID of the group.
 func (igr *InmemGroupRepository) SetGroup(group *Group) (string, error) {
 	if group.AppID == "" {
-		return "", fmt.Errorf("Group AppID not specified")
+		return "", fmt.Errorf("%w: AppID not specified", ErrInvalidGroup)
 	}
 
 	if group.ID == "" {
 		group.ID = uuid.New().String()
 	}
 
-	group.LastUpdated = time.Now().Unix()
-
 	igr.Lock()
 	defer igr.Unlock()
 
+	current, gok := igr.groupsByID[group.ID]
+
+	if group.Version != 0 && (!gok || current.Version != group.Version) {
+		return "", ErrVersionMismatch
+	}
+
+	group.LastUpdated = time.Now().Unix()
+
+	if gok {
+		group.Version = current.Version + 1
+	} else {
+		group.Version = 1
+	}
+
 	// If the group does not exist, add it to the AppID index
-	if _, gok := igr.groupsByID[group.ID]; !gok {
+	if !gok {
 		appGroups, aok := igr.groupsByAppID[group.AppID]
 		if !aok {
 			appGroups = []string{}
@@ -110,6 +156,25 @@ func (igr *InmemGroupRepository) SetGroup(group *Group) (string, error) {
 	return group.ID, nil
 }
 
+// TouchGroup implements the GroupRepository interface and sets the LastUpdated
+// time of a group to now. The group is replaced by a copy, because the current
+// one may be read concurrently by the callers of the other methods.
+func (igr *InmemGroupRepository) TouchGroup(id string) error {
+	igr.Lock()
+	defer igr.Unlock()
+
+	g, ok := igr.groupsByID[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+
+	gc := *g
+	gc.LastUpdated = time.Now().Unix()
+	igr.groupsByID[id] = &gc
+
+	return nil
+}
+
 // DeleteGroup implements the GroupRepository interface and removes a group from
 // the map
 func (igr *InmemGroupRepository) DeleteGroup(id string) error {
@@ -1,6 +1,8 @@
 package group
 
 import (
+	"encoding/json"
+	"errors"
 	"reflect"
 	"testing"
 
@@ -157,3 +159,287 @@ func TestGetGroups(t *testing.T) {
 		t.Fatalf("App2 should contain 1 group, not %d", len(app2Groups))
 	}
 }
+
+// Test that an AppGroupRepository can only access the groups of its AppID.
+func TestAppGroupRepository(t *testing.T) {
+	repo := NewInmemGroupRepository()
+
+	app1Repo := NewAppGroupRepository(repo, "TestApp1")
+	app2Repo := NewAppGroupRepository(repo, "TestApp2")
+
+	// AppID is set automatically
+
+	group1 := NewGroup(
+		"",
+		"TestGroup1",
+		"",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+
+	group1ID, err := app1Repo.SetGroup(group1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if group1.AppID != "TestApp1" {
+		t.Fatalf("group AppID should be TestApp1, not %s", group1.AppID)
+	}
+
+	// Groups of other apps are not visible
+
+	if _, err := app2Repo.GetGroup(group1ID); err == nil {
+		t.Fatalf("App2 should not be able to get App1's group")
+	}
+
+	app2Groups, err := app2Repo.GetAllGroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(app2Groups) != 0 {
+		t.Fatalf("App2 should see 0 groups, not %d", len(app2Groups))
+	}
+
+	if _, err := app2Repo.GetAllGroupsByAppID("TestApp1"); err == nil {
+		t.Fatalf("App2 should not be able to list App1's groups")
+	}
+
+	// Groups of other apps can not be created, overridden, or deleted
+
+	if _, err := app2Repo.SetGroup(NewGroup("", "TestGroup2", "TestApp1", nil)); err == nil {
+		t.Fatalf("App2 should not be able to create a group for App1")
+	}
+
+	if _, err := app2Repo.SetGroup(NewGroup(group1ID, "Hijacked", "TestApp2", nil)); err == nil {
+		t.Fatalf("App2 should not be able to override App1's group")
+	}
+
+	if err := app2Repo.DeleteGroup(group1ID); err == nil {
+		t.Fatalf("App2 should not be able to delete App1's group")
+	}
+
+	retrievedGroup, err := app1Repo.GetGroup(group1ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if retrievedGroup.Name != "TestGroup1" {
+		t.Fatalf("group Name should be TestGroup1, not %s", retrievedGroup.Name)
+	}
+
+	if err := app1Repo.DeleteGroup(group1ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that updates are rejected when the group's Version does not match the
+// Version in the repository, and that touching a group does not change its
+// Version.
+func TestGroupVersion(t *testing.T) {
+	repo := NewInmemGroupRepository()
+
+	groupID, err := repo.SetGroup(NewGroup("", "TestGroup", "TestApp", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := repo.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Version != 1 {
+		t.Fatalf("group Version should be 1, not %d", g.Version)
+	}
+
+	// Update with the current version
+
+	update := NewGroup(groupID, "Updated", "TestApp", nil)
+	update.Version = 1
+
+	if _, err := repo.SetGroup(update); err != nil {
+		t.Fatal(err)
+	}
+
+	if update.Version != 2 {
+		t.Fatalf("group Version should be 2, not %d", update.Version)
+	}
+
+	// Update with a stale version
+
+	stale := NewGroup(groupID, "Stale", "TestApp", nil)
+	stale.Version = 1
+
+	if _, err := repo.SetGroup(stale); err != ErrVersionMismatch {
+		t.Fatalf("Update with stale version should return ErrVersionMismatch, not %v", err)
+	}
+
+	g, err = repo.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Name != "Updated" {
+		t.Fatalf("group Name should be Updated, not %s", g.Name)
+	}
+
+	// Creating a group with a version fails
+
+	if _, err := repo.SetGroup(&Group{AppID: "TestApp", Version: 1}); err != ErrVersionMismatch {
+		t.Fatalf("Creating a group with a version should return ErrVersionMismatch, not %v", err)
+	}
+
+	// Unconditional update
+
+	if _, err := repo.SetGroup(NewGroup(groupID, "Unconditional", "TestApp", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Touch
+
+	g.LastUpdated = 0
+
+	if err := repo.TouchGroup(groupID); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err = repo.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.LastUpdated == 0 {
+		t.Fatalf("group LastUpdated should be refreshed")
+	}
+
+	if g.Version != 3 {
+		t.Fatalf("group Version should be 3, not %d", g.Version)
+	}
+
+	if err := repo.TouchGroup("unknown"); err == nil {
+		t.Fatalf("Touching an unknown group should fail")
+	}
+}
+
+// Test that the errors caused by the arguments of the repositories can be told
+// apart with errors.Is.
+func TestRepositoryErrors(t *testing.T) {
+	repo := NewInmemGroupRepository()
+
+	groupID, err := repo.SetGroup(NewGroup("", "TestGroup", "TestApp1", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app2Repo := NewAppGroupRepository(repo, "TestApp2")
+
+	cases := map[string]struct {
+		err      error
+		expected error
+	}{
+		"unknown group": {
+			err:      func() error { _, err := repo.GetGroup("unknown"); return err }(),
+			expected: ErrNotFound,
+		},
+		"touch unknown group": {
+			err:      repo.TouchGroup("unknown"),
+			expected: ErrNotFound,
+		},
+		"group without AppID": {
+			err:      func() error { _, err := repo.SetGroup(&Group{}); return err }(),
+			expected: ErrInvalidGroup,
+		},
+		"group of another app": {
+			err:      func() error { _, err := app2Repo.GetGroup(groupID); return err }(),
+			expected: ErrNotFound,
+		},
+		"groups of another app": {
+			err:      func() error { _, err := app2Repo.GetAllGroupsByAppID("TestApp1"); return err }(),
+			expected: ErrAccessDenied,
+		},
+		"override group of another app": {
+			err:      func() error { _, err := app2Repo.SetGroup(NewGroup(groupID, "Hijacked", "", nil)); return err }(),
+			expected: ErrAccessDenied,
+		},
+	}
+
+	for name, c := range cases {
+		if !errors.Is(c.err, c.expected) {
+			t.Fatalf("Error for %s should match %v, not %v", name, c.expected, c.err)
+		}
+	}
+}
+
+// Test that heartbeats do not modify the groups returned to concurrent readers.
+// Data races are reported by go test -race.
+func TestTouchGroupConcurrentReads(t *testing.T) {
+	repo := NewInmemGroupRepository()
+
+	groupID, err := repo.SetGroup(NewGroup("", "TestGroup", "TestApp", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := repo.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lastUpdated := before.LastUpdated
+
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 1000; i++ {
+			if err := repo.TouchGroup(groupID); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	for reading := true; reading; {
+		select {
+		case <-done:
+			reading = false
+		default:
+		}
+
+		g, err := repo.GetGroup(groupID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := json.Marshal(g); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := MergePatch(g, []byte(`{"Name": "Patched"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		groups, err := repo.GetAllGroups()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, g := range groups {
+			_ = g.LastUpdated
+		}
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	default:
+	}
+
+	if before.LastUpdated != lastUpdated {
+		t.Fatalf("Heartbeat should not modify a group returned earlier")
+	}
+}
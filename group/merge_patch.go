@@ -0,0 +1,75 @@
+package group
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MergePatch applies a JSON Merge Patch (RFC 7396) to a group and returns the
+// patched copy. The original group is not modified. The patch can not change
+// the group's ID or AppID. LastUpdated and Version are managed by the
+// repository, so they are left untouched.
+func MergePatch(group *Group, patch []byte) (*Group, error) {
+	var patchDoc interface{}
+	if err := json.Unmarshal(patch, &patchDoc); err != nil {
+		return nil, fmt.Errorf("Error parsing patch: %v", err)
+	}
+
+	original, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc interface{}
+	if err := json.Unmarshal(original, &doc); err != nil {
+		return nil, err
+	}
+
+	patched, err := json.Marshal(mergePatch(doc, patchDoc))
+	if err != nil {
+		return nil, err
+	}
+
+	var res Group
+	if err := json.Unmarshal(patched, &res); err != nil {
+		return nil, fmt.Errorf("Error applying patch: %v", err)
+	}
+
+	if res.ID != group.ID {
+		return nil, fmt.Errorf("Patch can not change group ID")
+	}
+
+	if res.AppID != group.AppID {
+		return nil, fmt.Errorf("Patch can not change group AppID")
+	}
+
+	res.LastUpdated = group.LastUpdated
+	res.Version = group.Version
+
+	return &res, nil
+}
+
+// mergePatch implements the MergePatch algorithm of RFC 7396. Members of patch
+// objects replace the members of target objects, recursively, and null members
+// remove them. Any other patch value replaces the target.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for name, value := range patchObj {
+		if value == nil {
+			delete(targetObj, name)
+			continue
+		}
+		targetObj[name] = mergePatch(targetObj[name], value)
+	}
+
+	return targetObj
+}
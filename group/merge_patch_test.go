@@ -0,0 +1,75 @@
+package group
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mosaicnetworks/babble/src/peers"
+)
+
+// Test that merge patches replace, add, and remove fields, and can not change
+// the identity of the group.
+func TestMergePatch(t *testing.T) {
+	g := NewGroup(
+		"group1",
+		"TestGroup",
+		"TestApp",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+	g.PubKey = "key"
+	g.LastUpdated = 10
+	g.Version = 3
+
+	patched, err := MergePatch(g, []byte(`{
+		"Name": "Renamed",
+		"PubKey": null,
+		"Peers": [{"PubKeyHex": "pub2", "NetAddr": "net2", "Moniker": "peer2"}],
+		"LastUpdated": 20,
+		"Version": 7
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &Group{
+		ID:           "group1",
+		Name:         "Renamed",
+		AppID:        "TestApp",
+		LastUpdated:  10,
+		Version:      3,
+		Peers:        []*peers.Peer{peers.NewPeer("pub2", "net2", "peer2")},
+		GenesisPeers: g.GenesisPeers,
+	}
+
+	if !reflect.DeepEqual(patched, expected) {
+		t.Fatalf("Patched group should be %#v, not %#v", expected, patched)
+	}
+
+	// The original group is not modified
+
+	if g.Name != "TestGroup" || g.PubKey != "key" {
+		t.Fatalf("Original group should not be modified")
+	}
+
+	// Identity can not change
+
+	if _, err := MergePatch(g, []byte(`{"ID": "group2"}`)); err == nil {
+		t.Fatalf("Patch should not change the group ID")
+	}
+
+	if _, err := MergePatch(g, []byte(`{"AppID": "OtherApp"}`)); err == nil {
+		t.Fatalf("Patch should not change the group AppID")
+	}
+
+	// Invalid patches
+
+	if _, err := MergePatch(g, []byte(`{`)); err == nil {
+		t.Fatalf("Invalid JSON patch should fail")
+	}
+
+	if _, err := MergePatch(g, []byte(`{"Peers": "none"}`)); err == nil {
+		t.Fatalf("Patch producing an invalid group should fail")
+	}
+}
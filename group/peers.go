@@ -0,0 +1,86 @@
+package group
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/mosaicnetworks/babble/src/common"
+	"github.com/mosaicnetworks/babble/src/crypto/keys"
+	"github.com/mosaicnetworks/babble/src/peers"
+)
+
+// ValidatePeers checks that a list of peers can be used by Babble. It must not
+// be empty, every PubKeyHex must be a 0X-prefixed uncompressed secp256k1 public
+// key, no public key may appear twice, and every NetAddr must be empty (when
+// peers connect over WebRTC) or of the form host:port.
+func ValidatePeers(ps []*peers.Peer) error {
+	if len(ps) == 0 {
+		return fmt.Errorf("No peers")
+	}
+
+	seen := make(map[string]bool)
+
+	for i, p := range ps {
+		if p == nil {
+			return fmt.Errorf("Peer %d is null", i)
+		}
+
+		if err := validatePubKey(p.PubKeyHex); err != nil {
+			return fmt.Errorf("Peer %d (%s): %v", i, p.Moniker, err)
+		}
+
+		if seen[p.PubKeyString()] {
+			return fmt.Errorf("Peer %d (%s): Duplicate public key %s", i, p.Moniker, p.PubKeyHex)
+		}
+		seen[p.PubKeyString()] = true
+
+		if err := validateNetAddr(p.NetAddr); err != nil {
+			return fmt.Errorf("Peer %d (%s): %v", i, p.Moniker, err)
+		}
+	}
+
+	return nil
+}
+
+// validatePubKey checks that a public key is in the format of Babble's
+// keys.PublicKeyHex
+func validatePubKey(pubKeyHex string) error {
+	if !strings.HasPrefix(strings.ToUpper(pubKeyHex), "0X") {
+		return fmt.Errorf("Public key %q should start with 0X", pubKeyHex)
+	}
+
+	pubKey, err := common.DecodeFromString(pubKeyHex)
+	if err != nil {
+		return fmt.Errorf("Invalid public key %q: %v", pubKeyHex, err)
+	}
+
+	if pub := keys.ToPublicKey(pubKey); pub == nil || pub.X == nil {
+		return fmt.Errorf("Public key %q is not an uncompressed secp256k1 public key", pubKeyHex)
+	}
+
+	return nil
+}
+
+// validateNetAddr checks that an address is empty or of the form host:port
+func validateNetAddr(netAddr string) error {
+	if netAddr == "" {
+		return nil
+	}
+
+	host, port, err := net.SplitHostPort(netAddr)
+	if err != nil {
+		return fmt.Errorf("Invalid address %q: %v", netAddr, err)
+	}
+
+	if host == "" {
+		return fmt.Errorf("Address %q has no host", netAddr)
+	}
+
+	if p, err := strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+		return fmt.Errorf("Address %q has an invalid port", netAddr)
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package group
+
+import (
+	"testing"
+
+	"github.com/mosaicnetworks/babble/src/crypto/keys"
+	"github.com/mosaicnetworks/babble/src/peers"
+)
+
+// newTestPeer creates a peer with a new public key
+func newTestPeer(t *testing.T, netAddr string, moniker string) *peers.Peer {
+	key, err := keys.GenerateECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return peers.NewPeer(keys.PublicKeyHex(&key.PublicKey), netAddr, moniker)
+}
+
+// Test that ValidatePeers accepts peers usable by Babble, and rejects invalid
+// keys and addresses.
+func TestValidatePeers(t *testing.T) {
+	valid := []*peers.Peer{
+		newTestPeer(t, "192.168.1.1:1337", "alice"),
+		newTestPeer(t, "", "bob"),
+		newTestPeer(t, "babble.example.com:1337", "charlie"),
+	}
+
+	if err := ValidatePeers(valid); err != nil {
+		t.Fatalf("Valid peers should be accepted, not %v", err)
+	}
+
+	dup := newTestPeer(t, "", "dup")
+
+	invalid := map[string][]*peers.Peer{
+		"no peers":          nil,
+		"null peer":         {nil},
+		"no prefix":         {peers.NewPeer(valid[0].PubKeyHex[2:], "", "")},
+		"not hex":           {peers.NewPeer("0Xpubkey", "", "")},
+		"not on curve":      {peers.NewPeer("0X04"+valid[0].PubKeyHex[4:len(valid[0].PubKeyHex)-2]+"00", "", "")},
+		"compressed key":    {peers.NewPeer(valid[0].PubKeyHex[:68], "", "")},
+		"duplicate key":     {dup, peers.NewPeer(dup.PubKeyHex, "", "")},
+		"no port":           {newTestPeer(t, "192.168.1.1", "")},
+		"invalid port":      {newTestPeer(t, "192.168.1.1:http", "")},
+		"port out of range": {newTestPeer(t, "192.168.1.1:65536", "")},
+		"no host":           {newTestPeer(t, ":1337", "")},
+	}
+
+	for name, ps := range invalid {
+		if err := ValidatePeers(ps); err == nil {
+			t.Fatalf("Peers with %s should be rejected", name)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+package ice
+
+// ICEServer describes a STUN or TURN server that WebRTC peers can use to
+// establish a connection. Unlike the rest of the disco API, it uses the field
+// names of the WebRTC RTCIceServer dictionary, so that a list of ICEServers can
+// be passed as is to the iceServers of an RTCPeerConnection.
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// NewICEServer generates a new ICEServer
+func NewICEServer(urls []string, username string, credential string) *ICEServer {
+	return &ICEServer{
+		URLs:       urls,
+		Username:   username,
+		Credential: credential,
+	}
+}
@@ -0,0 +1,86 @@
+package proto
+
+import (
+	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// FromGroup converts a group to its protobuf message
+func FromGroup(g *group.Group) *Group {
+	if g == nil {
+		return nil
+	}
+
+	return &Group{
+		ID:           g.ID,
+		Name:         g.Name,
+		AppID:        g.AppID,
+		PubKey:       g.PubKey,
+		LastUpdated:  g.LastUpdated,
+		Version:      g.Version,
+		Peers:        fromPeers(g.Peers),
+		GenesisPeers: fromPeers(g.GenesisPeers),
+	}
+}
+
+// ToGroup converts a protobuf message to a group
+func ToGroup(g *Group) *group.Group {
+	if g == nil {
+		return nil
+	}
+
+	return &group.Group{
+		ID:           g.ID,
+		Name:         g.Name,
+		AppID:        g.AppID,
+		PubKey:       g.PubKey,
+		LastUpdated:  g.LastUpdated,
+		Version:      g.Version,
+		Peers:        toPeers(g.Peers),
+		GenesisPeers: toPeers(g.GenesisPeers),
+	}
+}
+
+// FromGroups converts a map of groups indexed by ID to protobuf messages
+func FromGroups(groups map[string]*group.Group) map[string]*Group {
+	res := make(map[string]*Group, len(groups))
+	for id, g := range groups {
+		res[id] = FromGroup(g)
+	}
+	return res
+}
+
+// ToGroups converts a map of protobuf messages indexed by ID to groups
+func ToGroups(groups map[string]*Group) map[string]*group.Group {
+	res := make(map[string]*group.Group, len(groups))
+	for id, g := range groups {
+		res[id] = ToGroup(g)
+	}
+	return res
+}
+
+// fromPeers converts peers to protobuf messages. Nil peers, which protobuf can
+// not represent, are skipped.
+func fromPeers(ps []*peers.Peer) []*Peer {
+	var res []*Peer
+	for _, p := range ps {
+		if p == nil {
+			continue
+		}
+		res = append(res, &Peer{
+			NetAddr:   p.NetAddr,
+			PubKeyHex: p.PubKeyHex,
+			Moniker:   p.Moniker,
+		})
+	}
+	return res
+}
+
+// toPeers converts protobuf messages to peers
+func toPeers(ps []*Peer) []*peers.Peer {
+	var res []*peers.Peer
+	for _, p := range ps {
+		res = append(res, peers.NewPeer(p.PubKeyHex, p.NetAddr, p.Moniker))
+	}
+	return res
+}
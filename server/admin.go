@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/mosaicnetworks/disco/app"
+)
+
+func (s *DiscoServer) createApp(w http.ResponseWriter, r *http.Request) {
+	var newApp app.App
+	reqBody, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	err = json.Unmarshal(reqBody, &newApp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error unmarshalling app: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	_, err = s.apps.CreateApp(&newApp)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error creating app: %v", err), http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newApp)
+}
+
+func (s *DiscoServer) getApps(w http.ResponseWriter, r *http.Request) {
+	apps, err := s.apps.GetAllApps()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting apps: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(apps)
+}
+
+func (s *DiscoServer) getApp(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["id"]
+
+	a, err := s.apps.GetApp(appID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting app %s: %v", appID, err), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(a)
+}
+
+func (s *DiscoServer) rotateAPIKey(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["id"]
+
+	apiKey, err := s.apps.RotateAPIKey(appID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rotating API key of app %s: %v", appID, err), http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(apiKey)
+}
+
+func (s *DiscoServer) revokeApp(w http.ResponseWriter, r *http.Request) {
+	appID := mux.Vars(r)["id"]
+
+	err := s.apps.RevokeApp(appID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error revoking app %s: %v", appID, err), http.StatusNotFound)
+		return
+	}
+
+	fmt.Fprintf(w, "The app with ID %v has been revoked successfully", appID)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// contextKey is the type of the keys used to store values in request contexts
+type contextKey int
+
+const (
+	// appContextKey is the key of the authenticated App in request contexts
+	appContextKey contextKey = iota
+	// identityContextKey is the key of the clientIdentity in request contexts
+	identityContextKey
+)
+
+// clientIdentity is the identity asserted by a verified client certificate. The
+// Common Name of the certificate's subject identifies the client (typically a
+// device), and its first Organizational Unit, if any, the App it belongs to.
+type clientIdentity struct {
+	Name  string
+	AppID string
+}
+
+// certificateIdentity returns the identity of the client certificate verified
+// during a TLS handshake, or nil if the client did not present one.
+func certificateIdentity(state *tls.ConnectionState) *clientIdentity {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+
+	subject := state.VerifiedChains[0][0].Subject
+
+	id := &clientIdentity{
+		Name: subject.CommonName,
+	}
+
+	if len(subject.OrganizationalUnit) > 0 {
+		id.AppID = subject.OrganizationalUnit[0]
+	}
+
+	return id
+}
+
+// bearerToken extracts the token from a request's "Authorization: Bearer"
+// header. It returns the empty string if there is no such header.
+func bearerToken(r *http.Request) string {
+	return parseBearerToken(r.Header.Get("Authorization"))
+}
+
+// parseBearerToken extracts the token from the value of an "Authorization:
+// Bearer" header. It returns the empty string if the value has another scheme.
+func parseBearerToken(auth string) string {
+	const prefix = "Bearer "
+
+	if !strings.HasPrefix(auth, prefix) {
+		return ""
+	}
+
+	return strings.TrimSpace(auth[len(prefix):])
+}
+
+// authError is returned by authenticate when a client can not be authenticated.
+// Status is the HTTP status of the error.
+type authError struct {
+	Status  int
+	Message string
+}
+
+// Error implements the error interface
+func (e *authError) Error() string {
+	return e.Message
+}
+
+// authenticate returns the App designated by the API key, or by the identity of
+// a client certificate. When both are provided, they must designate the same
+// App.
+func (s *DiscoServer) authenticate(apiKey string, id *clientIdentity) (*app.App, *authError) {
+	switch {
+	case apiKey != "":
+		a, err := s.apps.GetAppByAPIKey(apiKey)
+		if err != nil {
+			return nil, &authError{http.StatusUnauthorized, "Invalid API key"}
+		}
+
+		if id != nil && id.AppID != "" && id.AppID != a.ID {
+			return nil, &authError{http.StatusForbidden, "Client certificate does not belong to the application"}
+		}
+
+		return a, nil
+	case id != nil && id.AppID != "":
+		a, err := s.apps.GetApp(id.AppID)
+		if err != nil || a.Revoked {
+			return nil, &authError{http.StatusUnauthorized, "Invalid client certificate application"}
+		}
+
+		return a, nil
+	default:
+		return nil, &authError{http.StatusUnauthorized, "Missing API key"}
+	}
+}
+
+// withAuthentication returns a copy of ctx holding the authenticated App, and
+// the certificate identity if any
+func withAuthentication(ctx context.Context, a *app.App, id *clientIdentity) context.Context {
+	ctx = context.WithValue(ctx, appContextKey, a)
+	if id != nil {
+		ctx = context.WithValue(ctx, identityContextKey, id)
+	}
+	return ctx
+}
+
+// authenticateApp is a middleware which authenticates requests with the API key
+// of a registered App, or with a client certificate whose subject names a
+// registered App. When both are provided, they must designate the same App. The
+// App is stored in the request context where it can be retrieved with
+// requestApp, and the certificate identity, if any, with contextIdentity.
+func (s *DiscoServer) authenticateApp(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := certificateIdentity(r.TLS)
+
+		a, err := s.authenticate(bearerToken(r), id)
+		if err != nil {
+			http.Error(w, err.Message, err.Status)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(withAuthentication(r.Context(), a, id)))
+	})
+}
+
+// authenticateAdmin is a middleware which restricts access to requests bearing
+// the admin key. The admin API is disabled when no admin key is configured.
+func (s *DiscoServer) authenticateAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminKey == "" {
+			http.Error(w, "Admin API disabled", http.StatusForbidden)
+			return
+		}
+
+		key := bearerToken(r)
+		if subtle.ConstantTimeCompare([]byte(key), []byte(s.adminKey)) != 1 {
+			http.Error(w, "Invalid admin key", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestApp returns the App authenticated by the authenticateApp middleware
+func requestApp(r *http.Request) *app.App {
+	return contextApp(r.Context())
+}
+
+// contextApp returns the App stored in a context by withAuthentication
+func contextApp(ctx context.Context) *app.App {
+	a, _ := ctx.Value(appContextKey).(*app.App)
+	return a
+}
+
+// contextIdentity returns the client certificate identity stored in a context
+// by withAuthentication, or nil if the client did not present a certificate.
+func contextIdentity(ctx context.Context) *clientIdentity {
+	id, _ := ctx.Value(identityContextKey).(*clientIdentity)
+	return id
+}
+
+// logGroupWrite logs a change made to a group by the authenticated App, and by
+// the device named in its client certificate, if any
+func (s *DiscoServer) logGroupWrite(ctx context.Context, action string, groupID string) {
+	fields := logrus.Fields{
+		"app":   contextApp(ctx).ID,
+		"group": groupID,
+	}
+
+	if id := contextIdentity(ctx); id != nil {
+		fields["device"] = id.Name
+	}
+
+	s.logger.WithFields(fields).Infof("Group %s", action)
+}
+
+// groupRepo returns a GroupRepository scoped to the App authenticated by the
+// authenticateApp middleware
+func (s *DiscoServer) groupRepo(r *http.Request) group.GroupRepository {
+	return s.contextGroupRepo(r.Context())
+}
+
+// contextGroupRepo returns a GroupRepository scoped to the App stored in a
+// context by withAuthentication
+func (s *DiscoServer) contextGroupRepo(ctx context.Context) group.GroupRepository {
+	return group.NewAppGroupRepository(s.repo, contextApp(ctx).ID)
+}
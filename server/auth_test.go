@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// loadTestClientCert loads the client certificate issued to device1 of TestApp1
+// by the test client CA
+func loadTestClientCert(t *testing.T) *x509.Certificate {
+	raw, err := ioutil.ReadFile("../test_data/client-cert.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		t.Fatalf("Failed to decode client certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert
+}
+
+// Test that requests are authenticated with API keys and client certificates,
+// and that the client certificate identity is available to handlers.
+func TestAuthenticateApp(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	app1 := app.NewApp("TestApp1", "Test Application 1")
+	if _, err := apps.CreateApp(app1); err != nil {
+		t.Fatal(err)
+	}
+
+	app2 := app.NewApp("TestApp2", "Test Application 2")
+	if _, err := apps.CreateApp(app2); err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewDiscoServer(nil, apps, "", TURNConfig{}, TLSConfig{}, logrus.New().WithField("component", "disco-server"))
+
+	var authApp *app.App
+	var authID *clientIdentity
+
+	handler := s.authenticateApp(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authApp = requestApp(r)
+		authID = contextIdentity(r.Context())
+	}))
+
+	cert := loadTestClientCert(t)
+
+	request := func(apiKey string, withCert bool) int {
+		authApp, authID = nil, nil
+
+		req := httptest.NewRequest(http.MethodGet, "/groups", nil)
+		if apiKey != "" {
+			req.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		if withCert {
+			req.TLS = &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			}
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+
+		return w.Code
+	}
+
+	// API key only
+
+	if code := request(app1.APIKey, false); code != http.StatusOK {
+		t.Fatalf("Request with API key should succeed, not return %d", code)
+	}
+
+	if authApp == nil || authApp.ID != "TestApp1" {
+		t.Fatalf("Request with API key should be authenticated as TestApp1, not %v", authApp)
+	}
+
+	if authID != nil {
+		t.Fatalf("Request without client certificate should have no identity, not %v", authID)
+	}
+
+	// Client certificate only
+
+	if code := request("", true); code != http.StatusOK {
+		t.Fatalf("Request with client certificate should succeed, not return %d", code)
+	}
+
+	if authApp == nil || authApp.ID != "TestApp1" {
+		t.Fatalf("Request with client certificate should be authenticated as TestApp1, not %v", authApp)
+	}
+
+	if authID == nil || authID.Name != "device1" || authID.AppID != "TestApp1" {
+		t.Fatalf("Client certificate identity should be device1 of TestApp1, not %v", authID)
+	}
+
+	// Client certificate with the API key of the same app
+
+	if code := request(app1.APIKey, true); code != http.StatusOK {
+		t.Fatalf("Request with matching API key and certificate should succeed, not return %d", code)
+	}
+
+	// Client certificate with the API key of another app
+
+	if code := request(app2.APIKey, true); code != http.StatusForbidden {
+		t.Fatalf("Request with mismatching API key and certificate should return %d, not %d", http.StatusForbidden, code)
+	}
+
+	// Neither API key nor client certificate
+
+	if code := request("", false); code != http.StatusUnauthorized {
+		t.Fatalf("Request without credentials should return %d, not %d", http.StatusUnauthorized, code)
+	}
+
+	// Client certificate of a revoked app
+
+	if err := apps.RevokeApp("TestApp1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := request("", true); code != http.StatusUnauthorized {
+		t.Fatalf("Request with certificate of revoked app should return %d, not %d", http.StatusUnauthorized, code)
+	}
+}
+
+// Test that group writes are logged with the device named in the client
+// certificate
+func TestLogGroupWrite(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	if _, err := apps.CreateApp(app.NewApp("TestApp1", "Test Application 1")); err != nil {
+		t.Fatal(err)
+	}
+
+	logger, hook := test.NewNullLogger()
+
+	s := NewDiscoServer(group.NewInmemGroupRepository(), apps, "", TURNConfig{}, TLSConfig{}, logger.WithField("component", "disco-server"))
+
+	req := httptest.NewRequest(http.MethodPost, "/group", strings.NewReader(`{"Name": "TestGroup"}`))
+	req.TLS = &tls.ConnectionState{
+		VerifiedChains: [][]*x509.Certificate{{loadTestClientCert(t)}},
+	}
+
+	w := httptest.NewRecorder()
+	s.router().ServeHTTP(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Creating a group should return %d, not %d", http.StatusCreated, w.Code)
+	}
+
+	entry := hook.LastEntry()
+	if entry == nil || entry.Message != "Group created" {
+		t.Fatalf("Group creation should be logged, not %v", entry)
+	}
+
+	if entry.Data["app"] != "TestApp1" || entry.Data["device"] != "device1" || entry.Data["group"] == "" {
+		t.Fatalf("Group creation should be logged with the app, device and group, not %v", entry.Data)
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sirupsen/logrus"
+)
+
+// TLSConfig configures the TLS certificates of the discovery API, the WAMP
+// server, and the TURN TLS listener.
+type TLSConfig struct {
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string // CA bundle of discovery API client certificates. Not required if empty
+
+	// Dev replaces the certificate files with a self-signed certificate,
+	// generated in memory at startup. It is written to DevCertFile, if set, so
+	// that clients can trust it.
+	Dev         bool
+	DevCertFile string
+
+	// InsecureHTTP serves the discovery API over plaintext HTTP. It should only
+	// be used locally.
+	InsecureHTTP bool
+}
+
+// devCertHosts are the names and addresses of the self-signed certificate
+// generated in dev mode
+var devCertHosts = []string{"localhost", "127.0.0.1", "::1"}
+
+// devCertValidity is the validity period of the self-signed certificate
+// generated in dev mode
+const devCertValidity = 365 * 24 * time.Hour
+
+// certReloadDelay is how long certReloader waits after a change to the
+// certificate files before reloading them, so that the certificate and the key
+// can both be replaced
+const certReloadDelay = 500 * time.Millisecond
+
+// certReloader holds a TLS certificate loaded from a pair of files. The
+// certificate can be reloaded while servers are using it, so that renewing it
+// does not require a restart. It is thread safe.
+type certReloader struct {
+	sync.RWMutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+}
+
+// newCertReloader instantiates a certReloader and loads the certificate
+func newCertReloader(certFile string, keyFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// newSelfSignedCertReloader instantiates a certReloader with a new self-signed
+// certificate for hosts. The certificate only exists in memory, so it can not be
+// reloaded.
+func newSelfSignedCertReloader(hosts []string) (*certReloader, error) {
+	cert, err := generateSelfSignedCert(hosts, devCertValidity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certReloader{cert: cert}, nil
+}
+
+// generateSelfSignedCert creates a self-signed certificate, and its ECDSA key,
+// for a list of DNS names and IP addresses.
+func generateSelfSignedCert(hosts []string, validity time.Duration) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("Error generating key: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("Error generating serial number: %s", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Disco Dev"}, CommonName: hosts[0]},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("Error creating certificate: %s", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// writeCert writes the current certificate to a PEM file. The key is not
+// written.
+func (cr *certReloader) writeCert(path string) error {
+	cr.RLock()
+	defer cr.RUnlock()
+
+	var certPEM []byte
+	for _, der := range cr.cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := ioutil.WriteFile(path, certPEM, 0644); err != nil {
+		return fmt.Errorf("Error writing certificate: %s", err)
+	}
+
+	return nil
+}
+
+// reload loads the certificate from the files. If they can not be loaded, the
+// current certificate is left untouched.
+func (cr *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading X509 key pair: %s", err)
+	}
+
+	cr.Lock()
+	defer cr.Unlock()
+
+	cr.cert = &cert
+
+	return nil
+}
+
+// getCertificate implements tls.Config.GetCertificate
+func (cr *certReloader) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.RLock()
+	defer cr.RUnlock()
+
+	return cr.cert, nil
+}
+
+// tlsConfig returns a TLS configuration serving the current certificate
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: cr.getCertificate,
+	}
+}
+
+// watch reloads the certificate whenever the certificate or key file changes.
+// It watches the directories containing the files, rather than the files
+// themselves, so that files replaced by a rename (as done by most certificate
+// renewal tools) are still picked up. It returns when done is closed.
+func (cr *certReloader) watch(done <-chan struct{}, logger *logrus.Entry) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	files := map[string]bool{
+		filepath.Clean(cr.certFile): true,
+		filepath.Clean(cr.keyFile):  true,
+	}
+
+	for file := range files {
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			return err
+		}
+	}
+
+	var timer *time.Timer
+
+	reload := func() {
+		if err := cr.reload(); err != nil {
+			logger.WithError(err).Error("Failed to reload TLS certificate")
+			return
+		}
+		logger.Info("Reloaded TLS certificate")
+	}
+
+	for {
+		select {
+		case event := <-watcher.Events:
+			if !files[filepath.Clean(event.Name)] {
+				continue
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.AfterFunc(certReloadDelay, reload)
+		case err := <-watcher.Errors:
+			logger.WithError(err).Error("Error watching TLS certificate")
+		case <-done:
+			if timer != nil {
+				timer.Stop()
+			}
+			return nil
+		}
+	}
+}
+
+// loadCertPool loads a bundle of PEM-encoded CA certificates from a file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	raw, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("No certificate found in CA file %s", file)
+	}
+
+	return pool, nil
+}
@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeTestCert writes a new self-signed certificate and its key to files
+func writeTestCert(t *testing.T, certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(certFile, certPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Test that the certificate is reloaded when the files change, and that an
+// invalid certificate does not replace the current one.
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cert-reloader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	writeTestCert(t, certFile, keyFile)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	currentCert := func() []byte {
+		cert, err := certs.tlsConfig().GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert.Certificate[0]
+	}
+
+	firstCert := currentCert()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go certs.watch(done, logrus.New().WithField("component", "cert-reloader"))
+
+	// Give the watcher time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// Renew the certificate
+
+	writeTestCert(t, certFile, keyFile)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for bytes.Equal(currentCert(), firstCert) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Certificate should be reloaded after the files change")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// An invalid certificate is not loaded
+
+	renewedCert := currentCert()
+
+	if err := ioutil.WriteFile(certFile, []byte("invalid"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := certs.reload(); err == nil {
+		t.Fatalf("Reloading an invalid certificate should fail")
+	}
+
+	if !bytes.Equal(currentCert(), renewedCert) {
+		t.Fatalf("Invalid certificate should not replace the current one")
+	}
+}
+
+// Test that the development certificate is valid for the local host names and
+// addresses, and that it can be written out for clients to trust.
+func TestSelfSignedCert(t *testing.T) {
+	certs, err := newSelfSignedCertReloader(devCertHosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "dev-cert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile := filepath.Join(dir, "dev-cert.pem")
+
+	if err := certs.writeCert(certFile); err != nil {
+		t.Fatal(err)
+	}
+
+	roots, err := loadCertPool(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := certs.tlsConfig().GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		_, err := cert.Leaf.Verify(x509.VerifyOptions{
+			DNSName: host,
+			Roots:   roots,
+		})
+		if err != nil {
+			t.Fatalf("Certificate should be valid for %s: %v", host, err)
+		}
+	}
+
+	if _, err := cert.Leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots}); err == nil {
+		t.Fatalf("Certificate should not be valid for example.com")
+	}
+
+	// The certificate can not be reloaded
+
+	if err := certs.reload(); err == nil {
+		t.Fatalf("Reloading a self-signed certificate should fail")
+	}
+}
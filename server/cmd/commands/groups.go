@@ -0,0 +1,406 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mosaicnetworks/disco/client"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var groupsURLs = []string{"localhost:1443"}
+var groupsAPIKey = os.Getenv("DISCO_API_KEY")
+var groupsCertFile = ""
+var groupsSkipVerify = false
+var groupsClientCertFile = ""
+var groupsClientKeyFile = ""
+var groupsTimeout = 10 * time.Second
+var groupsOutput = "table"
+var groupsAppID = ""
+var groupsFile = ""
+var groupsVersion uint64
+var groupsPatch = false
+var groupsInterval = 5 * time.Second
+var groupsDatadir = ""
+
+func init() {
+	groupsCmd.PersistentFlags().StringSliceVar(&groupsURLs, "url", groupsURLs, "Discovery server URL. Repeat for failover across several servers")
+	groupsCmd.PersistentFlags().StringVar(&groupsAPIKey, "api-key", groupsAPIKey, "API key of the app. Defaults to DISCO_API_KEY")
+	groupsCmd.PersistentFlags().StringVar(&groupsCertFile, "cert-file", groupsCertFile, "File containing the certificate of the discovery server, if it is not signed by a trusted CA")
+	groupsCmd.PersistentFlags().BoolVar(&groupsSkipVerify, "skip-verify", groupsSkipVerify, "Do not verify the certificate of the discovery server")
+	groupsCmd.PersistentFlags().StringVar(&groupsClientCertFile, "client-cert-file", groupsClientCertFile, "File containing the client certificate, if the server requires one")
+	groupsCmd.PersistentFlags().StringVar(&groupsClientKeyFile, "client-key-file", groupsClientKeyFile, "File containing the client certificate key")
+	groupsCmd.PersistentFlags().DurationVar(&groupsTimeout, "timeout", groupsTimeout, "Timeout of every request")
+	groupsCmd.PersistentFlags().StringVarP(&groupsOutput, "output", "o", groupsOutput, "Output format: table or json")
+
+	groupsListCmd.Flags().StringVar(&groupsAppID, "app-id", groupsAppID, "Only list the groups of this app")
+	groupsWatchCmd.Flags().StringVar(&groupsAppID, "app-id", groupsAppID, "Only watch the groups of this app")
+	groupsWatchCmd.Flags().DurationVar(&groupsInterval, "interval", groupsInterval, "Interval between polls of the discovery server")
+
+	groupsCreateCmd.Flags().StringVarP(&groupsFile, "file", "f", groupsFile, "JSON file containing the group, or - for stdin")
+	groupsUpdateCmd.Flags().StringVarP(&groupsFile, "file", "f", groupsFile, "JSON file containing the group, or - for stdin")
+	groupsUpdateCmd.Flags().Uint64Var(&groupsVersion, "version", groupsVersion, "Only update the group if this is its current version. Defaults to the Version in the file")
+	groupsUpdateCmd.Flags().BoolVar(&groupsPatch, "patch", groupsPatch, "Apply the file as a JSON Merge Patch instead of replacing the group")
+	groupsCreateCmd.MarkFlagRequired("file")
+	groupsUpdateCmd.MarkFlagRequired("file")
+
+	groupsPeersCmd.Flags().StringVar(&groupsDatadir, "datadir", groupsDatadir, "Babble data directory")
+	groupsPeersCmd.MarkFlagRequired("datadir")
+
+	groupsCmd.AddCommand(
+		groupsListCmd,
+		groupsGetCmd,
+		groupsCreateCmd,
+		groupsUpdateCmd,
+		groupsDeleteCmd,
+		groupsWatchCmd,
+		groupsPeersCmd,
+	)
+
+	RootCmd.AddCommand(groupsCmd)
+}
+
+var groupsCmd = &cobra.Command{
+	Use:   "groups",
+	Short: "Manage the groups of a discovery server",
+}
+
+var groupsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List groups",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		groups, err := c.GetGroupsContext(cmd.Context(), groupsAppID)
+		if err != nil {
+			return err
+		}
+
+		var list []*group.Group
+		for _, g := range groups {
+			list = append(list, g)
+		}
+
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+
+		if groupsOutput == "json" {
+			if list == nil {
+				list = []*group.Group{}
+			}
+			return printJSON(cmd.OutOrStdout(), list)
+		}
+
+		return printGroups(cmd.OutOrStdout(), list...)
+	},
+}
+
+var groupsGetCmd = &cobra.Command{
+	Use:   "get ID",
+	Short: "Show a group",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		g, err := c.GetGroupByIDContext(cmd.Context(), args[0])
+		if err != nil {
+			return err
+		}
+
+		return printGroups(cmd.OutOrStdout(), g)
+	},
+}
+
+var groupsCreateCmd = &cobra.Command{
+	Use:   "create -f FILE",
+	Short: "Create a group and print its ID",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var g group.Group
+		if err := readJSONFile(cmd.InOrStdin(), groupsFile, &g); err != nil {
+			return err
+		}
+
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		id, err := c.CreateGroupContext(cmd.Context(), g)
+		if err != nil {
+			return err
+		}
+
+		if groupsOutput == "json" {
+			return printJSON(cmd.OutOrStdout(), map[string]string{"ID": id})
+		}
+
+		fmt.Fprintln(cmd.OutOrStdout(), id)
+
+		return nil
+	},
+}
+
+var groupsUpdateCmd = &cobra.Command{
+	Use:   "update ID -f FILE",
+	Short: "Replace or patch a group",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		var updated *group.Group
+
+		if groupsPatch {
+			var patch map[string]interface{}
+			if err := readJSONFile(cmd.InOrStdin(), groupsFile, &patch); err != nil {
+				return err
+			}
+
+			updated, err = c.PatchGroupContext(cmd.Context(), args[0], patch, groupsVersion)
+		} else {
+			var g group.Group
+			if err := readJSONFile(cmd.InOrStdin(), groupsFile, &g); err != nil {
+				return err
+			}
+
+			if g.ID != "" && g.ID != args[0] {
+				return fmt.Errorf("Group ID %s in %s does not match %s", g.ID, groupsFile, args[0])
+			}
+
+			g.ID = args[0]
+			if cmd.Flags().Changed("version") {
+				g.Version = groupsVersion
+			}
+
+			updated, err = c.UpdateGroupContext(cmd.Context(), g)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return printGroups(cmd.OutOrStdout(), updated)
+	},
+}
+
+var groupsDeleteCmd = &cobra.Command{
+	Use:   "delete ID",
+	Short: "Delete a group",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		return c.DeleteGroupContext(cmd.Context(), args[0])
+	},
+}
+
+var groupsWatchCmd = &cobra.Command{
+	Use:   "watch",
+	Short: "Print groups as they are created, updated, and deleted",
+	Long: `Print groups as they are created, updated, and deleted, until interrupted.
+
+The discovery server is polled with conditional requests, so unchanged groups
+are not sent again. Groups that change several times between two polls are only
+reported once.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		ctx, cancel := context.WithCancel(cmd.Context())
+		defer cancel()
+
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		defer signal.Stop(sigCh)
+
+		go func() {
+			select {
+			case <-sigCh:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		out := cmd.OutOrStdout()
+
+		err = c.WatchGroups(ctx, groupsAppID, groupsInterval, func(e client.GroupEvent) {
+			if groupsOutput == "json" {
+				printJSON(out, e)
+				return
+			}
+
+			w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+			fmt.Fprintf(w, "%s\t%s\n", e.Type, groupRow(e.Group))
+			w.Flush()
+		})
+
+		if err == context.Canceled {
+			return nil
+		}
+
+		return err
+	},
+}
+
+var groupsPeersCmd = &cobra.Command{
+	Use:   "peers ID --datadir DIR",
+	Short: "Write the peers of a group to a Babble data directory",
+	Long: `Write the peers of a group to the peers.json and peers.genesis.json files of a
+Babble data directory, so that a Babble node can join the group.
+
+Public keys and addresses are validated before anything is written. Existing
+files are replaced.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		c, err := newGroupsClient()
+		if err != nil {
+			return err
+		}
+
+		g, err := c.WriteGroupPeers(cmd.Context(), args[0], groupsDatadir)
+		if err != nil {
+			return err
+		}
+
+		if groupsOutput == "json" {
+			return printJSON(cmd.OutOrStdout(), g)
+		}
+
+		genesisPeers := g.GenesisPeers
+		if len(genesisPeers) == 0 {
+			genesisPeers = g.Peers
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Wrote %d peers to %s\n", len(g.Peers), filepath.Join(groupsDatadir, client.PeersFile))
+		fmt.Fprintf(cmd.OutOrStdout(), "Wrote %d genesis peers to %s\n", len(genesisPeers), filepath.Join(groupsDatadir, client.GenesisPeersFile))
+
+		return nil
+	},
+}
+
+// newGroupsClient creates a DiscoClient from the flags of the groups command
+func newGroupsClient() (*client.DiscoClient, error) {
+	if groupsOutput != "table" && groupsOutput != "json" {
+		return nil, fmt.Errorf("Unknown output format %s", groupsOutput)
+	}
+
+	logger := logrus.New()
+	logger.Out = os.Stderr
+
+	c, err := client.NewDiscoClientWithServers(groupsURLs,
+		groupsCertFile,
+		groupsSkipVerify,
+		groupsAPIKey,
+		groupsClientCertFile,
+		groupsClientKeyFile,
+		logger.WithField("component", "disco-client"))
+	if err != nil {
+		return nil, err
+	}
+
+	config := client.DefaultConfig()
+	config.Timeout = groupsTimeout
+	config.Cache = true
+	c.SetConfig(config)
+
+	return c, nil
+}
+
+// readJSONFile unmarshals the content of a JSON file, or of stdin if file is -
+func readJSONFile(stdin io.Reader, file string, v interface{}) error {
+	var data []byte
+	var err error
+
+	if file == "-" {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = ioutil.ReadFile(file)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("Error parsing %s: %v", file, err)
+	}
+
+	return nil
+}
+
+// printGroups prints groups as a table, or as JSON objects if the output
+// format is json
+func printGroups(out io.Writer, groups ...*group.Group) error {
+	if groupsOutput == "json" {
+		for _, g := range groups {
+			if err := printJSON(out, g); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintln(w, "ID\tNAME\tAPP ID\tPEERS\tVERSION\tLAST UPDATED")
+	for _, g := range groups {
+		fmt.Fprintln(w, groupRow(g))
+	}
+
+	return w.Flush()
+}
+
+// groupRow formats a group as a tab-separated table row
+func groupRow(g *group.Group) string {
+	lastUpdated := "-"
+	if g.LastUpdated != 0 {
+		lastUpdated = time.Unix(g.LastUpdated, 0).Format(time.RFC3339)
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%d\t%d\t%s",
+		g.ID,
+		g.Name,
+		g.AppID,
+		len(g.Peers),
+		g.Version,
+		lastUpdated)
+}
+
+// printJSON prints a value as indented JSON
+func printJSON(out io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(out, string(data))
+
+	return err
+}
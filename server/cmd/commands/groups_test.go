@@ -0,0 +1,228 @@
+package commands
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mosaicnetworks/disco/discotest"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// runGroups runs a groups subcommand against a test server, with stdin as
+// input, and returns its output. The flags of the previous runs are reset.
+func runGroups(t *testing.T, ts *discotest.Server, apiKey string, stdin string, args ...string) (string, error) {
+	groupsURLs = nil
+	groupsOutput = "table"
+	groupsAppID = ""
+	groupsFile = ""
+	groupsVersion = 0
+	groupsPatch = false
+
+	resetChanged := func(f *pflag.Flag) { f.Changed = false }
+
+	var reset func(cmd *cobra.Command)
+	reset = func(cmd *cobra.Command) {
+		cmd.Flags().VisitAll(resetChanged)
+		cmd.PersistentFlags().VisitAll(resetChanged)
+		for _, sub := range cmd.Commands() {
+			reset(sub)
+		}
+	}
+	reset(RootCmd)
+
+	var out bytes.Buffer
+
+	RootCmd.SetOut(&out)
+	RootCmd.SetErr(ioutil.Discard)
+	RootCmd.SetIn(strings.NewReader(stdin))
+	RootCmd.SetArgs(append([]string{
+		"groups",
+		"--url", ts.URL,
+		"--cert-file", ts.CertFile,
+		"--api-key", apiKey,
+	}, args...))
+
+	err := RootCmd.Execute()
+
+	return out.String(), err
+}
+
+// Test creating, listing, showing, updating, and deleting groups with the
+// groups subcommands, in table and JSON output.
+func TestGroupsCommands(t *testing.T) {
+	ts := discotest.NewServer()
+	defer ts.Close()
+
+	app1 := ts.NewApp("TestApp1")
+
+	dir, err := ioutil.TempDir("", "disco-groups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create from stdin, with the ID in table output
+
+	out, err := runGroups(t, ts, app1.APIKey, `{"Name": "TestGroup1"}`, "create", "-f", "-")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id1 := strings.TrimSpace(out)
+
+	g, err := ts.Groups.GetGroup(id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Name != "TestGroup1" || g.AppID != "TestApp1" {
+		t.Fatalf("Created group should be TestGroup1 of TestApp1, not %s of %s", g.Name, g.AppID)
+	}
+
+	// Create from a file, with the ID in JSON output
+
+	groupFile := filepath.Join(dir, "group.json")
+	if err := ioutil.WriteFile(groupFile, []byte(`{"Name": "TestGroup2"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err = runGroups(t, ts, app1.APIKey, "", "create", "-f", groupFile, "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var created map[string]string
+	if err := json.Unmarshal([]byte(out), &created); err != nil {
+		t.Fatalf("create should print JSON, not %q: %v", out, err)
+	}
+
+	id2 := created["ID"]
+
+	if _, err := ts.Groups.GetGroup(id2); err != nil {
+		t.Fatalf("Group %s should have been created: %v", id2, err)
+	}
+
+	// List in table output
+
+	out, err = runGroups(t, ts, app1.APIKey, "", "list")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") {
+		t.Fatalf("list should print a header and 2 groups, not %q", out)
+	}
+
+	for _, name := range []string{"TestGroup1", "TestGroup2"} {
+		if !strings.Contains(out, name) {
+			t.Fatalf("list should print %s, not %q", name, out)
+		}
+	}
+
+	// List in JSON output
+
+	out, err = runGroups(t, ts, app1.APIKey, "", "list", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var list []*group.Group
+	if err := json.Unmarshal([]byte(out), &list); err != nil {
+		t.Fatalf("list should print JSON, not %q: %v", out, err)
+	}
+
+	if len(list) != 2 {
+		t.Fatalf("list should print 2 groups, not %d", len(list))
+	}
+
+	// Get in table output
+
+	out, err = runGroups(t, ts, app1.APIKey, "", "get", id1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines = strings.Split(strings.TrimSpace(out), "\n")
+
+	if len(lines) != 2 || !strings.HasPrefix(lines[1], id1) || !strings.Contains(lines[1], "TestGroup1") {
+		t.Fatalf("get should print a header and the group, not %q", out)
+	}
+
+	// Update from a file, with a stale and then the current version
+
+	if err := ioutil.WriteFile(groupFile, []byte(`{"Name": "Updated"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = runGroups(t, ts, app1.APIKey, "", "update", id1, "-f", groupFile, "--version", "7")
+	if !errors.Is(err, group.ErrVersionMismatch) {
+		t.Fatalf("update with a stale version should fail with ErrVersionMismatch, not %v", err)
+	}
+
+	out, err = runGroups(t, ts, app1.APIKey, "", "update", id1, "-f", groupFile, "--version", "1", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var updated group.Group
+	if err := json.Unmarshal([]byte(out), &updated); err != nil {
+		t.Fatalf("update should print JSON, not %q: %v", out, err)
+	}
+
+	if updated.Name != "Updated" || updated.Version != 2 {
+		t.Fatalf("Updated group should be Updated version 2, not %s version %d", updated.Name, updated.Version)
+	}
+
+	// Patch from stdin
+
+	out, err = runGroups(t, ts, app1.APIKey, `{"Name": "Patched"}`, "update", id1, "-f", "-", "--patch", "--version", "2", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var patched group.Group
+	if err := json.Unmarshal([]byte(out), &patched); err != nil {
+		t.Fatalf("update --patch should print JSON, not %q: %v", out, err)
+	}
+
+	if patched.Name != "Patched" || patched.Version != 3 {
+		t.Fatalf("Patched group should be Patched version 3, not %s version %d", patched.Name, patched.Version)
+	}
+
+	// The ID in the file must match the argument
+
+	_, err = runGroups(t, ts, app1.APIKey, `{"ID": "`+id2+`", "Name": "Mismatch"}`, "update", id1, "-f", "-")
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Fatalf("update with a mismatching ID should fail, not %v", err)
+	}
+
+	if g, err := ts.Groups.GetGroup(id2); err != nil || g.Name != "TestGroup2" {
+		t.Fatalf("Group %s should not be modified by a mismatching update, not %v, %v", id2, g, err)
+	}
+
+	// Delete
+
+	if _, err := runGroups(t, ts, app1.APIKey, "", "delete", id1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := runGroups(t, ts, app1.APIKey, "", "get", id1); err == nil {
+		t.Fatalf("get of a deleted group should fail")
+	}
+
+	// Invalid output formats are rejected
+
+	if _, err := runGroups(t, ts, app1.APIKey, "", "list", "-o", "yaml"); err == nil {
+		t.Fatalf("list with an unknown output format should fail")
+	}
+}
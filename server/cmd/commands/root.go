@@ -2,8 +2,10 @@ package commands
 
 import (
 	"fmt"
+	"net"
 	"time"
 
+	"github.com/mosaicnetworks/disco/app"
 	"github.com/mosaicnetworks/disco/group"
 	"github.com/mosaicnetworks/disco/server"
 	"github.com/sirupsen/logrus"
@@ -12,33 +14,79 @@ import (
 )
 
 var address = "0.0.0.0"
+var addressV6 = ""
 var discoPort = "1443"
 var signalPort = "2443"
+var grpcPort = "3443"
 var icePort = "3478"
+var iceTCPPort = ""
+var iceTLSPort = ""
 var iceUsername = "test"
 var icePassword = "test"
 var realm = "main"
 var certFile = "cert.pem"
 var keyFile = "key.pem"
+var clientCAFile = ""
+var dev = false
+var devCertFile = ""
+var insecureHTTP = false
 var ttl = 5 * time.Minute
 var ttlHeartbeat = 1 * time.Minute
+var adminKey = ""
+var appsFile = ""
+var iceSecret = ""
+var iceUsersFile = ""
+var iceCredentialsTTL = 12 * time.Hour
+var iceInterface = ""
+var iceRelayMinPort = 0
+var iceRelayMaxPort = 0
+var iceMaxAllocations = 0
+var iceMaxUserAllocations = 0
+var iceAllocationBandwidth int64
+var iceUserQuota int64
+var iceUsageFile = ""
+var iceUsageInterval = 1 * time.Minute
+var stunOnly = false
 
 func init() {
 	RootCmd.Flags().StringVar(&address, "address", address, "Advertise address (use public address)")
+	RootCmd.Flags().StringVar(&addressV6, "address-v6", addressV6, "Additional IPv6 advertise address, when address is an IPv4 address (use public address)")
 	RootCmd.Flags().StringVar(&discoPort, "disco-port", discoPort, "Discovery API port")
 	RootCmd.Flags().StringVar(&signalPort, "signal-port", signalPort, "WebRTC-Signaling port")
+	RootCmd.Flags().StringVar(&grpcPort, "grpc-port", grpcPort, "gRPC discovery API port. gRPC is disabled if empty")
 	RootCmd.Flags().StringVar(&icePort, "ice-port", icePort, "ICE server port")
+	RootCmd.Flags().StringVar(&iceTCPPort, "ice-tcp-port", iceTCPPort, "ICE server TCP port. TCP is disabled if empty")
+	RootCmd.Flags().StringVar(&iceTLSPort, "ice-tls-port", iceTLSPort, "ICE server TLS port, using the same certificate as the discovery API. TLS is disabled if empty")
+	RootCmd.Flags().StringVar(&iceInterface, "ice-interface", iceInterface, "Network interface the ICE server listens and allocates relays on. All interfaces if empty")
+	RootCmd.Flags().IntVar(&iceRelayMinPort, "ice-relay-min-port", iceRelayMinPort, "Lowest port of ICE server relays. Any port if 0")
+	RootCmd.Flags().IntVar(&iceRelayMaxPort, "ice-relay-max-port", iceRelayMaxPort, "Highest port of ICE server relays. Any port if 0")
+	RootCmd.Flags().IntVar(&iceMaxAllocations, "ice-max-allocations", iceMaxAllocations, "Maximum number of concurrent ICE server allocations. Unlimited if 0")
+	RootCmd.Flags().IntVar(&iceMaxUserAllocations, "ice-max-user-allocations", iceMaxUserAllocations, "Maximum number of concurrent ICE server allocations per user. Unlimited if 0")
+	RootCmd.Flags().Int64Var(&iceAllocationBandwidth, "ice-allocation-bandwidth", iceAllocationBandwidth, "Bandwidth cap of every ICE server allocation, in bytes per second, at least 1500. Unlimited if 0")
+	RootCmd.Flags().Int64Var(&iceUserQuota, "ice-user-quota", iceUserQuota, "Total number of bytes each user can relay through the ICE server. Unlimited if 0")
+	RootCmd.Flags().StringVar(&iceUsageFile, "ice-usage-file", iceUsageFile, "JSON file where ICE server usage is persisted. Usage is not persisted if empty")
+	RootCmd.Flags().DurationVar(&iceUsageInterval, "ice-usage-interval", iceUsageInterval, "Interval between saves of ICE server usage")
+	RootCmd.Flags().BoolVar(&stunOnly, "stun-only", stunOnly, "Only answer STUN binding requests on the ICE server ports, and refuse all TURN allocations")
 	RootCmd.Flags().StringVar(&iceUsername, "ice-username", iceUsername, "ICE server userame. Only this user will be allowed to use the ICE server")
 	RootCmd.Flags().StringVar(&icePassword, "ice-password", icePassword, "ICE server password corresponding to username")
-	RootCmd.Flags().StringVar(&realm, "realm", realm, "Administrative routing domain within the WebRTC signaling")
+	RootCmd.Flags().StringVar(&iceUsersFile, "ice-users-file", iceUsersFile, "JSON file defining additional ICE server users. Reloaded on SIGHUP")
+	RootCmd.Flags().StringVar(&iceSecret, "ice-secret", iceSecret, "Shared secret for ephemeral ICE server credentials. Ephemeral credentials are disabled if empty")
+	RootCmd.Flags().DurationVar(&iceCredentialsTTL, "ice-credentials-ttl", iceCredentialsTTL, "Lifetime of ephemeral ICE server credentials")
+	RootCmd.Flags().StringVar(&realm, "realm", realm, "Administrative domain of the TURN server")
 	RootCmd.Flags().StringVar(&certFile, "cert-file", certFile, "File containing TLS certificate")
 	RootCmd.Flags().StringVar(&keyFile, "key-file", keyFile, "File containing certificate key")
+	RootCmd.Flags().BoolVar(&dev, "dev", dev, "Development mode. Use a self-signed certificate generated at startup instead of cert-file and key-file")
+	RootCmd.Flags().StringVar(&devCertFile, "dev-cert-file", devCertFile, "File where the development certificate is written for clients to trust. Not written if empty")
+	RootCmd.Flags().BoolVar(&insecureHTTP, "insecure-http", insecureHTTP, "Serve the discovery API over plaintext HTTP, on localhost only")
+	RootCmd.Flags().StringVar(&clientCAFile, "client-ca-file", clientCAFile, "File containing the CA certificates of discovery API clients. Client certificates are not required if empty")
 	RootCmd.Flags().DurationVar(&ttl, "ttl", ttl, "Group Time To Live, after which groups will be deleted")
 	RootCmd.Flags().DurationVar(&ttlHeartbeat, "ttl-hearbeat", ttlHeartbeat, "Ticker frequency for checking group TTL")
+	RootCmd.Flags().StringVar(&adminKey, "admin-key", adminKey, "Key protecting the admin API. The admin API is disabled if empty")
+	RootCmd.Flags().StringVar(&appsFile, "apps-file", appsFile, "JSON file where applications and their API keys are persisted. Applications are lost on restart if empty")
 	viper.BindPFlags(RootCmd.Flags())
 }
 
-//RootCmd is the root command for the disco server
+// RootCmd is the root command for the disco server
 var RootCmd = &cobra.Command{
 	Use:   "disco",
 	Short: "Discovery service for Babble",
@@ -47,24 +95,78 @@ var RootCmd = &cobra.Command{
 
 // runServer starts the disco server and waits for a SIGINT or SIGTERM
 func runServer(cmd *cobra.Command, args []string) error {
+	logger := logrus.New().WithField("component", "disco-server")
+
 	groupRepo := group.NewInmemGroupRepository()
 
+	var appRepo app.AppRepository = app.NewInmemAppRepository()
+	if appsFile != "" {
+		fileRepo, err := app.NewFileAppRepository(appsFile)
+		if err != nil {
+			return err
+		}
+		appRepo = fileRepo
+	}
+
+	if apps, _ := appRepo.GetAllApps(); len(apps) == 0 && adminKey == "" {
+		logger.Warn("No application is registered and the admin API is disabled: every discovery request will be rejected. Set --admin-key, or register applications in --apps-file")
+	}
+
+	turnConfig := server.TURNConfig{
+		Address:             net.JoinHostPort(address, icePort),
+		AddressV6:           addressV6,
+		TCPPort:             iceTCPPort,
+		TLSPort:             iceTLSPort,
+		Interface:           iceInterface,
+		RelayMinPort:        iceRelayMinPort,
+		RelayMaxPort:        iceRelayMaxPort,
+		MaxAllocations:      iceMaxAllocations,
+		MaxUserAllocations:  iceMaxUserAllocations,
+		AllocationBandwidth: iceAllocationBandwidth,
+		UserQuota:           iceUserQuota,
+		UsageFile:           iceUsageFile,
+		UsageInterval:       iceUsageInterval,
+		STUNOnly:            stunOnly,
+		Realm:               realm,
+		Username:            iceUsername,
+		Password:            icePassword,
+		UsersFile:           iceUsersFile,
+		Secret:              iceSecret,
+		CredentialsTTL:      iceCredentialsTTL,
+	}
+
 	discoServer := server.NewDiscoServer(groupRepo,
-		certFile,
-		keyFile,
-		logrus.New().WithField("component", "disco-server"))
+		appRepo,
+		adminKey,
+		turnConfig,
+		server.TLSConfig{
+			CertFile:     certFile,
+			KeyFile:      keyFile,
+			ClientCAFile: clientCAFile,
+			Dev:          dev,
+			DevCertFile:  devCertFile,
+			InsecureHTTP: insecureHTTP,
+		},
+		logger)
+
+	apiHost := "0.0.0.0"
+	if insecureHTTP {
+		// Plaintext is only acceptable for local clients
+		apiHost = "127.0.0.1"
+	}
 
-	discoUrl := fmt.Sprintf("0.0.0.0:%s", discoPort)
+	discoUrl := net.JoinHostPort(apiHost, discoPort)
 	signalUrl := fmt.Sprintf("0.0.0.0:%s", signalPort)
-	iceUrl := fmt.Sprintf("%s:%s", address, icePort)
+
+	grpcUrl := ""
+	if grpcPort != "" {
+		grpcUrl = net.JoinHostPort(apiHost, grpcPort)
+	}
 
 	discoServer.Serve(
 		discoUrl,
 		signalUrl,
-		iceUrl,
-		iceUsername,
-		icePassword,
-		realm,
+		grpcUrl,
 		ttl,
 		ttlHeartbeat)
 
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// etag returns the ETag of a group, which is formed by its version and its
+// LastUpdated time, so that it changes when the group is updated, and also when
+// it is refreshed by a heartbeat.
+func etag(g *group.Group) string {
+	return fmt.Sprintf("\"%d-%d\"", g.Version, g.LastUpdated)
+}
+
+// setETag sets the ETag header of a response to the ETag of a group
+func setETag(w http.ResponseWriter, g *group.Group) {
+	w.Header().Set("ETag", etag(g))
+}
+
+// groupsETag returns an ETag for a set of groups. It changes whenever a group
+// is created, updated, refreshed, or deleted.
+func groupsETag(groups map[string]*group.Group) string {
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	hash := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(hash, "%s:%d:%d\n", id, groups[id].Version, groups[id].LastUpdated)
+	}
+
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(hash.Sum(nil))[:32])
+}
+
+// notModified evaluates the If-None-Match and If-Modified-Since headers of a GET
+// request against the current ETag and modification time of a resource. As in
+// RFC 7232, If-Modified-Since is ignored when If-None-Match is present, or when
+// lastModified is zero.
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		for _, tag := range strings.Split(ifNoneMatch, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == etag {
+				return true
+			}
+		}
+		return false
+	}
+
+	if lastModified.IsZero() {
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+
+	// HTTP dates have a resolution of one second
+	return !lastModified.Truncate(time.Second).After(ims)
+}
+
+// ifMatchVersion returns the group version in the If-Match header of a
+// request, or 0 if there is no such header. The header is either a version, or
+// an ETag of the group, whose LastUpdated time is ignored, so that heartbeats
+// do not make updates fail.
+func ifMatchVersion(r *http.Request) (uint64, error) {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		return 0, nil
+	}
+
+	tag := strings.Trim(ifMatch, "\"")
+	if i := strings.Index(tag, "-"); i >= 0 {
+		tag = tag[:i]
+	}
+
+	version, err := strconv.ParseUint(tag, 10, 64)
+	if err != nil || version == 0 {
+		return 0, fmt.Errorf("Invalid If-Match header: %s", ifMatch)
+	}
+
+	return version, nil
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// Test that getGroup and getGroups answer conditional requests with 304 Not
+// Modified until the groups change.
+func TestConditionalGet(t *testing.T) {
+	repo := group.NewInmemGroupRepository()
+
+	s := NewDiscoServer(repo, nil, "", TURNConfig{}, TLSConfig{}, logrus.New().WithField("component", "disco-server"))
+
+	groupID, err := repo.SetGroup(group.NewGroup("", "TestGroup", "TestApp", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(handler http.HandlerFunc, path string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req = req.WithContext(context.WithValue(req.Context(), appContextKey, app.NewApp("TestApp", "")))
+		req = mux.SetURLVars(req, map[string]string{"id": groupID})
+		for key, values := range header {
+			req.Header[key] = values
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, req)
+		return w
+	}
+
+	// Single group
+
+	w := get(s.getGroup, "/groups/"+groupID, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroup should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	g, err := repo.GetGroup(groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groupETag := w.Header().Get("ETag")
+	if expected := fmt.Sprintf(`"1-%d"`, g.LastUpdated); groupETag != expected {
+		t.Fatalf("group ETag should be %s, not %s", expected, groupETag)
+	}
+
+	lastModified := w.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatalf("getGroup should set Last-Modified")
+	}
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-None-Match": {groupETag}})
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("getGroup with matching If-None-Match should return %d without body, not %d", http.StatusNotModified, w.Code)
+	}
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-None-Match": {`"7", W/` + groupETag}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("getGroup with a list of ETags should return %d, not %d", http.StatusNotModified, w.Code)
+	}
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-Modified-Since": {lastModified}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("getGroup with If-Modified-Since should return %d, not %d", http.StatusNotModified, w.Code)
+	}
+
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-Modified-Since": {past}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroup modified since If-Modified-Since should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	// If-None-Match takes precedence over If-Modified-Since
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-None-Match": {`"7"`}, "If-Modified-Since": {lastModified}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroup with mismatching If-None-Match should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	// Group list
+
+	w = get(s.getGroups, "/groups", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroups should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	listETag := w.Header().Get("ETag")
+
+	w = get(s.getGroups, "/groups", http.Header{"If-None-Match": {listETag}})
+	if w.Code != http.StatusNotModified {
+		t.Fatalf("getGroups with matching If-None-Match should return %d, not %d", http.StatusNotModified, w.Code)
+	}
+
+	// Updates change the ETags
+
+	if _, err := repo.SetGroup(g); err != nil {
+		t.Fatal(err)
+	}
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-None-Match": {groupETag}})
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("ETag"), `"2-`) {
+		t.Fatalf("getGroup of updated group should return %d with the ETag of version 2, not %d with %s", http.StatusOK, w.Code, w.Header().Get("ETag"))
+	}
+
+	groupETag = w.Header().Get("ETag")
+
+	w = get(s.getGroups, "/groups", http.Header{"If-None-Match": {listETag}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroups after an update should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	listETag = w.Header().Get("ETag")
+
+	// Heartbeats change the ETags, because they change LastUpdated, which has
+	// a resolution of one second
+
+	time.Sleep(time.Until(time.Unix(g.LastUpdated+1, 0)))
+
+	if err := repo.TouchGroup(groupID); err != nil {
+		t.Fatal(err)
+	}
+
+	w = get(s.getGroup, "/groups/"+groupID, http.Header{"If-None-Match": {groupETag}})
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("ETag"), `"2-`) || w.Header().Get("ETag") == groupETag {
+		t.Fatalf("getGroup of refreshed group should return %d with a new ETag of version 2, not %d with %s", http.StatusOK, w.Code, w.Header().Get("ETag"))
+	}
+
+	w = get(s.getGroups, "/groups", http.Header{"If-None-Match": {listETag}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroups after a heartbeat should return %d, not %d", http.StatusOK, w.Code)
+	}
+
+	listETag = w.Header().Get("ETag")
+
+	// Deletions change the list ETag
+
+	if err := repo.DeleteGroup(groupID); err != nil {
+		t.Fatal(err)
+	}
+
+	w = get(s.getGroups, "/groups", http.Header{"If-None-Match": {listETag}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("getGroups after a deletion should return %d, not %d", http.StatusOK, w.Code)
+	}
+}
+
+// Test that If-Match headers are parsed as a version, or as the ETag of a
+// group, regardless of its LastUpdated time
+func TestIfMatchVersion(t *testing.T) {
+	cases := []struct {
+		ifMatch string
+		version uint64
+		valid   bool
+	}{
+		{"", 0, true},
+		{`"3"`, 3, true},
+		{`"3-1583773505"`, 3, true},
+		{`"0"`, 0, false},
+		{`"abc"`, 0, false},
+		{`"-3"`, 0, false},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(http.MethodPut, "/groups/1", nil)
+		if c.ifMatch != "" {
+			req.Header.Set("If-Match", c.ifMatch)
+		}
+
+		version, err := ifMatchVersion(req)
+		if (err == nil) != c.valid || version != c.version {
+			t.Fatalf("If-Match %s should give version %d and valid %v, not %d and %v", c.ifMatch, c.version, c.valid, version, err)
+		}
+	}
+}
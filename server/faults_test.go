@@ -0,0 +1,217 @@
+package server_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/discotest"
+	"github.com/mosaicnetworks/disco/group"
+)
+
+// faultyServer is a test server whose group repository injects faults
+type faultyServer struct {
+	*discotest.Server
+	repo   *group.InmemGroupRepository
+	faults *discotest.FaultyGroupRepository
+	apiKey string
+}
+
+// newFaultyServer starts a faultyServer with a registered application
+func newFaultyServer() *faultyServer {
+	fs := &faultyServer{
+		Server: discotest.NewUnstartedServer(),
+		repo:   group.NewInmemGroupRepository(),
+	}
+
+	fs.faults = discotest.NewFaultyGroupRepository(fs.repo)
+	fs.Groups = fs.faults
+	fs.Start()
+
+	fs.apiKey = fs.NewApp("TestApp").APIKey
+
+	return fs
+}
+
+// newGroup inserts a group of the test application directly in the repository,
+// and returns its ID
+func (fs *faultyServer) newGroup(t *testing.T) string {
+	id, err := fs.repo.SetGroup(group.NewGroup("", "TestGroup", "TestApp", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// do sends an authenticated request to the discovery API, and returns the
+// status of the response
+func (fs *faultyServer) do(t *testing.T, method string, path string, body string, header http.Header) int {
+	req, err := http.NewRequest(method, fs.URL+path, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Authorization", "Bearer "+fs.apiKey)
+
+	resp, err := fs.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// Test that the handlers of the discovery API report storage failures with a
+// 503 status, which clients retry, and other repository errors with a 4xx
+// status.
+func TestHandlerFaults(t *testing.T) {
+	fs := newFaultyServer()
+	defer fs.Close()
+
+	storageFailure := discotest.Fault{Err: discotest.ErrInjected}
+
+	cases := []struct {
+		name   string
+		method string
+		path   string // %s is replaced with the ID of a new group
+		body   string
+		fault  discotest.Method
+		status int
+	}{
+		{"list groups", "GET", "/groups", "", discotest.MethodGetAllGroupsByAppID, http.StatusServiceUnavailable},
+		{"list app groups", "GET", "/groups?app-id=TestApp", "", discotest.MethodGetAllGroupsByAppID, http.StatusServiceUnavailable},
+		{"get group", "GET", "/groups/%s", "", discotest.MethodGetGroup, http.StatusServiceUnavailable},
+		{"create group", "POST", "/group", `{"Name": "New"}`, discotest.MethodSetGroup, http.StatusServiceUnavailable},
+		{"create group with ID", "POST", "/group", `{"ID": "new"}`, discotest.MethodGetGroup, http.StatusServiceUnavailable},
+		{"update group", "PUT", "/groups/%s", `{"Name": "Updated"}`, discotest.MethodSetGroup, http.StatusServiceUnavailable},
+		{"update unreadable group", "PUT", "/groups/%s", `{"Name": "Updated"}`, discotest.MethodGetGroup, http.StatusServiceUnavailable},
+		{"patch group", "PATCH", "/groups/%s", `{"Name": "Patched"}`, discotest.MethodSetGroup, http.StatusServiceUnavailable},
+		{"patch unreadable group", "PATCH", "/groups/%s", `{"Name": "Patched"}`, discotest.MethodGetGroup, http.StatusServiceUnavailable},
+		{"heartbeat", "POST", "/groups/%s/heartbeat", "", discotest.MethodTouchGroup, http.StatusServiceUnavailable},
+		{"delete group", "DELETE", "/groups/%s", "", discotest.MethodDeleteGroup, http.StatusServiceUnavailable},
+	}
+
+	for _, c := range cases {
+		fs.faults.Clear()
+
+		path := c.path
+		if strings.Contains(path, "%s") {
+			path = fmt.Sprintf(path, fs.newGroup(t))
+		}
+
+		fs.faults.Inject(storageFailure, c.fault)
+
+		if status := fs.do(t, c.method, path, c.body, nil); status != c.status {
+			t.Fatalf("%s with %s failure should return %d, not %d", c.name, c.fault, c.status, status)
+		}
+	}
+
+	// Without faults, errors caused by the request are not storage failures
+
+	fs.faults.Clear()
+
+	requestErrors := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"unknown group", "GET", "/groups/unknown", "", http.StatusNotFound},
+		{"groups of another app", "GET", "/groups?app-id=OtherApp", "", http.StatusForbidden},
+		{"group of another app", "POST", "/group", `{"AppID": "OtherApp"}`, http.StatusForbidden},
+		{"heartbeat of unknown group", "POST", "/groups/unknown/heartbeat", "", http.StatusNotFound},
+	}
+
+	for _, c := range requestErrors {
+		if status := fs.do(t, c.method, c.path, c.body, nil); status != c.status {
+			t.Fatalf("Request for %s should return %d, not %d", c.name, c.status, status)
+		}
+	}
+}
+
+// Test that writes which are applied by the storage, but not acknowledged, are
+// reported as failures, and that retrying them is safe with optimistic
+// concurrency.
+func TestHandlerPartialFaults(t *testing.T) {
+	fs := newFaultyServer()
+	defer fs.Close()
+
+	id := fs.newGroup(t)
+
+	fs.faults.Inject(discotest.Fault{Err: discotest.ErrInjected, Partial: true}, discotest.MethodSetGroup)
+
+	ifMatch := http.Header{"If-Match": []string{`"1"`}}
+
+	if status := fs.do(t, "PUT", "/groups/"+id, `{"Name": "Updated"}`, ifMatch); status != http.StatusServiceUnavailable {
+		t.Fatalf("Unacknowledged update should return 503, not %d", status)
+	}
+
+	g, err := fs.repo.GetGroup(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if g.Name != "Updated" || g.Version != 2 {
+		t.Fatalf("Group should be Updated version 2, not %s version %d", g.Name, g.Version)
+	}
+
+	// The retried update is detected as a conflict, instead of being applied
+	// twice
+
+	fs.faults.Clear()
+
+	if status := fs.do(t, "PUT", "/groups/"+id, `{"Name": "Updated"}`, ifMatch); status != http.StatusPreconditionFailed {
+		t.Fatalf("Retried update should return 412, not %d", status)
+	}
+}
+
+// Test that intermittent faults only affect some calls, and that latency delays
+// the responses without failing them.
+func TestHandlerIntermittentFaults(t *testing.T) {
+	fs := newFaultyServer()
+	defer fs.Close()
+
+	id := fs.newGroup(t)
+
+	// The second call fails, and the others succeed
+
+	fs.faults.Inject(discotest.Fault{Err: discotest.ErrInjected, Skip: 1, Times: 1}, discotest.MethodGetGroup)
+
+	expected := []int{http.StatusOK, http.StatusServiceUnavailable, http.StatusOK}
+
+	for i, e := range expected {
+		if status := fs.do(t, "GET", "/groups/"+id, "", nil); status != e {
+			t.Fatalf("Request %d should return %d, not %d", i, e, status)
+		}
+	}
+
+	if n := fs.faults.Calls(discotest.MethodGetGroup); n != 3 {
+		t.Fatalf("GetGroup should be called 3 times, not %d", n)
+	}
+
+	// Latency in every method
+
+	latency := 100 * time.Millisecond
+
+	fs.faults.Inject(discotest.Fault{Latency: latency}, discotest.Methods...)
+
+	start := time.Now()
+
+	if status := fs.do(t, "GET", "/groups/"+id, "", nil); status != http.StatusOK {
+		t.Fatalf("Slow request should return 200, not %d", status)
+	}
+
+	if d := time.Since(start); d < latency {
+		t.Fatalf("Slow request should take at least %v, not %v", latency, d)
+	}
+}
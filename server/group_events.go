@@ -0,0 +1,134 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/mosaicnetworks/disco/group"
+	pb "github.com/mosaicnetworks/disco/proto"
+)
+
+// watchBuffer is the number of events buffered for every watcher. Watchers
+// which fall further behind are dropped.
+const watchBuffer = 256
+
+// groupEvents implements the GroupRepository interface by wrapping the
+// GroupRepository of a DiscoServer, and publishes the changes made through it
+// to the gRPC watchers. Changes made directly to the underlying repository, for
+// example by another server sharing the same storage, are not published.
+// Heartbeats are not published either, because they do not change the Version
+// of groups.
+type groupEvents struct {
+	group.GroupRepository
+
+	// writeLock serializes writes, so that events are published in the order
+	// of the changes
+	writeLock sync.Mutex
+
+	sync.Mutex
+	watchers map[*groupWatcher]bool
+}
+
+// groupWatcher receives the events of the groups of an AppID
+type groupWatcher struct {
+	appID  string
+	events chan *pb.GroupEvent // closed if the watcher falls behind
+}
+
+// newGroupEvents instantiates a new groupEvents wrapping repo
+func newGroupEvents(repo group.GroupRepository) *groupEvents {
+	return &groupEvents{
+		GroupRepository: repo,
+		watchers:        make(map[*groupWatcher]bool),
+	}
+}
+
+// SetGroup implements the GroupRepository interface, and publishes a CREATED
+// or UPDATED event
+func (ge *groupEvents) SetGroup(g *group.Group) (string, error) {
+	ge.writeLock.Lock()
+	defer ge.writeLock.Unlock()
+
+	id, err := ge.GroupRepository.SetGroup(g)
+	if err != nil {
+		return id, err
+	}
+
+	eventType := pb.GroupEvent_UPDATED
+	if g.Version == 1 {
+		eventType = pb.GroupEvent_CREATED
+	}
+
+	ge.publish(eventType, g)
+
+	return id, nil
+}
+
+// DeleteGroup implements the GroupRepository interface, and publishes a
+// DELETED event with the last state of the group
+func (ge *groupEvents) DeleteGroup(id string) error {
+	ge.writeLock.Lock()
+	defer ge.writeLock.Unlock()
+
+	g, getErr := ge.GroupRepository.GetGroup(id)
+
+	if err := ge.GroupRepository.DeleteGroup(id); err != nil {
+		return err
+	}
+
+	if getErr == nil {
+		ge.publish(pb.GroupEvent_DELETED, g)
+	}
+
+	return nil
+}
+
+// watch registers a watcher of the groups of appID. It must be removed with
+// unwatch.
+func (ge *groupEvents) watch(appID string) *groupWatcher {
+	ge.Lock()
+	defer ge.Unlock()
+
+	w := &groupWatcher{
+		appID:  appID,
+		events: make(chan *pb.GroupEvent, watchBuffer),
+	}
+
+	ge.watchers[w] = true
+
+	return w
+}
+
+// unwatch removes a watcher
+func (ge *groupEvents) unwatch(w *groupWatcher) {
+	ge.Lock()
+	defer ge.Unlock()
+
+	delete(ge.watchers, w)
+}
+
+// publish sends an event to the watchers of the group's AppID. Watchers whose
+// buffer is full are removed, and their channel is closed.
+func (ge *groupEvents) publish(eventType pb.GroupEvent_EventType, g *group.Group) {
+	ge.Lock()
+	defer ge.Unlock()
+
+	for w := range ge.watchers {
+		if w.appID != g.AppID {
+			continue
+		}
+
+		// Every watcher gets its own message, because streams marshal them
+		// concurrently, and marshalling a message is not thread safe
+		e := &pb.GroupEvent{
+			Type:  eventType,
+			Group: pb.FromGroup(g),
+		}
+
+		select {
+		case w.events <- e:
+		default:
+			delete(ge.watchers, w)
+			close(w.events)
+		}
+	}
+}
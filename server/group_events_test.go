@@ -0,0 +1,72 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/mosaicnetworks/disco/group"
+	pb "github.com/mosaicnetworks/disco/proto"
+)
+
+// Test that changes are published to the watchers of the group's AppID, and
+// that watchers which fall behind are dropped.
+func TestGroupEvents(t *testing.T) {
+	ge := newGroupEvents(group.NewInmemGroupRepository())
+
+	w1 := ge.watch("App1")
+	defer ge.unwatch(w1)
+
+	w2 := ge.watch("App2")
+	defer ge.unwatch(w2)
+
+	g := group.NewGroup("", "Group1", "App1", nil)
+
+	id, err := ge.SetGroup(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := ge.SetGroup(g); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ge.DeleteGroup(id); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		eventType pb.GroupEvent_EventType
+		version   uint64
+	}{
+		{pb.GroupEvent_CREATED, 1},
+		{pb.GroupEvent_UPDATED, 2},
+		{pb.GroupEvent_DELETED, 2},
+	}
+
+	for i, ex := range expected {
+		e := <-w1.events
+		if e.Type != ex.eventType || e.Group.ID != id || e.Group.Version != ex.version {
+			t.Fatalf("Event %d should be %s of version %d, not %s of version %d", i, ex.eventType, ex.version, e.Type, e.Group.Version)
+		}
+	}
+
+	if len(w2.events) != 0 {
+		t.Fatalf("Watcher of App2 should not receive events of App1")
+	}
+
+	// Fill the buffer of w1 without reading it
+
+	for i := 0; i <= watchBuffer; i++ {
+		if _, err := ge.SetGroup(group.NewGroup("", "Group", "App1", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n := 0
+	for range w1.events {
+		n++
+	}
+
+	if n != watchBuffer {
+		t.Fatalf("Watcher which fell behind should receive %d events before its channel is closed, not %d", watchBuffer, n)
+	}
+}
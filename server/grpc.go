@@ -0,0 +1,305 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/mosaicnetworks/disco/group"
+	pb "github.com/mosaicnetworks/disco/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpcService implements the Discovery gRPC service defined in proto/disco.proto.
+// It operates on the same GroupRepository as the REST API, and its calls are
+// authenticated in the same way, with the API key in the "authorization"
+// metadata, or with a client certificate.
+type grpcService struct {
+	pb.UnimplementedDiscoveryServer
+	s *DiscoServer
+}
+
+// newGRPCServer creates a gRPC server exposing the Discovery service. It uses
+// tlsConfig, if not nil, which is the same as the discovery API's.
+func (s *DiscoServer) newGRPCServer(tlsConfig *tls.Config) *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.authenticateUnary),
+		grpc.StreamInterceptor(s.authenticateStream),
+	}
+
+	if tlsConfig != nil {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+
+	server := grpc.NewServer(opts...)
+	pb.RegisterDiscoveryServer(server, &grpcService{s: s})
+
+	return server
+}
+
+// authenticateUnary is a gRPC interceptor which authenticates unary calls like
+// the authenticateApp middleware
+func (s *DiscoServer) authenticateUnary(
+	ctx context.Context,
+	req interface{},
+	info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+
+	ctx, err := s.authenticateContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return handler(ctx, req)
+}
+
+// authenticateStream is a gRPC interceptor which authenticates streaming calls
+// like the authenticateApp middleware
+func (s *DiscoServer) authenticateStream(
+	srv interface{},
+	stream grpc.ServerStream,
+	info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) error {
+
+	ctx, err := s.authenticateContext(stream.Context())
+	if err != nil {
+		return err
+	}
+
+	return handler(srv, &authenticatedStream{ServerStream: stream, ctx: ctx})
+}
+
+// authenticatedStream is a ServerStream whose context holds the authenticated
+// App
+type authenticatedStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the context of the stream
+func (as *authenticatedStream) Context() context.Context {
+	return as.ctx
+}
+
+// authenticateContext authenticates the call of a gRPC context, and returns a
+// context holding the App and certificate identity, like the authenticateApp
+// middleware
+func (s *DiscoServer) authenticateContext(ctx context.Context) (context.Context, error) {
+	var apiKey string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if auth := md.Get("authorization"); len(auth) > 0 {
+			apiKey = parseBearerToken(auth[0])
+		}
+	}
+
+	var id *clientIdentity
+	if p, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			id = certificateIdentity(&tlsInfo.State)
+		}
+	}
+
+	a, authErr := s.authenticate(apiKey, id)
+	if authErr != nil {
+		code := codes.Unauthenticated
+		if authErr.Status == http.StatusForbidden {
+			code = codes.PermissionDenied
+		}
+		return nil, status.Error(code, authErr.Message)
+	}
+
+	return withAuthentication(ctx, a, id), nil
+}
+
+// ListGroups implements the Discovery service
+func (gs *grpcService) ListGroups(ctx context.Context, req *pb.ListGroupsRequest) (*pb.ListGroupsResponse, error) {
+	repo := gs.s.contextGroupRepo(ctx)
+
+	var groups map[string]*group.Group
+	var err error
+
+	if req.AppID == "" {
+		groups, err = repo.GetAllGroups()
+	} else {
+		groups, err = repo.GetAllGroupsByAppID(req.AppID)
+	}
+
+	if err != nil {
+		return nil, gs.s.grpcError(err, "Error getting groups")
+	}
+
+	return &pb.ListGroupsResponse{Groups: pb.FromGroups(groups)}, nil
+}
+
+// GetGroup implements the Discovery service
+func (gs *grpcService) GetGroup(ctx context.Context, req *pb.GetGroupRequest) (*pb.Group, error) {
+	g, err := gs.s.contextGroupRepo(ctx).GetGroup(req.ID)
+	if err != nil {
+		return nil, gs.s.grpcError(err, fmt.Sprintf("Error getting group %s", req.ID))
+	}
+
+	return pb.FromGroup(g), nil
+}
+
+// CreateGroup implements the Discovery service
+func (gs *grpcService) CreateGroup(ctx context.Context, req *pb.Group) (*pb.CreateGroupResponse, error) {
+	newGroup := pb.ToGroup(req)
+
+	// Creating a group is unconditional
+	newGroup.Version = 0
+
+	id, err := gs.s.contextGroupRepo(ctx).SetGroup(newGroup)
+	if err != nil {
+		return nil, gs.s.grpcError(err, "Error saving group")
+	}
+
+	gs.s.logGroupWrite(ctx, "created", id)
+
+	return &pb.CreateGroupResponse{ID: id}, nil
+}
+
+// UpdateGroup implements the Discovery service. If the group's Version is not
+// 0, the group is only replaced if its current version matches.
+func (gs *grpcService) UpdateGroup(ctx context.Context, req *pb.Group) (*pb.Group, error) {
+	repo := gs.s.contextGroupRepo(ctx)
+	updatedGroup := pb.ToGroup(req)
+
+	if updatedGroup.ID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Group ID not specified")
+	}
+
+	if _, err := repo.GetGroup(updatedGroup.ID); err != nil {
+		return nil, gs.s.grpcError(err, fmt.Sprintf("Error getting group %s", updatedGroup.ID))
+	}
+
+	if _, err := repo.SetGroup(updatedGroup); err != nil {
+		return nil, gs.s.grpcError(err, "Error setting group")
+	}
+
+	gs.s.logGroupWrite(ctx, "updated", updatedGroup.ID)
+
+	return pb.FromGroup(updatedGroup), nil
+}
+
+// Heartbeat implements the Discovery service
+func (gs *grpcService) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	if err := gs.s.contextGroupRepo(ctx).TouchGroup(req.ID); err != nil {
+		return nil, gs.s.grpcError(err, fmt.Sprintf("Error refreshing group %s", req.ID))
+	}
+
+	return &pb.HeartbeatResponse{}, nil
+}
+
+// DeleteGroup implements the Discovery service
+func (gs *grpcService) DeleteGroup(ctx context.Context, req *pb.DeleteGroupRequest) (*pb.DeleteGroupResponse, error) {
+	if err := gs.s.contextGroupRepo(ctx).DeleteGroup(req.ID); err != nil {
+		return nil, gs.s.grpcError(err, "Error deleting group")
+	}
+
+	gs.s.logGroupWrite(ctx, "deleted", req.ID)
+
+	return &pb.DeleteGroupResponse{}, nil
+}
+
+// Watch implements the Discovery service. It sends the existing groups of the
+// application as CREATED events, and then the events published by the
+// groupEvents repository, until the client cancels the call, the watcher falls
+// behind, or the server is closed.
+func (gs *grpcService) Watch(req *pb.WatchRequest, stream pb.Discovery_WatchServer) error {
+	ctx := stream.Context()
+	appID := contextApp(ctx).ID
+
+	if req.AppID != "" && req.AppID != appID {
+		return status.Errorf(codes.PermissionDenied, "%v to AppID %s", group.ErrAccessDenied, req.AppID)
+	}
+
+	// Watch before listing the groups, so that no change is missed
+	w := gs.s.events.watch(appID)
+	defer gs.s.events.unwatch(w)
+
+	groups, err := gs.s.contextGroupRepo(ctx).GetAllGroups()
+	if err != nil {
+		return gs.s.grpcError(err, "Error getting groups")
+	}
+
+	// Versions of the groups sent to the client, to skip the events of
+	// changes which are already included in the list
+	versions := make(map[string]uint64, len(groups))
+
+	ids := make([]string, 0, len(groups))
+	for id := range groups {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		g := groups[id]
+		versions[id] = g.Version
+
+		err := stream.Send(&pb.GroupEvent{
+			Type:  pb.GroupEvent_CREATED,
+			Group: pb.FromGroup(g),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		select {
+		case e, ok := <-w.events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "Watcher fell behind")
+			}
+
+			id := e.Group.ID
+
+			if e.Type == pb.GroupEvent_DELETED {
+				delete(versions, id)
+			} else if v, ok := versions[id]; ok && v >= e.Group.Version {
+				continue
+			} else {
+				versions[id] = e.Group.Version
+			}
+
+			if err := stream.Send(e); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-gs.s.done:
+			return status.Error(codes.Unavailable, "Server closed")
+		}
+	}
+}
+
+// grpcError converts an error of the GroupRepository to a gRPC status, like
+// repositoryError does for the REST API. Failures of the storage are logged,
+// and reported as UNAVAILABLE so that clients retry the call.
+func (s *DiscoServer) grpcError(err error, msg string) error {
+	var code codes.Code
+
+	switch {
+	case errors.Is(err, group.ErrNotFound):
+		code = codes.NotFound
+	case errors.Is(err, group.ErrAccessDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, group.ErrInvalidGroup):
+		code = codes.InvalidArgument
+	case errors.Is(err, group.ErrVersionMismatch):
+		code = codes.FailedPrecondition
+	default:
+		s.logger.WithError(err).Error(msg)
+		code = codes.Unavailable
+	}
+
+	return status.Errorf(code, "%s: %v", msg, err)
+}
@@ -0,0 +1,154 @@
+package server_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/discotest"
+	"github.com/mosaicnetworks/disco/group"
+	pb "github.com/mosaicnetworks/disco/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// dialGRPC connects to the gRPC server of a test server, trusting its
+// certificate
+func dialGRPC(t *testing.T, ts *discotest.Server) *grpc.ClientConn {
+	pem, err := ioutil.ReadFile(ts.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	conn, err := grpc.Dial(ts.GRPCAddr,
+		grpc.WithTransportCredentials(credentials.NewTLS(&tls.Config{RootCAs: pool})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+// Test that gRPC calls are authenticated with the API key in the metadata, and
+// that storage failures are reported as UNAVAILABLE, like 503 responses of the
+// REST API.
+func TestGRPCErrors(t *testing.T) {
+	fs := newFaultyServer()
+	defer fs.Close()
+
+	conn := dialGRPC(t, fs.Server)
+	defer conn.Close()
+
+	client := pb.NewDiscoveryClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := client.ListGroups(ctx, &pb.ListGroupsRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("Call without API key should fail with Unauthenticated, not %v", err)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+fs.apiKey)
+
+	id := fs.newGroup(t)
+
+	cases := []struct {
+		name  string
+		call  func() error
+		fault discotest.Method
+		code  codes.Code
+	}{
+		{"list groups", func() error {
+			_, err := client.ListGroups(ctx, &pb.ListGroupsRequest{})
+			return err
+		}, discotest.MethodGetAllGroupsByAppID, codes.Unavailable},
+		{"get group", func() error {
+			_, err := client.GetGroup(ctx, &pb.GetGroupRequest{ID: id})
+			return err
+		}, discotest.MethodGetGroup, codes.Unavailable},
+		{"create group", func() error {
+			_, err := client.CreateGroup(ctx, &pb.Group{Name: "New"})
+			return err
+		}, discotest.MethodSetGroup, codes.Unavailable},
+		{"heartbeat", func() error {
+			_, err := client.Heartbeat(ctx, &pb.HeartbeatRequest{ID: id})
+			return err
+		}, discotest.MethodTouchGroup, codes.Unavailable},
+		{"delete group", func() error {
+			_, err := client.DeleteGroup(ctx, &pb.DeleteGroupRequest{ID: id})
+			return err
+		}, discotest.MethodDeleteGroup, codes.Unavailable},
+	}
+
+	for _, c := range cases {
+		fs.faults.Clear()
+		fs.faults.Inject(discotest.Fault{Err: discotest.ErrInjected}, c.fault)
+
+		if err := c.call(); status.Code(err) != c.code {
+			t.Fatalf("%s with %s failure should fail with %s, not %v", c.name, c.fault, c.code, err)
+		}
+	}
+
+	// Without faults, errors caused by the request are not storage failures
+
+	fs.faults.Clear()
+
+	if _, err := client.GetGroup(ctx, &pb.GetGroupRequest{ID: "unknown"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("Unknown group should fail with NotFound, not %v", err)
+	}
+
+	if _, err := client.ListGroups(ctx, &pb.ListGroupsRequest{AppID: "OtherApp"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("Groups of another app should fail with PermissionDenied, not %v", err)
+	}
+
+	if _, err := client.UpdateGroup(ctx, &pb.Group{Name: "NoID"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("Update without ID should fail with InvalidArgument, not %v", err)
+	}
+
+	if _, err := client.UpdateGroup(ctx, &pb.Group{ID: id, Version: 7}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("Stale update should fail with FailedPrecondition, not %v", err)
+	}
+}
+
+// Test that Watch streams end when the server is closed
+func TestGRPCWatchClose(t *testing.T) {
+	ts := discotest.NewServer()
+
+	conn := dialGRPC(t, ts)
+	defer conn.Close()
+
+	a := ts.NewApp("TestApp")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+a.APIKey)
+
+	if _, err := ts.Groups.SetGroup(group.NewGroup("", "TestGroup", "TestApp", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, err := pb.NewDiscoveryClient(conn).Watch(ctx, &pb.WatchRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e, err := stream.Recv(); err != nil || e.Group.Name != "TestGroup" {
+		t.Fatalf("Watch should receive the existing group, not %v %v", e, err)
+	}
+
+	ts.Close()
+
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Fatalf("Watch should fail with Unavailable when the server is closed, not %v", err)
+	}
+}
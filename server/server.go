@@ -1,21 +1,26 @@
 package server
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
-	"strings"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
-	"github.com/mosaicnetworks/babble/src/net/signal/wamp"
+	"github.com/mosaicnetworks/disco/app"
 	"github.com/mosaicnetworks/disco/group"
-	"github.com/pion/logging"
 	"github.com/pion/turn/v2"
 	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
 )
 
 // DiscoServer is a peer-discovery and webrtc-signaling service for Babble.
@@ -24,139 +29,420 @@ import (
 // WebRTC-signaling enables users to exchange connection metadata (SDP) to
 // create direct p2p connections, and relies on the WAMP protocol which is
 // basically RPC over web-sockets.
+//
+// Requests to the discovery API are authenticated with the API key of an
+// application registered in the AppRepository, and can only access the groups
+// of that application. Applications are managed through an admin API which is
+// protected by the admin key.
+//
+// When a client CA file is configured in the TLSConfig, the discovery API also
+// requires clients to present a certificate issued by one of its CAs (mutual
+// TLS). A certificate whose subject names a registered application
+// authenticates requests in place of the API key.
+//
+// The group operations of the discovery API are also exposed as a gRPC
+// service, with the same repository, TLS configuration, and authentication.
 type DiscoServer struct {
-	repo     group.GroupRepository
-	certFile string
-	keyFile  string
-	logger   *logrus.Entry
+	repo       group.GroupRepository // publishes its changes to events
+	events     *groupEvents
+	apps       app.AppRepository
+	adminKey   string
+	turn       TURNConfig
+	turnQuotas *turnQuotas
+	tls        TLSConfig
+	logger     *logrus.Entry
+
+	apiServer    *http.Server
+	apiListener  net.Listener
+	grpcServer   *grpc.Server
+	grpcListener net.Listener
+	signalServer *SignalServer
+	turnServer   *turn.Server
+	ready        chan struct{} // closed when the servers are listening
+	done         chan struct{} // closed by Close
+	apiErrors    chan error    // errors of the discovery API and gRPC servers
+	closeOnce    sync.Once
 }
 
-// NewDiscoServer instantiates a new DiscoServer with a GroupRepository.
+// NewDiscoServer instantiates a new DiscoServer with a GroupRepository and an
+// AppRepository. If adminKey is empty, the admin API is disabled.
 func NewDiscoServer(
 	repo group.GroupRepository,
-	certFile string,
-	keyFile string,
+	apps app.AppRepository,
+	adminKey string,
+	turnConfig TURNConfig,
+	tlsConfig TLSConfig,
 	logger *logrus.Entry,
 ) *DiscoServer {
 
+	events := newGroupEvents(repo)
+
 	return &DiscoServer{
-		repo:     repo,
-		certFile: certFile,
-		keyFile:  keyFile,
-		logger:   logger,
+		repo:       events,
+		events:     events,
+		apps:       apps,
+		adminKey:   adminKey,
+		turn:       turnConfig,
+		turnQuotas: newTURNQuotas(turnConfig, logger.WithField("component", "turn-quotas")),
+		tls:        tlsConfig,
+		logger:     logger,
+		ready:      make(chan struct{}),
+		done:       make(chan struct{}),
+		apiErrors:  make(chan error, 2),
 	}
 }
 
-// Serve starts the peer-discovery, signaling, and TURN servers.
+// Serve starts the peer-discovery, gRPC, signaling, and TURN servers, and
+// blocks until the server is closed. It exits the process if a server fails.
 func (s *DiscoServer) Serve(
 	discoAddr string,
 	signalAddr string,
-	turnAddr string,
-	turnUsername string,
-	turnPassword string,
-	realm string,
+	grpcAddr string,
 	ttl time.Duration,
 	ttlHearbeat time.Duration) {
 
-	// Create and start WAMP server
-	wampServer, err := wamp.NewServer(
+	if err := s.Start(discoAddr, signalAddr, grpcAddr, ttl, ttlHearbeat); err != nil {
+		log.Fatal(err)
+	}
+
+	select {
+	case err := <-s.apiErrors:
+		log.Fatal(err)
+	case <-s.done:
+	}
+}
+
+// Start starts the peer-discovery, gRPC, signaling, and TURN servers in the
+// background, and returns once they are listening. Addresses with port 0 are
+// assigned a random port, which is returned by Addr, GRPCAddr, and SignalAddr.
+// The gRPC server is disabled if grpcAddr is empty. If a server fails to start,
+// the others are closed and the error is returned.
+func (s *DiscoServer) Start(
+	discoAddr string,
+	signalAddr string,
+	grpcAddr string,
+	ttl time.Duration,
+	ttlHearbeat time.Duration) error {
+
+	if err := s.start(discoAddr, signalAddr, grpcAddr, ttl, ttlHearbeat); err != nil {
+		s.Close()
+		return err
+	}
+
+	close(s.ready)
+
+	return nil
+}
+
+// start creates the listeners of the servers, and serves them in the
+// background
+func (s *DiscoServer) start(
+	discoAddr string,
+	signalAddr string,
+	grpcAddr string,
+	ttl time.Duration,
+	ttlHearbeat time.Duration) error {
+
+	// Load the TLS certificate shared by the discovery API, the WAMP server,
+	// and the TURN TLS listener
+	certs, err := s.loadCertificate()
+	if err != nil {
+		return err
+	}
+
+	apiTLSConfig, err := s.apiTLSConfig(certs)
+	if err != nil {
+		return err
+	}
+
+	// Create the WAMP server. It hosts a realm for every registered
+	// application, and also exposes the discovery API as WAMP procedures.
+	s.signalServer, err = NewSignalServer(
 		signalAddr,
-		realm,
-		s.certFile,
-		s.keyFile,
+		certs.tlsConfig(),
+		s.repo,
+		s.apps,
 		s.logger)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	if err := s.signalServer.Listen(); err != nil {
+		return err
 	}
-	go wampServer.Run()
-	defer wampServer.Shutdown()
 
 	// Create and start TURN server
-	turnServer, err := createAndStartTURNServer(
-		turnAddr,
-		turnUsername,
-		turnPassword,
-		realm,
-	)
+	turnAuthenticator, err := newTURNAuthenticator(s.turn, s.apps)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+
+	s.turnQuotas.userAppID = turnAuthenticator.userAppID
+
+	if s.turn.UsageFile != "" {
+		if err := s.turnQuotas.loadUsage(s.turn.UsageFile); err != nil {
+			return err
+		}
+	}
+
+	s.turnServer, err = createAndStartTURNServer(s.turn,
+		turnAuthenticator.authenticate,
+		s.turnQuotas,
+		certs.tlsConfig())
+	if err != nil {
+		return err
+	}
+
+	// Create the discovery API listener. Only the discovery API requests
+	// client certificates.
+	s.apiListener, err = net.Listen("tcp", discoAddr)
+	if err != nil {
+		return err
+	}
+
+	if apiTLSConfig == nil {
+		s.logger.Warnf("Serving discovery API over plaintext HTTP on %s", s.Addr())
+	}
+
+	s.apiServer = &http.Server{
+		Handler:   s.router(),
+		TLSConfig: apiTLSConfig,
+	}
+
+	// Create the gRPC listener. The gRPC service uses the TLS configuration of
+	// the discovery API, including client certificates.
+	if grpcAddr != "" {
+		s.grpcListener, err = net.Listen("tcp", grpcAddr)
+		if err != nil {
+			return err
+		}
+
+		s.grpcServer = s.newGRPCServer(apiTLSConfig)
+	}
+
+	// Everything is listening. Serve in the background.
+
+	go s.signalServer.Run()
+
+	go func() {
+		var err error
+		if apiTLSConfig == nil {
+			err = s.apiServer.Serve(s.apiListener)
+		} else {
+			// The certificate is provided by apiTLSConfig
+			err = s.apiServer.ServeTLS(s.apiListener, "", "")
+		}
+
+		if err != http.ErrServerClosed {
+			s.apiErrors <- err
+		}
+	}()
+
+	if s.grpcServer != nil {
+		go func() {
+			err := s.grpcServer.Serve(s.grpcListener)
+			if err != nil && err != grpc.ErrServerStopped {
+				s.apiErrors <- err
+			}
+		}()
+	}
+
+	// Reload the TURN users file on SIGHUP
+	go s.reloadOnSIGHUP("TURN users", turnAuthenticator.reload)
+
+	// Save the TURN usage periodically
+	if s.turn.UsageFile != "" {
+		go s.persistTURNUsage(s.turn.UsageInterval)
 	}
-	defer turnServer.Close()
 
 	// Start the TTL routine that deletes groups when the exceed their Time To
 	// Live
 	go s.processTTL(ttlHearbeat, ttl)
 
-	// Configure and start discovery API
-	s.serveAPI(discoAddr)
-
-	return
+	return nil
 }
 
-// createAndStartTURNServer configures and runs the TURN server.
-func createAndStartTURNServer(
-	turnAddr string,
-	turnUsername string,
-	turnPassword string,
-	realm string) (*turn.Server, error) {
+// Ready returns a channel which is closed when the servers started by Serve or
+// Start are listening
+func (s *DiscoServer) Ready() <-chan struct{} {
+	return s.ready
+}
 
-	// Populate the map of authorised users with the single user defined by
-	// turnUsername and turnPassword.
-	usersMap := map[string][]byte{}
-	usersMap[turnUsername] = turn.GenerateAuthKey(turnUsername, realm, turnPassword)
+// Addr returns the address of the discovery API, once the server is listening
+func (s *DiscoServer) Addr() string {
+	if s.apiListener == nil {
+		return ""
+	}
+	return s.apiListener.Addr().String()
+}
 
-	// Split the turnAddr into IP and Port.
-	split := strings.Split(turnAddr, ":")
-	if len(split) != 2 {
-		return nil, fmt.Errorf("Invalid ICE address format")
+// GRPCAddr returns the address of the gRPC server, once the server is
+// listening. It is empty if the gRPC server is disabled.
+func (s *DiscoServer) GRPCAddr() string {
+	if s.grpcListener == nil {
+		return ""
 	}
-	bindAddr := split[0]
-	icePort := split[1]
+	return s.grpcListener.Addr().String()
+}
 
-	// Create a UDP listener to pass into pion/turn
-	udpListener, err := net.ListenPacket("udp4", "0.0.0.0:"+icePort)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to create TURN server listener: %s", err)
+// SignalAddr returns the address of the WebRTC-signaling server, once the
+// server is listening
+func (s *DiscoServer) SignalAddr() string {
+	if s.signalServer == nil {
+		return ""
 	}
+	return s.signalServer.Addr()
+}
+
+// Close stops the servers and their background routines, and closes all the
+// connections to the discovery API. A closed server can not be restarted.
+func (s *DiscoServer) Close() error {
+	var err error
 
-	// Override the default log level
-	logFactory := logging.NewDefaultLoggerFactory()
-	logFactory.DefaultLogLevel = logging.LogLevelInfo
+	s.closeOnce.Do(func() {
+		close(s.done)
 
-	s, err := turn.NewServer(turn.ServerConfig{
-		Realm: realm,
-		// Set AuthHandler callback
-		// This is called everytime a user tries to authenticate with the TURN
-		// server. Return the key for that user, or false when no user is found
-		AuthHandler: func(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
-			if key, ok := usersMap[username]; ok {
-				return key, true
+		if s.apiServer != nil {
+			err = s.apiServer.Close()
+		}
+
+		// The API server only closes the listener once it serves it, which it
+		// does not if Start failed later. Closing it twice is harmless.
+		if s.apiListener != nil {
+			s.apiListener.Close()
+		}
+
+		// Stop closes the listener, and all the connections
+		switch {
+		case s.grpcServer != nil:
+			s.grpcServer.Stop()
+		case s.grpcListener != nil:
+			s.grpcListener.Close()
+		}
+
+		if s.signalServer != nil {
+			s.signalServer.Shutdown()
+		}
+
+		if s.turnServer != nil {
+			if turnErr := s.turnServer.Close(); err == nil {
+				err = turnErr
+			}
+
+			// Save the usage recorded since the last periodic save. The usage
+			// file was loaded before the TURN server started.
+			if s.turn.UsageFile != "" {
+				if saveErr := s.turnQuotas.saveUsage(s.turn.UsageFile); err == nil {
+					err = saveErr
+				}
 			}
-			return nil, false
-		},
-		// PacketConnConfigs is a list of UDP Listeners and the configuration around them
-		PacketConnConfigs: []turn.PacketConnConfig{
-			{
-				PacketConn: udpListener,
-				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
-					RelayAddress: net.ParseIP(bindAddr), // Claim that we are listening on IP passed by user (This should be your Public IP)
-					Address:      "0.0.0.0",             // But actually be listening on every interface
-				},
-			},
-		},
-		LoggerFactory: logFactory,
+		}
 	})
+
+	return err
+}
+
+// apiTLSConfig returns the TLS configuration of the discovery API, which also
+// requires client certificates if a client CA file is configured. It returns
+// nil if the discovery API is served over plaintext HTTP.
+func (s *DiscoServer) apiTLSConfig(certs *certReloader) (*tls.Config, error) {
+	if s.tls.InsecureHTTP {
+		if s.tls.ClientCAFile != "" {
+			return nil, fmt.Errorf("Client certificates can not be used with insecure HTTP")
+		}
+		return nil, nil
+	}
+
+	tlsConfig := certs.tlsConfig()
+
+	if s.tls.ClientCAFile != "" {
+		clientCAs, err := loadCertPool(s.tls.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// loadCertificate loads the TLS certificate files, and reloads them when they
+// change, or on SIGHUP, without dropping existing connections. In dev mode, it
+// generates a self-signed certificate instead.
+func (s *DiscoServer) loadCertificate() (*certReloader, error) {
+	if s.tls.Dev {
+		certs, err := newSelfSignedCertReloader(devCertHosts)
+		if err != nil {
+			return nil, err
+		}
+
+		s.logger.Warn("Using a self-signed development certificate")
+
+		if s.tls.DevCertFile != "" {
+			if err := certs.writeCert(s.tls.DevCertFile); err != nil {
+				return nil, err
+			}
+			s.logger.Infof("Wrote development certificate to %s", s.tls.DevCertFile)
+		}
+
+		return certs, nil
+	}
+
+	certs, err := newCertReloader(s.tls.CertFile, s.tls.KeyFile)
 	if err != nil {
-		return nil, fmt.Errorf("Fail to create TURN server: %s", err)
+		return nil, err
 	}
 
-	return s, nil
+	go func() {
+		if err := certs.watch(s.done, s.logger); err != nil {
+			s.logger.WithError(err).Error("Failed to watch TLS certificate")
+		}
+	}()
+
+	go s.reloadOnSIGHUP("TLS certificate", certs.reload)
+
+	return certs, nil
+}
+
+// reloadOnSIGHUP calls reload every time the process receives a SIGHUP, until
+// the server is closed.
+func (s *DiscoServer) reloadOnSIGHUP(name string, reload func() error) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-sighup:
+		case <-s.done:
+			return
+		}
+
+		if err := reload(); err != nil {
+			s.logger.WithError(err).Errorf("Failed to reload %s", name)
+			continue
+		}
+		s.logger.Infof("Reloaded %s", name)
+	}
 }
 
 // processTTL deletes groups that have exceeded their Time To Live (TTL). It
-// will check each group at event intervals defined by the heartbeat parameter.
+// will check each group at event intervals defined by the heartbeat parameter,
+// until the server is closed.
 func (s *DiscoServer) processTTL(heartbeat time.Duration, ttl time.Duration) {
-	for now := range time.Tick(heartbeat) {
+	ticker := time.NewTicker(heartbeat)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+
+		select {
+		case now = <-ticker.C:
+		case <-s.done:
+			return
+		}
+
 		allGroups, _ := s.repo.GetAllGroups()
 		for gid, g := range allGroups {
 			if g.LastUpdated+int64(ttl.Seconds()) < now.Unix() {
@@ -167,52 +453,96 @@ func (s *DiscoServer) processTTL(heartbeat time.Duration, ttl time.Duration) {
 	}
 }
 
-// serveAPI configures the handlers and runs the HTTP server.
-func (s *DiscoServer) serveAPI(discoAddr string) {
+// router returns the handler of the discovery API
+func (s *DiscoServer) router() http.Handler {
 	router := mux.NewRouter().StrictSlash(true)
-	router.HandleFunc("/group", s.createGroup).Methods("POST")
-	router.HandleFunc("/groups", s.getGroups).Methods("GET")
-	router.HandleFunc("/groups/{id}", s.getGroup).Methods("GET")
-	router.HandleFunc("/groups/{id}", s.updateGroup).Methods("PATCH")
-	router.HandleFunc("/groups/{id}", s.deleteGroup).Methods("DELETE")
-	log.Fatal(http.ListenAndServeTLS(discoAddr, s.certFile, s.keyFile, router))
+
+	router.HandleFunc("/health", s.health).Methods("GET")
+
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(s.authenticateAdmin)
+	admin.HandleFunc("/apps", s.createApp).Methods("POST")
+	admin.HandleFunc("/apps", s.getApps).Methods("GET")
+	admin.HandleFunc("/apps/{id}", s.getApp).Methods("GET")
+	admin.HandleFunc("/apps/{id}", s.revokeApp).Methods("DELETE")
+	admin.HandleFunc("/apps/{id}/key", s.rotateAPIKey).Methods("POST")
+	admin.HandleFunc("/turn/usage", s.getTURNUsage).Methods("GET")
+
+	api := router.NewRoute().Subrouter()
+	api.Use(s.authenticateApp)
+	api.HandleFunc("/group", s.createGroup).Methods("POST")
+	api.HandleFunc("/groups", s.getGroups).Methods("GET")
+	api.HandleFunc("/groups/{id}", s.getGroup).Methods("GET")
+	api.HandleFunc("/groups/{id}", s.updateGroup).Methods("PUT")
+	api.HandleFunc("/groups/{id}", s.patchGroup).Methods("PATCH")
+	api.HandleFunc("/groups/{id}/heartbeat", s.heartbeatGroup).Methods("POST")
+	api.HandleFunc("/groups/{id}", s.deleteGroup).Methods("DELETE")
+	api.HandleFunc("/turn/credentials", s.getTURNCredentials).Methods("GET")
+	api.HandleFunc("/ice-servers", s.getICEServers).Methods("GET")
+
+	return router
+}
+
+// health is an unauthenticated endpoint that clients use to check that the
+// server is up, and to measure its latency
+func (s *DiscoServer) health(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprint(w, "OK")
 }
 
 func (s *DiscoServer) createGroup(w http.ResponseWriter, r *http.Request) {
 	var newGroup group.Group
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Fprintf(w, "Error reading request body: %v", err)
+		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return
 	}
 
 	err = json.Unmarshal(reqBody, &newGroup)
 	if err != nil {
-		fmt.Fprintf(w, "Error unmarshalling group: %v", err)
+		http.Error(w, fmt.Sprintf("Error unmarshalling group: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	id, err := s.repo.SetGroup(&newGroup)
+	// Creating a group is unconditional
+	newGroup.Version = 0
+
+	id, err := s.groupRepo(r).SetGroup(&newGroup)
 	if err != nil {
-		fmt.Fprintf(w, "Error saving group: %v", err)
+		s.repositoryError(w, err, "Error saving group")
+		return
 	}
 
+	s.logGroupWrite(r.Context(), "created", id)
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(id)
 }
 
 func (s *DiscoServer) getGroups(w http.ResponseWriter, r *http.Request) {
 	appID := r.URL.Query().Get("app-id")
+	repo := s.groupRepo(r)
 
 	groups := make(map[string]*group.Group)
 	var err error
 
 	if appID == "" {
-		groups, err = s.repo.GetAllGroups()
+		groups, err = repo.GetAllGroups()
 	} else {
-		groups, err = s.repo.GetAllGroupsByAppID(appID)
+		groups, err = repo.GetAllGroupsByAppID(appID)
 	}
 
 	if err != nil {
-		fmt.Fprintf(w, "Error getting groups: %v", err)
+		s.repositoryError(w, err, "Error getting groups")
+		return
+	}
+
+	etag := groupsETag(groups)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if notModified(r, etag, time.Time{}) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	json.NewEncoder(w).Encode(groups)
@@ -221,42 +551,170 @@ func (s *DiscoServer) getGroups(w http.ResponseWriter, r *http.Request) {
 func (s *DiscoServer) getGroup(w http.ResponseWriter, r *http.Request) {
 	groupID := mux.Vars(r)["id"]
 
-	group, err := s.repo.GetGroup(groupID)
+	group, err := s.groupRepo(r).GetGroup(groupID)
 	if err != nil {
-		fmt.Fprintf(w, "Error getting group %s: %v", groupID, err)
+		s.repositoryError(w, err, fmt.Sprintf("Error getting group %s", groupID))
+		return
+	}
+
+	setETag(w, group)
+	lastModified := time.Unix(group.LastUpdated, 0)
+	w.Header().Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if notModified(r, etag(group), lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
 	}
 
 	json.NewEncoder(w).Encode(group)
 }
 
+// updateGroup replaces a group. If the request has an If-Match header, the
+// group is only replaced if its current version matches.
 func (s *DiscoServer) updateGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	repo := s.groupRepo(r)
+
+	version, err := ifMatchVersion(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
 	var updatedGroup group.Group
 
 	reqBody, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		fmt.Fprintf(w, "Kindly enter data with the event title and description only in order to update")
+		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return
 	}
 
 	err = json.Unmarshal(reqBody, &updatedGroup)
 	if err != nil {
-		fmt.Fprintf(w, "Error parsing group: %v", err)
+		http.Error(w, fmt.Sprintf("Error parsing group: %v", err), http.StatusBadRequest)
+		return
 	}
 
-	id, err := s.repo.SetGroup(&updatedGroup)
+	if updatedGroup.ID == "" {
+		updatedGroup.ID = groupID
+	}
+
+	if updatedGroup.ID != groupID {
+		http.Error(w, "Group ID does not match URL", http.StatusBadRequest)
+		return
+	}
+
+	if _, err := repo.GetGroup(groupID); err != nil {
+		s.repositoryError(w, err, fmt.Sprintf("Error getting group %s", groupID))
+		return
+	}
+
+	updatedGroup.Version = version
+
+	s.saveGroup(w, r, repo, &updatedGroup)
+}
+
+// patchGroup applies a JSON Merge Patch (RFC 7396) to a group. The patch is
+// applied to the current version of the group, and fails if the group is
+// updated concurrently. If the request has an If-Match header, the patch is
+// only applied if the current version matches.
+func (s *DiscoServer) patchGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+	repo := s.groupRepo(r)
+
+	version, err := ifMatchVersion(r)
 	if err != nil {
-		fmt.Fprintf(w, "Error setting group: %v", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
 
-	json.NewEncoder(w).Encode(id)
+	patch, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error reading request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	current, err := repo.GetGroup(groupID)
+	if err != nil {
+		s.repositoryError(w, err, fmt.Sprintf("Error getting group %s", groupID))
+		return
+	}
+
+	if version != 0 && version != current.Version {
+		http.Error(w, group.ErrVersionMismatch.Error(), http.StatusPreconditionFailed)
+		return
+	}
+
+	patchedGroup, err := group.MergePatch(current, patch)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.saveGroup(w, r, repo, patchedGroup)
+}
+
+// saveGroup sets a group in the repository and responds with the updated group
+func (s *DiscoServer) saveGroup(w http.ResponseWriter, r *http.Request, repo group.GroupRepository, g *group.Group) {
+	if _, err := repo.SetGroup(g); err != nil {
+		s.repositoryError(w, err, "Error setting group")
+		return
+	}
+
+	s.logGroupWrite(r.Context(), "updated", g.ID)
+
+	setETag(w, g)
+	json.NewEncoder(w).Encode(g)
+}
+
+// heartbeatGroup refreshes the LastUpdated time of a group, so that it does not
+// expire, without changing its version
+func (s *DiscoServer) heartbeatGroup(w http.ResponseWriter, r *http.Request) {
+	groupID := mux.Vars(r)["id"]
+
+	if err := s.groupRepo(r).TouchGroup(groupID); err != nil {
+		s.repositoryError(w, err, fmt.Sprintf("Error refreshing group %s", groupID))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *DiscoServer) deleteGroup(w http.ResponseWriter, r *http.Request) {
 	groupID := mux.Vars(r)["id"]
 
-	err := s.repo.DeleteGroup(groupID)
+	err := s.groupRepo(r).DeleteGroup(groupID)
 	if err != nil {
-		fmt.Fprintf(w, "Error deleting group: %v", err)
+		s.repositoryError(w, err, "Error deleting group")
+		return
 	}
 
+	s.logGroupWrite(r.Context(), "deleted", groupID)
+
 	fmt.Fprintf(w, "The group with ID %v has been deleted successfully", groupID)
 }
+
+// repositoryError responds to a request that failed with an error of the
+// GroupRepository. Errors caused by the request have a 4xx status. Other errors
+// are failures of the storage, which are logged, and reported with a 503 status
+// so that clients retry the request, or fail over to another server.
+func (s *DiscoServer) repositoryError(w http.ResponseWriter, err error, msg string) {
+	var status int
+
+	switch {
+	case errors.Is(err, group.ErrNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, group.ErrAccessDenied):
+		status = http.StatusForbidden
+	case errors.Is(err, group.ErrInvalidGroup):
+		status = http.StatusBadRequest
+	case errors.Is(err, group.ErrVersionMismatch):
+		status = http.StatusPreconditionFailed
+	default:
+		s.logger.WithError(err).Error(msg)
+		status = http.StatusServiceUnavailable
+	}
+
+	http.Error(w, fmt.Sprintf("%s: %v", msg, err), status)
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+// Test that Serve signals when the server is ready, on random ports, and
+// returns when the server is closed.
+func TestServe(t *testing.T) {
+	s := NewDiscoServer(
+		group.NewInmemGroupRepository(),
+		app.NewInmemAppRepository(),
+		"",
+		TURNConfig{
+			Address: "127.0.0.1:0",
+			Realm:   "main",
+		},
+		TLSConfig{
+			CertFile: "../test_data/cert.pem",
+			KeyFile:  "../test_data/key.pem",
+		},
+		logrus.New().WithField("component", "disco-server"),
+	)
+
+	served := make(chan struct{})
+
+	go func() {
+		s.Serve("127.0.0.1:0", "127.0.0.1:0", "127.0.0.1:0", 5*time.Minute, 1*time.Minute)
+		close(served)
+	}()
+
+	select {
+	case <-s.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Server should be ready")
+	}
+
+	if s.SignalAddr() == "" || s.SignalAddr() == s.Addr() {
+		t.Fatalf("Signal address should be assigned, not %q", s.SignalAddr())
+	}
+
+	if s.GRPCAddr() == "" || s.GRPCAddr() == s.Addr() || s.GRPCAddr() == s.SignalAddr() {
+		t.Fatalf("gRPC address should be assigned, not %q", s.GRPCAddr())
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		},
+	}
+
+	resp, err := client.Get("https://" + s.Addr() + "/health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Health check should return 200, not %d", resp.StatusCode)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve should return when the server is closed")
+	}
+
+	if _, err := client.Get("https://" + s.Addr() + "/health"); err == nil {
+		t.Fatalf("Closed server should refuse connections")
+	}
+}
+
+// Test that the listeners of a server that fails to start, because its gRPC
+// port is already in use, are released when it is closed.
+func TestStartGRPCPortInUse(t *testing.T) {
+	used, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer used.Close()
+
+	s := NewDiscoServer(
+		group.NewInmemGroupRepository(),
+		app.NewInmemAppRepository(),
+		"",
+		TURNConfig{
+			Address: "127.0.0.1:0",
+			Realm:   "main",
+		},
+		TLSConfig{
+			CertFile: "../test_data/cert.pem",
+			KeyFile:  "../test_data/key.pem",
+		},
+		logrus.New().WithField("component", "disco-server"),
+	)
+
+	if err := s.Start("127.0.0.1:0", "127.0.0.1:0", used.Addr().String(), 5*time.Minute, time.Minute); err == nil {
+		t.Fatalf("Starting on a gRPC port in use should fail")
+	}
+
+	apiAddr := s.Addr()
+	if apiAddr == "" {
+		t.Fatalf("Discovery API should be listening before the gRPC server")
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", apiAddr)
+	if err != nil {
+		t.Fatalf("Discovery API address should be released: %v", err)
+	}
+	l.Close()
+}
@@ -0,0 +1,535 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/router"
+	"github.com/gammazero/nexus/v3/router/auth"
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ProcListGroups is the WAMP procedure that returns all the groups, or only
+	// those belonging to the AppID passed as first argument.
+	ProcListGroups = "disco.groups.list"
+	// ProcGetGroup is the WAMP procedure that returns a single group by ID.
+	ProcGetGroup = "disco.groups.get"
+	// ProcCreateGroup is the WAMP procedure that creates a new group.
+	ProcCreateGroup = "disco.groups.create"
+	// ProcUpdateGroup is the WAMP procedure that updates an existing group.
+	ProcUpdateGroup = "disco.groups.update"
+	// ProcDeleteGroup is the WAMP procedure that deletes a group by ID.
+	ProcDeleteGroup = "disco.groups.delete"
+
+	// ErrInvalidArgument indicates that the arguments of a discovery procedure
+	// call could not be parsed.
+	ErrInvalidArgument = "disco.error.invalid_argument"
+	// ErrRepository indicates that the GroupRepository returned an error while
+	// processing a discovery procedure call.
+	ErrRepository = "disco.error.repository"
+)
+
+const (
+	// helloTimeout is the time allowed for new clients to send their HELLO
+	// message
+	helloTimeout = 5 * time.Second
+	// authTimeout is the time allowed for clients to respond to a ticket
+	// challenge
+	authTimeout = 30 * time.Second
+)
+
+// SignalServer is a WAMP server which relays WebRTC signaling messages between
+// connected clients. It is equivalent to Babble's wamp.Server, but it hosts a
+// separate realm for every registered application, and it also registers
+// procedures which expose the discovery API over the same WAMP connection. The
+// procedure arguments and results are JSON-encoded strings, mirroring the
+// bodies of the REST API.
+//
+// The realm of an application has the same URI as its AppID, and is created on
+// demand when the first client tries to join it. Clients must authenticate with
+// the "ticket" method, where the authid is the AppID and the ticket is the
+// application's API key. If the application enables AnonymousSignaling, clients
+// can also join anonymously, but they can not call the discovery procedures.
+type SignalServer struct {
+	sync.Mutex
+	address    string
+	nxr        router.Router             // underlying nexus router
+	router     router.Router             // realmRouter wrapping nxr
+	realms     map[string]*client.Client // [AppID] => local client
+	repo       group.GroupRepository
+	apps       app.AppRepository
+	httpServer *http.Server
+	listener   net.Listener
+	logger     *logrus.Entry
+}
+
+// NewSignalServer instantiates a new SignalServer which can be run at a
+// specified address. The websocket server uses tlsConfig, which must provide a
+// certificate.
+func NewSignalServer(
+	address string,
+	tlsConfig *tls.Config,
+	repo group.GroupRepository,
+	apps app.AppRepository,
+	logger *logrus.Entry,
+) (*SignalServer, error) {
+
+	// Create router instance without any realms. Realms are added on demand.
+	nxr, err := router.NewRouter(&router.Config{}, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SignalServer{
+		address: address,
+		nxr:     nxr,
+		realms:  make(map[string]*client.Client),
+		repo:    repo,
+		apps:    apps,
+		logger:  logger,
+	}
+
+	res.router = &realmRouter{
+		Router:      nxr,
+		ensureRealm: res.ensureRealm,
+	}
+
+	res.httpServer = &http.Server{
+		Handler:   router.NewWebsocketServer(res.router),
+		Addr:      address,
+		TLSConfig: tlsConfig,
+	}
+
+	return res, nil
+}
+
+// Listen binds the address of the server, so that clients can connect before
+// Run is called. If the address has port 0, a random port is chosen, and Addr
+// returns the actual address.
+func (s *SignalServer) Listen() error {
+	l, err := net.Listen("tcp", s.address)
+	if err != nil {
+		return err
+	}
+
+	s.listener = l
+	s.address = l.Addr().String()
+
+	return nil
+}
+
+// Run starts the WAMP websocket server, calling Listen first if necessary
+func (s *SignalServer) Run() error {
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			s.logger.WithError(err).Error("Run")
+			return err
+		}
+	}
+
+	// The call to ServeTLS has empty arguments because the certificates are
+	// provided by the TLSConfig of the server
+	err := s.httpServer.ServeTLS(s.listener, "", "")
+	if err != nil && err != http.ErrServerClosed {
+		s.logger.WithError(err).Error("Run")
+	}
+	return err
+}
+
+// Shutdown stops the websocket server, the local clients, and the wamp router
+func (s *SignalServer) Shutdown() {
+	defer s.router.Close()
+
+	s.Lock()
+	for realm, local := range s.realms {
+		if err := local.Close(); err != nil {
+			s.logger.WithError(err).Errorf("Closing local WAMP client of realm %s", realm)
+		}
+	}
+	s.Unlock()
+
+	if err := s.httpServer.Shutdown(context.Background()); err != nil {
+		s.logger.WithError(err).Error("Shutting down http server")
+	}
+
+	// The listener is only closed by Shutdown if Run was called
+	if s.listener != nil {
+		s.listener.Close()
+	}
+}
+
+// Addr returns the address of the server
+func (s *SignalServer) Addr() string {
+	return s.address
+}
+
+// ensureRealm creates the realm of a registered application, if it does not
+// exist yet, and registers the discovery procedures in that realm.
+func (s *SignalServer) ensureRealm(appID string) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.realms[appID]; ok {
+		return nil
+	}
+
+	a, err := s.apps.GetApp(appID)
+	if err != nil {
+		return err
+	}
+
+	if a.Revoked {
+		return fmt.Errorf("App %s is revoked", appID)
+	}
+
+	err = s.nxr.AddRealm(&router.RealmConfig{
+		URI: wamp.URI(appID),
+		Authenticators: []auth.Authenticator{
+			auth.NewTicketAuthenticator(&appKeyStore{appID: appID, apps: s.apps}, authTimeout),
+		},
+		AnonymousAuth: a.AnonymousSignaling,
+		Authorizer:    anonymousAuthorizer{},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Connect a local client to the realm, directly through the underlying
+	// router. It is trusted and used to register the discovery procedures.
+	local, err := client.ConnectLocal(s.nxr, client.Config{
+		Realm:  appID,
+		Logger: s.logger,
+	})
+	if err != nil {
+		s.nxr.RemoveRealm(wamp.URI(appID))
+		return fmt.Errorf("error connecting local WAMP client: %s", err)
+	}
+
+	procs := &procedures{
+		repo: group.NewAppGroupRepository(s.repo, appID),
+	}
+
+	if err := procs.register(local); err != nil {
+		local.Close()
+		s.nxr.RemoveRealm(wamp.URI(appID))
+		return err
+	}
+
+	s.realms[appID] = local
+
+	s.logger.Debugf("Created realm %s", appID)
+
+	return nil
+}
+
+// realmRouter wraps a nexus router to create the realm requested by new clients
+// before they are attached.
+type realmRouter struct {
+	router.Router
+	ensureRealm func(realm string) error
+}
+
+// Attach connects a client to the router and to the requested realm.
+func (r *realmRouter) Attach(client wamp.Peer) error {
+	return r.AttachClient(client, nil)
+}
+
+// AttachClient reads the client's HELLO message to find the requested realm,
+// and creates that realm if it corresponds to a registered application. The
+// HELLO message is then replayed to the underlying router, which responds with
+// an ABORT message if the realm does not exist.
+func (r *realmRouter) AttachClient(client wamp.Peer, transportDetails wamp.Dict) error {
+	msg, err := wamp.RecvTimeout(client, helloTimeout)
+	if err != nil {
+		client.Close()
+		return fmt.Errorf("did not receive HELLO: %s", err)
+	}
+
+	if hello, ok := msg.(*wamp.Hello); ok {
+		if err := r.ensureRealm(string(hello.Realm)); err != nil {
+			r.Logger().Printf("Failed to create realm %q: %s", hello.Realm, err)
+		}
+	}
+
+	return r.Router.AttachClient(newHelloPeer(client, msg), transportDetails)
+}
+
+// helloPeer wraps a peer whose first message has already been consumed, and
+// replays that message before forwarding the rest.
+type helloPeer struct {
+	wamp.Peer
+	recv      chan wamp.Message
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newHelloPeer(peer wamp.Peer, hello wamp.Message) *helloPeer {
+	p := &helloPeer{
+		Peer: peer,
+		recv: make(chan wamp.Message, 1),
+		done: make(chan struct{}),
+	}
+
+	p.recv <- hello
+
+	go func() {
+		defer close(p.recv)
+		for msg := range peer.Recv() {
+			select {
+			case p.recv <- msg:
+			case <-p.done:
+				return
+			}
+		}
+	}()
+
+	return p
+}
+
+// Recv returns the channel of messages received from the peer
+func (p *helloPeer) Recv() <-chan wamp.Message {
+	return p.recv
+}
+
+// Close closes the underlying peer
+func (p *helloPeer) Close() {
+	p.closeOnce.Do(func() { close(p.done) })
+	p.Peer.Close()
+}
+
+// appKeyStore implements the nexus KeyStore interface for the ticket
+// authentication of clients in an application's realm. The only accepted authid
+// is the AppID, and the ticket is the application's current API key.
+type appKeyStore struct {
+	appID string
+	apps  app.AppRepository
+}
+
+// AuthKey returns the API key of the realm's application
+func (ks *appKeyStore) AuthKey(authid, authmethod string) ([]byte, error) {
+	if authid != ks.appID || authmethod != "ticket" {
+		return nil, fmt.Errorf("unknown authid %s", authid)
+	}
+
+	a, err := ks.apps.GetApp(ks.appID)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.Revoked || a.APIKey == "" {
+		return nil, fmt.Errorf("App %s is revoked", ks.appID)
+	}
+
+	return []byte(a.APIKey), nil
+}
+
+// PasswordInfo is not used by ticket authentication
+func (ks *appKeyStore) PasswordInfo(authid string) (string, int, int) {
+	return "", 0, 0
+}
+
+// AuthRole returns the role of authenticated application clients
+func (ks *appKeyStore) AuthRole(authid string) (string, error) {
+	return "app", nil
+}
+
+// Provider returns the name of the KeyStore
+func (ks *appKeyStore) Provider() string {
+	return "disco"
+}
+
+// procedures implements the discovery procedures on top of a GroupRepository
+type procedures struct {
+	repo group.GroupRepository
+}
+
+// register registers the discovery procedures with a WAMP client
+func (p *procedures) register(cli *client.Client) error {
+	procs := map[string]client.InvocationHandler{
+		ProcListGroups:  p.listGroups,
+		ProcGetGroup:    p.getGroup,
+		ProcCreateGroup: p.createGroup,
+		ProcUpdateGroup: p.updateGroup,
+		ProcDeleteGroup: p.deleteGroup,
+	}
+
+	for proc, handler := range procs {
+		if err := cli.Register(proc, handler, nil); err != nil {
+			return fmt.Errorf("error registering procedure %s: %s", proc, err)
+		}
+	}
+
+	return nil
+}
+
+// listGroups takes an optional AppID argument
+func (p *procedures) listGroups(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+	appID := ""
+	if len(inv.Arguments) > 0 {
+		var ok bool
+		appID, ok = wamp.AsString(inv.Arguments[0])
+		if !ok {
+			return errResult(ErrInvalidArgument, "AppID should be a string")
+		}
+	}
+
+	var groups map[string]*group.Group
+	var err error
+
+	if appID == "" {
+		groups, err = p.repo.GetAllGroups()
+	} else {
+		groups, err = p.repo.GetAllGroupsByAppID(appID)
+	}
+
+	if err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error getting groups: %v", err))
+	}
+
+	return jsonResult(groups)
+}
+
+// getGroup takes a group ID argument
+func (p *procedures) getGroup(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+	groupID, err := stringArg(inv)
+	if err != nil {
+		return errResult(ErrInvalidArgument, err.Error())
+	}
+
+	group, err := p.repo.GetGroup(groupID)
+	if err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error getting group %s: %v", groupID, err))
+	}
+
+	return jsonResult(group)
+}
+
+// createGroup takes a JSON-encoded group argument and returns the ID of the
+// new group
+func (p *procedures) createGroup(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+	newGroup, err := groupArg(inv)
+	if err != nil {
+		return errResult(ErrInvalidArgument, err.Error())
+	}
+
+	// Creating a group is unconditional
+	newGroup.Version = 0
+
+	id, err := p.repo.SetGroup(newGroup)
+	if err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error saving group: %v", err))
+	}
+
+	return client.InvokeResult{Args: wamp.List{id}}
+}
+
+// updateGroup takes a JSON-encoded group argument and returns the ID of the
+// updated group. If the group's Version is set, the update fails unless it
+// matches the current version.
+func (p *procedures) updateGroup(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+	updatedGroup, err := groupArg(inv)
+	if err != nil {
+		return errResult(ErrInvalidArgument, err.Error())
+	}
+
+	id, err := p.repo.SetGroup(updatedGroup)
+	if err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error setting group: %v", err))
+	}
+
+	return client.InvokeResult{Args: wamp.List{id}}
+}
+
+// deleteGroup takes a group ID argument
+func (p *procedures) deleteGroup(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+	groupID, err := stringArg(inv)
+	if err != nil {
+		return errResult(ErrInvalidArgument, err.Error())
+	}
+
+	if err := p.repo.DeleteGroup(groupID); err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error deleting group: %v", err))
+	}
+
+	return client.InvokeResult{Args: wamp.List{groupID}}
+}
+
+func stringArg(inv *wamp.Invocation) (string, error) {
+	if len(inv.Arguments) != 1 {
+		return "", fmt.Errorf("Invocation should contain 1 argument, not %d", len(inv.Arguments))
+	}
+
+	arg, ok := wamp.AsString(inv.Arguments[0])
+	if !ok {
+		return "", fmt.Errorf("Error reading invocation argument")
+	}
+
+	return arg, nil
+}
+
+func groupArg(inv *wamp.Invocation) (*group.Group, error) {
+	raw, err := stringArg(inv)
+	if err != nil {
+		return nil, err
+	}
+
+	var g group.Group
+	if err := json.Unmarshal([]byte(raw), &g); err != nil {
+		return nil, fmt.Errorf("Error parsing group: %v", err)
+	}
+
+	return &g, nil
+}
+
+func jsonResult(v interface{}) client.InvokeResult {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return errResult(ErrRepository, fmt.Sprintf("Error marshalling result: %v", err))
+	}
+
+	return client.InvokeResult{Args: wamp.List{string(raw)}}
+}
+
+func errResult(uri wamp.URI, msg string) client.InvokeResult {
+	return client.InvokeResult{
+		Err:  uri,
+		Args: wamp.List{msg},
+	}
+}
+
+// anonymousAuthorizer implements the nexus Authorizer interface. It prevents
+// anonymous clients from calling or registering the discovery procedures, so
+// that they can only relay signaling messages.
+type anonymousAuthorizer struct{}
+
+// Authorize returns false for the CALL and REGISTER messages of anonymous
+// clients on discovery procedures
+func (anonymousAuthorizer) Authorize(sess *wamp.Session, msg wamp.Message) (bool, error) {
+	if method, _ := wamp.AsString(sess.Details["authmethod"]); method != "anonymous" {
+		return true, nil
+	}
+
+	var procedure wamp.URI
+
+	switch m := msg.(type) {
+	case *wamp.Call:
+		procedure = m.Procedure
+	case *wamp.Register:
+		procedure = m.Procedure
+	default:
+		return true, nil
+	}
+
+	return !procedure.PrefixMatch("disco."), nil
+}
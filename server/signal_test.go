@@ -0,0 +1,327 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/gammazero/nexus/v3/client"
+	"github.com/gammazero/nexus/v3/transport"
+	"github.com/gammazero/nexus/v3/wamp"
+	"github.com/mosaicnetworks/babble/src/peers"
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/sirupsen/logrus"
+)
+
+func newTestSignalServer(t *testing.T, apps app.AppRepository) *SignalServer {
+	certs, err := newCertReloader("../test_data/cert.pem", "../test_data/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signalServer, err := NewSignalServer(
+		"localhost:0",
+		certs.tlsConfig(),
+		group.NewInmemGroupRepository(),
+		apps,
+		logrus.New().WithField("component", "signal-server"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signalServer
+}
+
+// connectSignalClient connects a client to the SignalServer's router through
+// an in-memory transport. Unlike client.ConnectLocal, the client is not
+// trusted by the router and must authenticate.
+func connectSignalClient(s *SignalServer, realm string, authID string, ticket string) (*client.Client, error) {
+	clientSide, routerSide := transport.LinkedPeers()
+
+	go s.router.Attach(routerSide)
+
+	return client.NewClient(clientSide, client.Config{
+		Realm: realm,
+		HelloDetails: wamp.Dict{
+			"authid": authID,
+		},
+		AuthHandlers: map[string]client.AuthFunc{
+			"ticket": func(c *wamp.Challenge) (string, wamp.Dict) {
+				return ticket, wamp.Dict{}
+			},
+		},
+		Logger: logrus.New().WithField("component", "signal-client"),
+	})
+}
+
+// connectAnonymousSignalClient connects a client which does not authenticate,
+// like a Babble node, to the SignalServer's router.
+func connectAnonymousSignalClient(s *SignalServer, realm string) (*client.Client, error) {
+	clientSide, routerSide := transport.LinkedPeers()
+
+	go s.router.Attach(routerSide)
+
+	return client.NewClient(clientSide, client.Config{
+		Realm:  realm,
+		Logger: logrus.New().WithField("component", "signal-client"),
+	})
+}
+
+// Test that clients can only join the realm of the application whose API key
+// they present.
+func TestSignalServerRealms(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	app1 := app.NewApp("TestApp1", "Test Application 1")
+	if _, err := apps.CreateApp(app1); err != nil {
+		t.Fatal(err)
+	}
+
+	app2 := app.NewApp("TestApp2", "Test Application 2")
+	if _, err := apps.CreateApp(app2); err != nil {
+		t.Fatal(err)
+	}
+
+	signalServer := newTestSignalServer(t, apps)
+	defer signalServer.Shutdown()
+
+	cli, err := connectSignalClient(signalServer, "TestApp1", "TestApp1", app1.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Close()
+
+	if _, err := connectSignalClient(signalServer, "TestApp1", "TestApp1", app2.APIKey); err == nil {
+		t.Fatalf("Joining TestApp1 realm with TestApp2 API key should fail")
+	}
+
+	if _, err := connectSignalClient(signalServer, "TestApp1", "TestApp2", app2.APIKey); err == nil {
+		t.Fatalf("Joining TestApp1 realm as TestApp2 should fail")
+	}
+
+	if _, err := connectSignalClient(signalServer, "UnknownApp", "UnknownApp", app1.APIKey); err == nil {
+		t.Fatalf("Joining the realm of an unregistered app should fail")
+	}
+
+	if _, err := connectAnonymousSignalClient(signalServer, "TestApp1"); err == nil {
+		t.Fatalf("Joining TestApp1 realm anonymously should fail")
+	}
+
+	if err := apps.RevokeApp("TestApp2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := connectSignalClient(signalServer, "TestApp2", "TestApp2", app2.APIKey); err == nil {
+		t.Fatalf("Joining the realm of a revoked app should fail")
+	}
+}
+
+// Test calling the discovery procedures through a client connected to the WAMP
+// router.
+func TestSignalServerProcedures(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	app1 := app.NewApp("TestApp1", "Test Application 1")
+	if _, err := apps.CreateApp(app1); err != nil {
+		t.Fatal(err)
+	}
+
+	signalServer := newTestSignalServer(t, apps)
+	defer signalServer.Shutdown()
+
+	cli, err := connectSignalClient(signalServer, "TestApp1", "TestApp1", app1.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	call := func(proc string, args ...interface{}) (*wamp.Result, error) {
+		return cli.Call(context.Background(), proc, nil, wamp.List(args), nil, nil)
+	}
+
+	// Create a group
+
+	group1 := group.NewGroup(
+		"",
+		"TestGroup1",
+		"TestApp1",
+		[]*peers.Peer{
+			peers.NewPeer("pub1", "net1", "peer1"),
+		},
+	)
+
+	raw, err := json.Marshal(group1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := call(ProcCreateGroup, string(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	groupID, ok := wamp.AsString(res.Arguments[0])
+	if !ok || groupID == "" {
+		t.Fatalf("CreateGroup should return a group ID, not %v", res.Arguments)
+	}
+
+	// Retrieve the group
+
+	res, err = call(ProcGetGroup, groupID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retrievedGroup group.Group
+	if err := json.Unmarshal([]byte(res.Arguments[0].(string)), &retrievedGroup); err != nil {
+		t.Fatal(err)
+	}
+
+	if retrievedGroup.Name != group1.Name {
+		t.Fatalf("group Name should be %s, not %s", group1.Name, retrievedGroup.Name)
+	}
+
+	// A stale Version is ignored when creating a group
+
+	staleGroup := group.NewGroup("", "StaleGroup", "TestApp1", nil)
+	staleGroup.Version = 7
+
+	raw, err = json.Marshal(staleGroup)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err = call(ProcCreateGroup, string(raw))
+	if err != nil {
+		t.Fatalf("Creating a group with a stale Version should succeed: %v", err)
+	}
+
+	staleID, _ := wamp.AsString(res.Arguments[0])
+
+	res, err = call(ProcGetGroup, staleID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var staleRetrieved group.Group
+	if err := json.Unmarshal([]byte(res.Arguments[0].(string)), &staleRetrieved); err != nil {
+		t.Fatal(err)
+	}
+
+	if staleRetrieved.Version != 1 {
+		t.Fatalf("Created group Version should be 1, not %d", staleRetrieved.Version)
+	}
+
+	if _, err := call(ProcDeleteGroup, staleID); err != nil {
+		t.Fatal(err)
+	}
+
+	// List groups
+
+	for _, appID := range []string{"", "TestApp1"} {
+		res, err = call(ProcListGroups, appID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var groups map[string]*group.Group
+		if err := json.Unmarshal([]byte(res.Arguments[0].(string)), &groups); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(groups) != 1 {
+			t.Fatalf("AppID %q should contain 1 group, not %d", appID, len(groups))
+		}
+	}
+
+	// Groups of other apps are out of reach
+
+	_, err = call(ProcListGroups, "TestApp2")
+	if rpcErr, ok := err.(client.RPCError); !ok || rpcErr.Err.Error != ErrRepository {
+		t.Fatalf("Listing groups of another app should return %s error, not %v", ErrRepository, err)
+	}
+
+	// Delete the group and check that it is gone
+
+	if _, err := call(ProcDeleteGroup, groupID); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = call(ProcGetGroup, groupID)
+	if rpcErr, ok := err.(client.RPCError); !ok || rpcErr.Err.Error != ErrRepository {
+		t.Fatalf("Getting deleted group should return %s error, not %v", ErrRepository, err)
+	}
+
+	// Invalid arguments
+
+	_, err = call(ProcCreateGroup, "not a group")
+	if rpcErr, ok := err.(client.RPCError); !ok || rpcErr.Err.Error != ErrInvalidArgument {
+		t.Fatalf("Creating invalid group should return %s error, not %v", ErrInvalidArgument, err)
+	}
+}
+
+// Test that anonymous clients can relay signaling messages in the realm of an
+// app which enables AnonymousSignaling, but can not call the discovery
+// procedures.
+func TestSignalServerAnonymous(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	app1 := app.NewApp("TestApp1", "Test Application 1")
+	app1.AnonymousSignaling = true
+	if _, err := apps.CreateApp(app1); err != nil {
+		t.Fatal(err)
+	}
+
+	signalServer := newTestSignalServer(t, apps)
+	defer signalServer.Shutdown()
+
+	anon1, err := connectAnonymousSignalClient(signalServer, "TestApp1")
+	if err != nil {
+		t.Fatalf("Joining TestApp1 realm anonymously should succeed: %v", err)
+	}
+	defer anon1.Close()
+
+	anon2, err := connectAnonymousSignalClient(signalServer, "TestApp1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer anon2.Close()
+
+	// Relay a message between anonymous clients
+
+	received := make(chan string, 1)
+
+	err = anon1.Register("babble.signal", func(ctx context.Context, inv *wamp.Invocation) client.InvokeResult {
+		msg, _ := wamp.AsString(inv.Arguments[0])
+		received <- msg
+		return client.InvokeResult{}
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := anon2.Call(context.Background(), "babble.signal", nil, wamp.List{"offer"}, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := <-received; msg != "offer" {
+		t.Fatalf("Relayed message should be offer, not %s", msg)
+	}
+
+	// The discovery procedures are reserved to authenticated clients
+
+	if _, err := anon1.Call(context.Background(), ProcListGroups, nil, wamp.List{""}, nil, nil); err == nil {
+		t.Fatalf("Anonymous clients should not call the discovery procedures")
+	}
+
+	authenticated, err := connectSignalClient(signalServer, "TestApp1", "TestApp1", app1.APIKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer authenticated.Close()
+
+	if _, err := authenticated.Call(context.Background(), ProcListGroups, nil, wamp.List{""}, nil, nil); err != nil {
+		t.Fatalf("Authenticated clients should call the discovery procedures: %v", err)
+	}
+}
@@ -0,0 +1,439 @@
+package server
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/mosaicnetworks/disco/ice"
+	"github.com/pion/logging"
+	"github.com/pion/turn/v2"
+)
+
+// TURNConfig configures the TURN server.
+type TURNConfig struct {
+	// Address is the public address (host:port) of the TURN server. It is used
+	// as the relay address, and advertised to clients. The host must be an IPv4
+	// or IPv6 literal, and the port is the UDP port.
+	Address string
+
+	// AddressV6 is an optional public IPv6 address of the TURN server, which is
+	// advertised in addition to an IPv4 Address, with the same ports.
+	AddressV6 string
+
+	// TCPPort and TLSPort are the ports of the TCP and TLS listeners of the
+	// TURN server. The corresponding listener is disabled if the port is empty.
+	// The TLS listener uses the same certificate as the discovery API.
+	TCPPort string
+	TLSPort string
+
+	// Interface is the name of the network interface the listeners and relays
+	// of the TURN server are bound to. They are bound to every interface if
+	// Interface is empty.
+	Interface string
+
+	// RelayMinPort and RelayMaxPort restrict the ports of the relays allocated
+	// by the TURN server to an inclusive range. Relays are allocated on any
+	// port if they are 0.
+	RelayMinPort int
+	RelayMaxPort int
+
+	// MaxAllocations and MaxUserAllocations limit the number of concurrent
+	// relay allocations, in total and per user. The user of ephemeral
+	// credentials is the one they were issued to. There is no limit if they
+	// are 0.
+	MaxAllocations     int
+	MaxUserAllocations int
+
+	// AllocationBandwidth caps the traffic of every allocation, in bytes per
+	// second in both directions combined. There is no cap if it is 0. It must
+	// be at least minAllocationBandwidth, because bursts are limited to one
+	// second of traffic, and larger packets would always be dropped.
+	AllocationBandwidth int64
+
+	// UserQuota is the total number of bytes a user can relay. Once it is
+	// reached, the relays of the user drop traffic and new allocations are
+	// refused. There is no quota if it is 0.
+	UserQuota int64
+
+	// UsageFile is the path of a JSON file where the usage of every user is
+	// saved at every UsageInterval and on Close, and restored from on startup.
+	// Usage is not persisted if UsageFile is empty.
+	UsageFile     string
+	UsageInterval time.Duration
+
+	// STUNOnly disables relaying. The server still answers STUN binding
+	// requests on every listener, but refuses all allocations.
+	STUNOnly bool
+
+	// Realm is the administrative domain of the TURN server.
+	Realm string
+
+	// Username and Password are the credentials of a static user allowed to
+	// use the TURN server. There is no static user if Username is empty.
+	Username string
+	Password string
+
+	// UsersFile is the path of a JSON file defining additional users allowed to
+	// use the TURN server. It is reloaded when the process receives a SIGHUP.
+	// There are no additional users if UsersFile is empty.
+	UsersFile string
+
+	// Secret is the shared secret used to sign ephemeral credentials, following
+	// the TURN REST API scheme. Ephemeral credentials are disabled if Secret is
+	// empty.
+	Secret string
+
+	// CredentialsTTL is the lifetime of ephemeral credentials.
+	CredentialsTTL time.Duration
+}
+
+// TURNCredentials are time-limited credentials for the TURN server. They are
+// returned by the /turn/credentials endpoint of the discovery API, in the
+// format defined by the TURN REST API.
+type TURNCredentials struct {
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	TTL      int64    `json:"ttl"`
+	URIs     []string `json:"uris"`
+}
+
+// publicIPs parses the public addresses of the TURN server. It returns the
+// public IPs, and the UDP port.
+func (c TURNConfig) publicIPs() ([]net.IP, string, error) {
+	host, port, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid ICE address format: %v", err)
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, "", fmt.Errorf("Invalid ICE address IP: %s", host)
+	}
+
+	ips := []net.IP{ip}
+
+	if c.AddressV6 != "" {
+		ip6 := net.ParseIP(c.AddressV6)
+		if ip6 == nil || ip6.To4() != nil {
+			return nil, "", fmt.Errorf("Invalid ICE IPv6 address: %s", c.AddressV6)
+		}
+
+		if ip.To4() == nil {
+			return nil, "", fmt.Errorf("ICE IPv6 address requires an IPv4 primary address")
+		}
+
+		ips = append(ips, ip6)
+	}
+
+	return ips, port, nil
+}
+
+// validate checks the configuration of relay ports and allocation limits.
+// Every allocation uses a relay port, so the port range must be large enough
+// for the allocation limits.
+func (c TURNConfig) validate() error {
+	if c.MaxAllocations < 0 || c.MaxUserAllocations < 0 || c.AllocationBandwidth < 0 || c.UserQuota < 0 {
+		return fmt.Errorf("ICE allocation limits can not be negative")
+	}
+
+	if c.AllocationBandwidth > 0 && c.AllocationBandwidth < minAllocationBandwidth {
+		return fmt.Errorf("ICE allocation bandwidth %d is below the minimum of %d bytes per second", c.AllocationBandwidth, minAllocationBandwidth)
+	}
+
+	if c.MaxAllocations > 0 && c.MaxUserAllocations > c.MaxAllocations {
+		return fmt.Errorf("ICE user allocation limit %d exceeds allocation limit %d", c.MaxUserAllocations, c.MaxAllocations)
+	}
+
+	if c.RelayMinPort == 0 && c.RelayMaxPort == 0 {
+		return nil
+	}
+
+	if c.RelayMinPort <= 0 || c.RelayMaxPort > 65535 || c.RelayMinPort > c.RelayMaxPort {
+		return fmt.Errorf("Invalid ICE relay port range %d-%d", c.RelayMinPort, c.RelayMaxPort)
+	}
+
+	ports := c.RelayMaxPort - c.RelayMinPort + 1
+
+	if c.MaxAllocations > ports || c.MaxUserAllocations > ports {
+		return fmt.Errorf("ICE relay port range %d-%d is too small for the allocation limits", c.RelayMinPort, c.RelayMaxPort)
+	}
+
+	return nil
+}
+
+// bindIPs returns the local IPs of Interface, indexed by address family ("4"
+// or "6"). It returns an empty map if Interface is empty.
+func (c TURNConfig) bindIPs() (map[string]net.IP, error) {
+	ips := make(map[string]net.IP)
+
+	if c.Interface == "" {
+		return ips, nil
+	}
+
+	iface, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid ICE interface: %v", err)
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get addresses of ICE interface %s: %v", c.Interface, err)
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		family := "6"
+		if ipNet.IP.To4() != nil {
+			family = "4"
+		}
+
+		if _, ok := ips[family]; !ok {
+			ips[family] = ipNet.IP
+		}
+	}
+
+	return ips, nil
+}
+
+// URIs returns the TURN URIs advertised to clients, for every public address
+// and every transport enabled in the configuration. In STUN-only mode, it
+// returns the STUN URIs instead.
+func (c TURNConfig) URIs() []string {
+	if c.STUNOnly {
+		return c.stunURIs()
+	}
+	return c.turnURIs()
+}
+
+// stunURIs returns the STUN URIs of every public address
+func (c TURNConfig) stunURIs() []string {
+	ips, port, err := c.publicIPs()
+	if err != nil {
+		return nil
+	}
+
+	uris := []string{}
+
+	for _, ip := range ips {
+		uris = append(uris, fmt.Sprintf("stun:%s", net.JoinHostPort(ip.String(), port)))
+	}
+
+	return uris
+}
+
+// turnURIs returns the TURN URIs of every public address, for every transport
+// enabled in the configuration
+func (c TURNConfig) turnURIs() []string {
+	ips, port, err := c.publicIPs()
+	if err != nil {
+		return nil
+	}
+
+	uris := []string{}
+
+	for _, ip := range ips {
+		host := ip.String()
+
+		uris = append(uris, fmt.Sprintf("turn:%s?transport=udp", net.JoinHostPort(host, port)))
+
+		if c.TCPPort != "" {
+			uris = append(uris, fmt.Sprintf("turn:%s?transport=tcp", net.JoinHostPort(host, c.TCPPort)))
+		}
+
+		if c.TLSPort != "" {
+			uris = append(uris, fmt.Sprintf("turns:%s?transport=tcp", net.JoinHostPort(host, c.TLSPort)))
+		}
+	}
+
+	return uris
+}
+
+// createAndStartTURNServer configures and runs the TURN server. It always
+// listens on UDP, and optionally on TCP and TLS if the corresponding ports are
+// configured. tlsConfig is only used by the TLS listener. There is a set of
+// listeners for every public address. Clients connecting to the IPv6 listeners
+// are allocated IPv6 relays. If an interface is configured, every listener and
+// relay is bound to the address of that interface in the same address family.
+// All listeners and relays are wrapped by quotas, which enforces the allocation
+// limits.
+func createAndStartTURNServer(config TURNConfig, authHandler turn.AuthHandler, quotas *turnQuotas, tlsConfig *tls.Config) (*turn.Server, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
+	publicIPs, icePort, err := config.publicIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	bindIPs, err := config.bindIPs()
+	if err != nil {
+		return nil, err
+	}
+
+	packetConnConfigs := []turn.PacketConnConfig{}
+	listenerConfigs := []turn.ListenerConfig{}
+
+	// closeAll closes the listeners created so far when an error occurs
+	closeAll := func() {
+		for _, p := range packetConnConfigs {
+			p.PacketConn.Close()
+		}
+		for _, l := range listenerConfigs {
+			l.Listener.Close()
+		}
+	}
+
+	for _, ip := range publicIPs {
+		family := "6"
+		if ip.To4() != nil {
+			family = "4"
+		}
+
+		bindIP, ok := bindIPs[family]
+		if config.Interface != "" && !ok {
+			closeAll()
+			return nil, fmt.Errorf("ICE interface %s has no IPv%s address", config.Interface, family)
+		}
+
+		// Claim that we are listening on the public IP passed by the user, but
+		// actually be listening on the configured interface, or on every
+		// interface of the same address family
+		relayAddressGenerator := newRelayAddressGenerator(ip,
+			bindIP,
+			config.RelayMinPort,
+			config.RelayMaxPort,
+			quotas)
+
+		bindAddr := func(port string) string {
+			return net.JoinHostPort(relayAddressGenerator.bindAddr, port)
+		}
+
+		// Create a UDP listener to pass into pion/turn
+		udpListener, err := net.ListenPacket("udp"+family, bindAddr(icePort))
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("Failed to create TURN server listener: %w", err)
+		}
+
+		packetConnConfigs = append(packetConnConfigs, turn.PacketConnConfig{
+			PacketConn:            quotas.wrapPacketConn(udpListener),
+			RelayAddressGenerator: relayAddressGenerator,
+		})
+
+		// TCP and TLS listeners. Relays are still allocated over UDP.
+
+		if config.TCPPort != "" {
+			tcpListener, err := net.Listen("tcp"+family, bindAddr(config.TCPPort))
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("Failed to create TURN server TCP listener: %w", err)
+			}
+
+			listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+				Listener:              quotas.wrapListener(tcpListener),
+				RelayAddressGenerator: relayAddressGenerator,
+			})
+		}
+
+		if config.TLSPort != "" {
+			tlsListener, err := tls.Listen("tcp"+family, bindAddr(config.TLSPort), tlsConfig)
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("Failed to create TURN server TLS listener: %w", err)
+			}
+
+			listenerConfigs = append(listenerConfigs, turn.ListenerConfig{
+				Listener:              quotas.wrapListener(tlsListener),
+				RelayAddressGenerator: relayAddressGenerator,
+			})
+		}
+	}
+
+	// Override the default log level
+	logFactory := logging.NewDefaultLoggerFactory()
+	logFactory.DefaultLogLevel = logging.LogLevelInfo
+
+	s, err := turn.NewServer(turn.ServerConfig{
+		Realm: config.Realm,
+		// Set AuthHandler callback
+		// This is called everytime a user tries to authenticate with the TURN
+		// server. Return the key for that user, or false when no user is found
+		AuthHandler: authHandler,
+		// PacketConnConfigs is a list of UDP Listeners and the configuration
+		// around them
+		PacketConnConfigs: packetConnConfigs,
+		// ListenerConfigs is a list of TCP and TLS listeners
+		ListenerConfigs: listenerConfigs,
+		LoggerFactory:   logFactory,
+	})
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("Fail to create TURN server: %s", err)
+	}
+
+	return s, nil
+}
+
+// getTURNCredentials returns ephemeral TURN credentials for the authenticated
+// application. In STUN-only mode, it only returns the STUN URIs, as no
+// credentials are needed.
+func (s *DiscoServer) getTURNCredentials(w http.ResponseWriter, r *http.Request) {
+	if s.turn.STUNOnly {
+		json.NewEncoder(w).Encode(TURNCredentials{
+			URIs: s.turn.URIs(),
+		})
+		return
+	}
+
+	if s.turn.Secret == "" {
+		http.Error(w, "Ephemeral TURN credentials are disabled", http.StatusNotFound)
+		return
+	}
+
+	username, password := generateTURNCredentials(
+		s.turn.Secret,
+		requestApp(r).ID,
+		s.turn.CredentialsTTL)
+
+	json.NewEncoder(w).Encode(TURNCredentials{
+		Username: username,
+		Password: password,
+		TTL:      int64(s.turn.CredentialsTTL.Seconds()),
+		URIs:     s.turn.URIs(),
+	})
+}
+
+// getICEServers returns the ICE servers that the authenticated application
+// should use, in the format of the WebRTC iceServers configuration. The STUN
+// server is always included. The TURN server is included, unless in STUN-only
+// mode, with ephemeral credentials if they are enabled, or with the static
+// user's credentials otherwise.
+func (s *DiscoServer) getICEServers(w http.ResponseWriter, r *http.Request) {
+	servers := []*ice.ICEServer{
+		ice.NewICEServer(s.turn.stunURIs(), "", ""),
+	}
+
+	username, password := s.turn.Username, s.turn.Password
+
+	if s.turn.Secret != "" {
+		username, password = generateTURNCredentials(
+			s.turn.Secret,
+			requestApp(r).ID,
+			s.turn.CredentialsTTL)
+	}
+
+	if !s.turn.STUNOnly && username != "" {
+		servers = append(servers, ice.NewICEServer(s.turn.turnURIs(), username, password))
+	}
+
+	json.NewEncoder(w).Encode(servers)
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/pion/turn/v2"
+)
+
+// TURNUser defines a user in the TURN users file. The user is authenticated
+// either with a Password, or with a precomputed Key, which is the hex-encoded
+// MD5 hash of "Username:Realm:Password". The TURN server challenges every
+// client with its own realm, so Realm, if set, must be the realm of the TURN
+// server. If AppID is set, the user is scoped to that application.
+type TURNUser struct {
+	Username string
+	Realm    string
+	AppID    string
+	Password string
+	Key      string
+}
+
+// turnUser is an authorised user of the TURN server
+type turnUser struct {
+	appID string // empty unless the user is scoped to an application
+	key   []byte
+}
+
+// turnAuthenticator implements the AuthHandler of the TURN server. It accepts
+// the static user, the users defined in the users file, and ephemeral
+// credentials signed with the shared secret. It is thread safe.
+//
+// pion challenges every client with the realm of the TURN server, so all the
+// credentials belong to that single realm. Credentials can however be scoped
+// to an application: ephemeral credentials issued to it, and users of the users
+// file with its AppID. They are only accepted while the application is
+// registered and not revoked, so revoking an application invalidates all its
+// TURN credentials. Ephemeral credentials are accounted for under their AppID,
+// so credentials leaked from one application can not be used against the relay
+// budget of another.
+type turnAuthenticator struct {
+	sync.RWMutex
+	config TURNConfig
+	apps   app.AppRepository
+	users  map[string]turnUser // [username] => user
+}
+
+// newTURNAuthenticator instantiates a turnAuthenticator and loads the users
+// file, if any. If apps is nil, credentials are not checked against registered
+// applications.
+func newTURNAuthenticator(config TURNConfig, apps app.AppRepository) (*turnAuthenticator, error) {
+	ta := &turnAuthenticator{
+		config: config,
+		apps:   apps,
+	}
+
+	if err := ta.reload(); err != nil {
+		return nil, err
+	}
+
+	return ta, nil
+}
+
+// reload rebuilds the map of authorised users from the static user and the
+// users file. If the users file can not be loaded, the current users are left
+// untouched.
+func (ta *turnAuthenticator) reload() error {
+	users := make(map[string]turnUser)
+
+	// Add the single user defined by Username and Password.
+	if ta.config.Username != "" {
+		users[ta.config.Username] = turnUser{
+			key: turn.GenerateAuthKey(ta.config.Username, ta.config.Realm, ta.config.Password),
+		}
+	}
+
+	if ta.config.UsersFile != "" {
+		fileUsers, err := loadTURNUsers(ta.config.UsersFile, ta.config.Realm)
+		if err != nil {
+			return err
+		}
+
+		for username, u := range fileUsers {
+			users[username] = u
+		}
+	}
+
+	ta.Lock()
+	defer ta.Unlock()
+
+	ta.users = users
+
+	return nil
+}
+
+// authenticate is called everytime a user tries to authenticate with the TURN
+// server. It returns the key for that user, or false when no user is found.
+func (ta *turnAuthenticator) authenticate(username string, realm string, srcAddr net.Addr) ([]byte, bool) {
+	if realm != ta.config.Realm {
+		return nil, false
+	}
+
+	ta.RLock()
+	u, ok := ta.users[username]
+	ta.RUnlock()
+
+	if ok {
+		if u.appID != "" && !ta.appAllowed(u.appID) {
+			return nil, false
+		}
+
+		return u.key, true
+	}
+
+	if ta.config.Secret == "" {
+		return nil, false
+	}
+
+	// Ephemeral usernames are formatted as "timestamp:user", where timestamp is
+	// the expiry time of the credentials.
+	split := strings.SplitN(username, ":", 2)
+	if len(split) != 2 {
+		return nil, false
+	}
+
+	expiry, err := strconv.ParseInt(split[0], 10, 64)
+	if err != nil || expiry < time.Now().Unix() {
+		return nil, false
+	}
+
+	// Ephemeral credentials are issued to applications
+	if !ta.appAllowed(split[1]) {
+		return nil, false
+	}
+
+	password := ephemeralPassword(ta.config.Secret, username)
+
+	return turn.GenerateAuthKey(username, realm, password), true
+}
+
+// userAppID returns the AppID a user of the users file is scoped to, or an
+// empty string if the user is not scoped or not found
+func (ta *turnAuthenticator) userAppID(username string) string {
+	ta.RLock()
+	defer ta.RUnlock()
+
+	return ta.users[username].appID
+}
+
+// appAllowed reports whether credentials scoped to an application are
+// accepted, which is when the application is registered and not revoked. All
+// applications are allowed if there is no AppRepository.
+func (ta *turnAuthenticator) appAllowed(appID string) bool {
+	if ta.apps == nil {
+		return true
+	}
+
+	a, err := ta.apps.GetApp(appID)
+	if err != nil {
+		return false
+	}
+
+	return !a.Revoked
+}
+
+// turnAccount returns the account a TURN username belongs to, which is the user
+// of ephemeral credentials ("timestamp:user"), or the username itself. It also
+// reports whether the username is ephemeral.
+func turnAccount(username string) (string, bool) {
+	split := strings.SplitN(username, ":", 2)
+	if len(split) != 2 {
+		return username, false
+	}
+
+	if _, err := strconv.ParseInt(split[0], 10, 64); err != nil {
+		return username, false
+	}
+
+	return split[1], true
+}
+
+// loadTURNUsers reads a JSON file containing a list of TURNUsers, whose keys are
+// computed in realm
+func loadTURNUsers(path string, realm string) (map[string]turnUser, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading TURN users file: %v", err)
+	}
+
+	var fileUsers []TURNUser
+	if err := json.Unmarshal(raw, &fileUsers); err != nil {
+		return nil, fmt.Errorf("Error parsing TURN users file: %v", err)
+	}
+
+	users := make(map[string]turnUser, len(fileUsers))
+
+	for i, fu := range fileUsers {
+		if fu.Username == "" {
+			return nil, fmt.Errorf("TURN user %d has no Username", i)
+		}
+
+		if _, ok := users[fu.Username]; ok {
+			return nil, fmt.Errorf("TURN user %s is defined more than once", fu.Username)
+		}
+
+		if fu.Realm != "" && fu.Realm != realm {
+			return nil, fmt.Errorf("TURN user %s has Realm %s, but the TURN server only authenticates users in realm %s", fu.Username, fu.Realm, realm)
+		}
+
+		var key []byte
+
+		switch {
+		case fu.Key != "" && fu.Password != "":
+			return nil, fmt.Errorf("TURN user %s has both a Password and a Key", fu.Username)
+		case fu.Key != "":
+			key, err = hex.DecodeString(fu.Key)
+			if err != nil || len(key) != 16 {
+				return nil, fmt.Errorf("TURN user %s has an invalid Key", fu.Username)
+			}
+		case fu.Password != "":
+			key = turn.GenerateAuthKey(fu.Username, realm, fu.Password)
+		default:
+			return nil, fmt.Errorf("TURN user %s has no Password or Key", fu.Username)
+		}
+
+		users[fu.Username] = turnUser{
+			appID: fu.AppID,
+			key:   key,
+		}
+	}
+
+	return users, nil
+}
+
+// generateTURNCredentials creates ephemeral credentials for user, following
+// the TURN REST API scheme: the username is "timestamp:user", where timestamp
+// is the expiry time, and the password is the base64-encoded HMAC-SHA1 of the
+// username keyed with the shared secret.
+func generateTURNCredentials(secret string, user string, ttl time.Duration) (string, string) {
+	expiry := time.Now().Add(ttl).Unix()
+	username := fmt.Sprintf("%d:%s", expiry, user)
+	return username, ephemeralPassword(secret, username)
+}
+
+// ephemeralPassword computes the password of an ephemeral username
+func ephemeralPassword(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
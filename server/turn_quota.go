@@ -0,0 +1,534 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/stun"
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Reasons for rejecting an allocation
+const (
+	rejectAllocationLimit     = "allocation_limit"
+	rejectUserAllocationLimit = "user_allocation_limit"
+	rejectUserQuota           = "user_quota"
+	rejectSTUNOnly            = "stun_only"
+)
+
+// pendingTTL is how long the account of an Allocate request is remembered
+// while waiting for the response of the TURN server
+const pendingTTL = 30 * time.Second
+
+// minAllocationBandwidth is the smallest AllocationBandwidth, so that the one
+// second bursts of a rateLimiter fit packets up to the Ethernet MTU
+const minAllocationBandwidth = 1500
+
+var (
+	allocateRequest         = stun.NewType(stun.MethodAllocate, stun.ClassRequest)
+	allocateSuccessResponse = stun.NewType(stun.MethodAllocate, stun.ClassSuccessResponse)
+	allocateErrorResponse   = stun.NewType(stun.MethodAllocate, stun.ClassErrorResponse)
+)
+
+// turnQuotas enforces the allocation limits, bandwidth caps and bytes quotas
+// of the TURN server, and records the usage of every account. In STUN-only
+// mode, it refuses every allocation. pion does not expose the user behind an allocation, so
+// turnQuotas wraps the connections of the TURN server: it inspects Allocate
+// requests to reject users over their limits, and Allocate responses to map
+// relays to users. The global allocation limit is enforced by the relay
+// address generators, in which case the TURN server responds with a 508
+// (Insufficient Capacity) error. It is thread safe.
+type turnQuotas struct {
+	sync.Mutex
+	config   TURNConfig
+	relays   map[string]*quotaRelayConn   // [relay address] => relay
+	accounts map[string]*TURNUsage        // [account] => usage
+	pending  map[string]pendingAllocation // [client address + transaction ID] => allocation
+	rejected map[string]uint64            // [reason] => count
+	logger   *logrus.Entry
+
+	// userAppID returns the AppID a user of the users file is scoped to. It is
+	// set before the TURN server starts, and ignored if nil.
+	userAppID func(username string) string
+}
+
+// pendingAllocation is an Allocate request waiting for a response
+type pendingAllocation struct {
+	account string
+	appID   string // AppID the account is scoped to, if any
+	created time.Time
+}
+
+// newTURNQuotas instantiates a turnQuotas enforcing the limits of config
+func newTURNQuotas(config TURNConfig, logger *logrus.Entry) *turnQuotas {
+	return &turnQuotas{
+		config:   config,
+		relays:   make(map[string]*quotaRelayConn),
+		accounts: make(map[string]*TURNUsage),
+		pending:  make(map[string]pendingAllocation),
+		rejected: make(map[string]uint64),
+		logger:   logger,
+	}
+}
+
+// rejections returns the number of rejected allocations, indexed by reason
+func (q *turnQuotas) rejections() map[string]uint64 {
+	q.Lock()
+	defer q.Unlock()
+
+	res := make(map[string]uint64, len(q.rejected))
+	for reason, count := range q.rejected {
+		res[reason] = count
+	}
+
+	return res
+}
+
+// reject logs and counts a rejected allocation. The caller must hold the lock.
+func (q *turnQuotas) reject(reason string, account string) {
+	q.rejected[reason]++
+
+	q.logger.WithFields(logrus.Fields{
+		"reason":   reason,
+		"account":  account,
+		"rejected": q.rejected[reason],
+	}).Warn("TURN allocation rejected")
+}
+
+// account returns the usage of an account, creating it if necessary. The
+// caller must hold the lock.
+func (q *turnQuotas) account(account string) *TURNUsage {
+	usage, ok := q.accounts[account]
+	if !ok {
+		usage = &TURNUsage{Username: account}
+		q.accounts[account] = usage
+	}
+	return usage
+}
+
+// checkAllocateRequest is called for every Allocate request before it reaches
+// the TURN server. It returns false if the user is over its limits. Otherwise,
+// it remembers the account of the request, so that the relay can be assigned
+// to it when the TURN server responds.
+func (q *turnQuotas) checkAllocateRequest(m *stun.Message, srcAddr net.Addr) bool {
+	var username stun.Username
+	if err := username.GetFrom(m); err != nil {
+		// Unauthenticated request, which will be challenged by the TURN server
+		return true
+	}
+
+	account, ephemeral := turnAccount(username.String())
+
+	// Ephemeral credentials are issued to applications, and users of the users
+	// file can be scoped to one
+	var appID string
+	switch {
+	case ephemeral:
+		appID = account
+	case q.userAppID != nil:
+		appID = q.userAppID(account)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	// The USERNAME of the request is not verified yet, so the account is only
+	// looked up. It is created when the TURN server accepts an allocation.
+	if usage, ok := q.accounts[account]; ok {
+		if q.config.MaxUserAllocations > 0 && usage.ActiveAllocations >= q.config.MaxUserAllocations {
+			q.reject(rejectUserAllocationLimit, account)
+			return false
+		}
+
+		if q.config.UserQuota > 0 && usage.bytes() >= q.config.UserQuota {
+			q.reject(rejectUserQuota, account)
+			return false
+		}
+	}
+
+	now := time.Now()
+	for key, p := range q.pending {
+		if now.Sub(p.created) > pendingTTL {
+			delete(q.pending, key)
+		}
+	}
+
+	q.pending[pendingKey(srcAddr, m.TransactionID)] = pendingAllocation{
+		account: account,
+		appID:   appID,
+		created: now,
+	}
+
+	return true
+}
+
+// handleAllocateResponse is called for every Allocate response sent by the
+// TURN server. It assigns the relay of a successful allocation to the account
+// of the request, which is created if necessary, because the TURN server has
+// authenticated it.
+func (q *turnQuotas) handleAllocateResponse(m *stun.Message, dstAddr net.Addr) {
+	q.Lock()
+	defer q.Unlock()
+
+	key := pendingKey(dstAddr, m.TransactionID)
+
+	pending, ok := q.pending[key]
+	if !ok {
+		return
+	}
+	delete(q.pending, key)
+
+	if m.Type != allocateSuccessResponse {
+		return
+	}
+
+	var relayedAddr stun.XORMappedAddress
+	if err := relayedAddr.GetFromAs(m, stun.AttrXORRelayedAddress); err != nil {
+		return
+	}
+
+	relay, ok := q.relays[(&net.UDPAddr{IP: relayedAddr.IP, Port: relayedAddr.Port}).String()]
+	if !ok || relay.account != "" {
+		return
+	}
+
+	relay.account = pending.account
+	relay.assigned = time.Now()
+
+	usage := q.account(pending.account)
+	usage.AppID = pending.appID
+	usage.Allocations++
+	usage.ActiveAllocations++
+}
+
+// addRelay registers a new relay, unless the global allocation limit is
+// reached.
+func (q *turnQuotas) addRelay(conn net.PacketConn, relayAddr net.Addr) (*quotaRelayConn, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.config.MaxAllocations > 0 && len(q.relays) >= q.config.MaxAllocations {
+		q.reject(rejectAllocationLimit, "")
+		return nil, fmt.Errorf("Allocation limit reached")
+	}
+
+	relay := &quotaRelayConn{
+		PacketConn: conn,
+		quotas:     q,
+		address:    relayAddr.String(),
+	}
+
+	if q.config.AllocationBandwidth > 0 {
+		relay.limiter = newRateLimiter(q.config.AllocationBandwidth)
+	}
+
+	q.relays[relay.address] = relay
+
+	return relay, nil
+}
+
+// removeRelay unregisters a closed relay
+func (q *turnQuotas) removeRelay(relay *quotaRelayConn) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.relays[relay.address] != relay {
+		return
+	}
+	delete(q.relays, relay.address)
+
+	if relay.account != "" {
+		usage := q.account(relay.account)
+		usage.ActiveAllocations--
+		usage.Duration += seconds(time.Since(relay.assigned))
+	}
+}
+
+// consume records n bytes relayed for an account, sent to its peers or
+// received from them. It returns false, and does not record anything, if the
+// account is over its quota.
+func (q *turnQuotas) consume(account string, n int, sent bool) bool {
+	q.Lock()
+	defer q.Unlock()
+
+	usage := q.account(account)
+
+	if q.config.UserQuota > 0 && usage.bytes() >= q.config.UserQuota {
+		return false
+	}
+
+	if sent {
+		usage.BytesSent += int64(n)
+	} else {
+		usage.BytesReceived += int64(n)
+	}
+
+	return true
+}
+
+// inbound inspects a message received by the TURN server. It returns false if
+// the message is an Allocate request from a user over its limits, in which
+// case the request has already been rejected with a 486 (Allocation Quota
+// Reached) error, sent with reply. In STUN-only mode, Allocate requests are
+// always rejected with a 403 (Forbidden) error.
+func (q *turnQuotas) inbound(p []byte, srcAddr net.Addr, reply func([]byte) error) bool {
+	if !isMessageType(p, allocateRequest) {
+		return true
+	}
+
+	m := &stun.Message{Raw: append([]byte{}, p...)}
+	if err := m.Decode(); err != nil {
+		return true
+	}
+
+	code := stun.CodeAllocQuotaReached
+
+	if q.config.STUNOnly {
+		q.Lock()
+		q.reject(rejectSTUNOnly, "")
+		q.Unlock()
+
+		code = stun.CodeForbidden
+	} else if q.checkAllocateRequest(m, srcAddr) {
+		return true
+	}
+
+	res, err := stun.Build(
+		stun.NewTransactionIDSetter(m.TransactionID),
+		allocateErrorResponse,
+		code)
+	if err == nil {
+		reply(res.Raw)
+	}
+
+	return false
+}
+
+// outbound inspects a message sent by the TURN server
+func (q *turnQuotas) outbound(p []byte, dstAddr net.Addr) {
+	if !isMessageType(p, allocateSuccessResponse) && !isMessageType(p, allocateErrorResponse) {
+		return
+	}
+
+	m := &stun.Message{Raw: append([]byte{}, p...)}
+	if err := m.Decode(); err != nil {
+		return
+	}
+
+	q.handleAllocateResponse(m, dstAddr)
+}
+
+// wrapPacketConn wraps a UDP listener of the TURN server
+func (q *turnQuotas) wrapPacketConn(conn net.PacketConn) net.PacketConn {
+	return &quotaPacketConn{
+		PacketConn: conn,
+		quotas:     q,
+	}
+}
+
+// wrapListener wraps a TCP or TLS listener of the TURN server
+func (q *turnQuotas) wrapListener(listener net.Listener) net.Listener {
+	return &quotaListener{
+		Listener: listener,
+		quotas:   q,
+	}
+}
+
+// quotaPacketConn is a UDP listener of the TURN server, whose messages are
+// inspected by turnQuotas
+type quotaPacketConn struct {
+	net.PacketConn
+	quotas *turnQuotas
+}
+
+// ReadFrom reads the next message which is not rejected by turnQuotas
+func (c *quotaPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil {
+			return n, addr, err
+		}
+
+		reply := func(res []byte) error {
+			_, err := c.PacketConn.WriteTo(res, addr)
+			return err
+		}
+
+		if c.quotas.inbound(p[:n], addr, reply) {
+			return n, addr, nil
+		}
+	}
+}
+
+// WriteTo writes a message after passing it to turnQuotas
+func (c *quotaPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.quotas.outbound(p, addr)
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// quotaListener is a TCP or TLS listener of the TURN server, whose connections
+// are inspected by turnQuotas
+type quotaListener struct {
+	net.Listener
+	quotas *turnQuotas
+}
+
+// Accept waits for the next connection and wraps it
+func (l *quotaListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &quotaConn{
+		Conn:   conn,
+		frames: turn.NewSTUNConn(conn),
+		quotas: l.quotas,
+	}, nil
+}
+
+// quotaConn is a TCP or TLS connection to the TURN server. Reads return one
+// STUN or ChannelData frame at a time, so that messages can be inspected by
+// turnQuotas.
+type quotaConn struct {
+	net.Conn
+	frames *turn.STUNConn
+	quotas *turnQuotas
+}
+
+// Read reads the next frame which is not rejected by turnQuotas
+func (c *quotaConn) Read(p []byte) (int, error) {
+	reply := func(res []byte) error {
+		_, err := c.Conn.Write(res)
+		return err
+	}
+
+	for {
+		n, _, err := c.frames.ReadFrom(p)
+		if err != nil {
+			return n, err
+		}
+
+		if c.quotas.inbound(p[:n], c.RemoteAddr(), reply) {
+			return n, nil
+		}
+	}
+}
+
+// Write writes a message after passing it to turnQuotas
+func (c *quotaConn) Write(p []byte) (int, error) {
+	c.quotas.outbound(p, c.RemoteAddr())
+	return c.Conn.Write(p)
+}
+
+// quotaRelayConn is a relay allocated by the TURN server. Traffic beyond the
+// bandwidth cap of the allocation, or the bytes quota of its account, is
+// dropped.
+type quotaRelayConn struct {
+	net.PacketConn
+	sync.Mutex
+	quotas  *turnQuotas
+	address string
+	limiter *rateLimiter
+
+	// account and assigned are set by turnQuotas once the allocation succeeded
+	account  string
+	assigned time.Time
+}
+
+// allow reports whether n bytes can be relayed, sent to a peer or received from
+// it, and records them
+func (c *quotaRelayConn) allow(n int, sent bool) bool {
+	c.quotas.Lock()
+	account := c.account
+	c.quotas.Unlock()
+
+	c.Lock()
+	if c.limiter != nil && !c.limiter.allow(n) {
+		c.Unlock()
+		return false
+	}
+	c.Unlock()
+
+	if account == "" {
+		return true
+	}
+
+	return c.quotas.consume(account, n, sent)
+}
+
+// ReadFrom reads the next packet from a peer which is within limits
+func (c *quotaRelayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.allow(n, false) {
+			return n, addr, err
+		}
+	}
+}
+
+// WriteTo sends a packet to a peer, or silently drops it if it is not within
+// limits
+func (c *quotaRelayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.allow(len(p), true) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
+
+// Close closes the relay and releases its allocation
+func (c *quotaRelayConn) Close() error {
+	c.quotas.removeRelay(c)
+	return c.PacketConn.Close()
+}
+
+// rateLimiter is a token bucket allowing rate bytes per second, with bursts of
+// up to one second. It is not thread safe.
+type rateLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter creates a full rateLimiter
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// allow reports whether n bytes can be sent now, and consumes them
+func (l *rateLimiter) allow(n int) bool {
+	now := time.Now()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	if l.tokens < float64(n) {
+		return false
+	}
+
+	l.tokens -= float64(n)
+
+	return true
+}
+
+// isMessageType reports whether p is a STUN message of type t, without
+// decoding it
+func isMessageType(p []byte, t stun.MessageType) bool {
+	return stun.IsMessage(p) && binary.BigEndian.Uint16(p[0:2]) == t.Value()
+}
+
+// pendingKey identifies an Allocate transaction
+func pendingKey(addr net.Addr, transactionID [stun.TransactionIDSize]byte) string {
+	return addr.String() + string(transactionID[:])
+}
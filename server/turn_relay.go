@@ -0,0 +1,135 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+)
+
+// relayAddressGenerator implements pion's RelayAddressGenerator interface. It
+// allocates relays on a local bind address, and advertises them at a public
+// relay IP. Unlike pion's RelayAddressGeneratorStatic, it supports IPv6: relays
+// are always allocated in the address family of the generator, regardless of
+// the network requested by the TURN server. If a port range is set, relays are
+// only allocated on ports within that range.
+//
+// The generator is custom because the pinned pion/turn v2.0.2 has no port-range
+// generator (RelayAddressGeneratorPortRange was only added in v2.0.8), and
+// because neither upstream generator allocates IPv6 relays or registers them
+// with the TURN quotas, so they would still have to be wrapped after a bump.
+type relayAddressGenerator struct {
+	network  string // "udp4" or "udp6"
+	relayIP  net.IP // public IP advertised to clients
+	bindAddr string // local address the relays listen on
+	minPort  int    // lowest relay port, or 0 for any port
+	maxPort  int    // highest relay port, or 0 for any port
+	quotas   *turnQuotas
+}
+
+// newRelayAddressGenerator creates a relayAddressGenerator for relayIP. Relays
+// listen on bindIP, or on every interface of the corresponding address family
+// if bindIP is nil, and on ports between minPort and maxPort, or any port if
+// they are 0. If quotas is not nil, relays are registered with it, and
+// allocations are refused once the global allocation limit is reached.
+func newRelayAddressGenerator(relayIP net.IP, bindIP net.IP, minPort int, maxPort int, quotas *turnQuotas) *relayAddressGenerator {
+	g := &relayAddressGenerator{
+		network:  "udp6",
+		relayIP:  relayIP,
+		bindAddr: "::",
+		minPort:  minPort,
+		maxPort:  maxPort,
+		quotas:   quotas,
+	}
+
+	if relayIP.To4() != nil {
+		g.network = "udp4"
+		g.bindAddr = "0.0.0.0"
+	}
+
+	if bindIP != nil {
+		g.bindAddr = bindIP.String()
+	}
+
+	return g
+}
+
+// Validate is called on server startup and confirms the relayAddressGenerator
+// is properly configured
+func (g *relayAddressGenerator) Validate() error {
+	switch {
+	case g.relayIP == nil:
+		return errors.New("Relay IP not set")
+	case g.bindAddr == "":
+		return errors.New("Relay bind address not set")
+	case g.minPort < 0 || g.maxPort < g.minPort || g.maxPort > 65535:
+		return fmt.Errorf("Invalid relay port range %d-%d", g.minPort, g.maxPort)
+	case g.minPort == 0 && g.maxPort != 0:
+		return fmt.Errorf("Invalid relay port range %d-%d", g.minPort, g.maxPort)
+	default:
+		return nil
+	}
+}
+
+// AllocatePacketConn creates a UDP relay and returns it with the public
+// address it is advertised at
+func (g *relayAddressGenerator) AllocatePacketConn(network string, requestedPort int) (net.PacketConn, net.Addr, error) {
+	conn, err := g.listenPacket(requestedPort)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Replace the actual listening IP with the public relay IP
+	relayAddr := *conn.LocalAddr().(*net.UDPAddr)
+	relayAddr.IP = g.relayIP
+
+	if g.quotas == nil {
+		return conn, &relayAddr, nil
+	}
+
+	relay, err := g.quotas.addRelay(conn, &relayAddr)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return relay, &relayAddr, nil
+}
+
+// AllocateConn is not supported as relays are always allocated over UDP
+func (g *relayAddressGenerator) AllocateConn(network string, requestedPort int) (net.Conn, net.Addr, error) {
+	return nil, nil, fmt.Errorf("TCP relays are not supported")
+}
+
+// listenPacket listens on the requested port, or on a free port if
+// requestedPort is 0. If a port range is set, the port must be within the
+// range. Free ports are searched from a random point in the range.
+func (g *relayAddressGenerator) listenPacket(requestedPort int) (net.PacketConn, error) {
+	listen := func(port int) (net.PacketConn, error) {
+		return net.ListenPacket(g.network, net.JoinHostPort(g.bindAddr, strconv.Itoa(port)))
+	}
+
+	if g.minPort == 0 {
+		return listen(requestedPort)
+	}
+
+	if requestedPort != 0 {
+		if requestedPort < g.minPort || requestedPort > g.maxPort {
+			return nil, fmt.Errorf("Requested port %d is outside of relay port range", requestedPort)
+		}
+		return listen(requestedPort)
+	}
+
+	size := g.maxPort - g.minPort + 1
+	offset := rand.Intn(size)
+
+	for i := 0; i < size; i++ {
+		port := g.minPort + (offset+i)%size
+		if conn, err := listen(port); err == nil {
+			return conn, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No free port in relay port range %d-%d", g.minPort, g.maxPort)
+}
@@ -0,0 +1,1146 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mosaicnetworks/disco/app"
+	"github.com/mosaicnetworks/disco/group"
+	"github.com/pion/turn/v2"
+	"github.com/sirupsen/logrus"
+)
+
+// Test that the TURN authenticator accepts the static user, and valid ephemeral
+// credentials.
+func TestTURNAuthenticator(t *testing.T) {
+	config := TURNConfig{
+		Realm:    "main",
+		Username: "test",
+		Password: "testpass",
+		Secret:   "secret",
+	}
+
+	authenticator, err := newTURNAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Static user
+
+	key, ok := authenticator.authenticate("test", "main", nil)
+	if !ok {
+		t.Fatalf("Static user should be authenticated")
+	}
+
+	if !bytes.Equal(key, turn.GenerateAuthKey("test", "main", "testpass")) {
+		t.Fatalf("Static user key does not match password")
+	}
+
+	if _, ok := authenticator.authenticate("unknown", "main", nil); ok {
+		t.Fatalf("Unknown user should not be authenticated")
+	}
+
+	// Ephemeral credentials
+
+	username, password := generateTURNCredentials("secret", "TestApp", time.Minute)
+
+	key, ok = authenticator.authenticate(username, "main", nil)
+	if !ok {
+		t.Fatalf("Ephemeral user should be authenticated")
+	}
+
+	if !bytes.Equal(key, turn.GenerateAuthKey(username, "main", password)) {
+		t.Fatalf("Ephemeral user key does not match password")
+	}
+
+	// Credentials signed with another secret produce a different key
+
+	_, otherPassword := generateTURNCredentials("other", "TestApp", time.Minute)
+	if bytes.Equal(key, turn.GenerateAuthKey(username, "main", otherPassword)) {
+		t.Fatalf("Ephemeral credentials should depend on the secret")
+	}
+
+	// Expired credentials are rejected
+
+	expiredUsername, _ := generateTURNCredentials("secret", "TestApp", -time.Minute)
+	if _, ok := authenticator.authenticate(expiredUsername, "main", nil); ok {
+		t.Fatalf("Expired credentials should not be authenticated")
+	}
+
+	// Ephemeral credentials are rejected when there is no secret
+
+	config.Secret = ""
+
+	authenticator, err = newTURNAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := authenticator.authenticate(username, "main", nil); ok {
+		t.Fatalf("Ephemeral credentials should not be authenticated without secret")
+	}
+}
+
+// Test loading TURN users from a file, and reloading the file.
+func TestTURNUsersFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "disco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usersFile := filepath.Join(dir, "users.json")
+
+	writeUsers := func(users []TURNUser) {
+		raw, err := json.Marshal(users)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(usersFile, raw, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	teamBKey := turn.GenerateAuthKey("team-b", "main", "passb")
+
+	writeUsers([]TURNUser{
+		{Username: "team-a", Password: "passa"},
+		{Username: "team-b", Realm: "main", Key: hex.EncodeToString(teamBKey)},
+	})
+
+	authenticator, err := newTURNAuthenticator(TURNConfig{
+		Realm:     "main",
+		UsersFile: usersFile,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, ok := authenticator.authenticate("team-a", "main", nil)
+	if !ok || !bytes.Equal(key, turn.GenerateAuthKey("team-a", "main", "passa")) {
+		t.Fatalf("team-a should be authenticated with its password")
+	}
+
+	key, ok = authenticator.authenticate("team-b", "main", nil)
+	if !ok || !bytes.Equal(key, teamBKey) {
+		t.Fatalf("team-b should be authenticated with its key")
+	}
+
+	if _, ok := authenticator.authenticate("team-b", "other", nil); ok {
+		t.Fatalf("team-b should not be authenticated in another realm")
+	}
+
+	// Revoke team-a and reload
+
+	writeUsers([]TURNUser{
+		{Username: "team-b", Realm: "main", Key: hex.EncodeToString(teamBKey)},
+	})
+
+	if err := authenticator.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := authenticator.authenticate("team-a", "main", nil); ok {
+		t.Fatalf("team-a should not be authenticated after reload")
+	}
+
+	// An invalid file does not affect the current users
+
+	writeUsers([]TURNUser{
+		{Username: "team-c"},
+	})
+
+	if err := authenticator.reload(); err == nil {
+		t.Fatalf("Reloading an invalid users file should fail")
+	}
+
+	if _, ok := authenticator.authenticate("team-b", "main", nil); !ok {
+		t.Fatalf("team-b should still be authenticated after failed reload")
+	}
+
+	// Users can not be defined in another realm, because the TURN server only
+	// challenges clients with its own realm
+
+	writeUsers([]TURNUser{
+		{Username: "team-d", Realm: "other", Password: "passd"},
+	})
+
+	if err := authenticator.reload(); err == nil {
+		t.Fatalf("Reloading a users file with another realm should fail")
+	}
+}
+
+// Test, with a TURN client, that credentials scoped to an application are only
+// accepted while the application is registered and not revoked
+func TestTURNAppCredentials(t *testing.T) {
+	apps := app.NewInmemAppRepository()
+
+	for _, id := range []string{"TestApp1", "TestApp2"} {
+		if _, err := apps.CreateApp(app.NewApp(id, "")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "turn-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	usersFile := filepath.Join(dir, "users.json")
+
+	raw, err := json.Marshal([]TURNUser{
+		{Username: "team-a", Password: "passa"},
+		{Username: "app1-user", AppID: "TestApp1", Password: "pass1"},
+		{Username: "app2-user", AppID: "TestApp2", Password: "pass2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(usersFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := TURNConfig{
+		Address:   "127.0.0.1:34820",
+		Realm:     "main",
+		UsersFile: usersFile,
+		Secret:    "secret",
+	}
+
+	authenticator, err := newTURNAuthenticator(config, apps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := newTURNQuotas(config, logrus.New().WithField("component", "turn-quotas"))
+	quotas.userAppID = authenticator.userAppID
+
+	turnServer, err := createAndStartTURNServer(config,
+		authenticator.authenticate,
+		quotas,
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+
+	// allocate allocates and releases a relay, with the realm of the server's
+	// challenge
+	allocate := func(username string, password string) error {
+		conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: config.Address,
+			TURNServerAddr: config.Address,
+			Conn:           conn,
+			Username:       username,
+			Password:       password,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+
+		relayConn, err := client.Allocate()
+		if err != nil {
+			return err
+		}
+
+		return relayConn.Close()
+	}
+
+	app1Username, app1Password := generateTURNCredentials(config.Secret, "TestApp1", time.Minute)
+	app2Username, app2Password := generateTURNCredentials(config.Secret, "TestApp2", time.Minute)
+	unknownUsername, unknownPassword := generateTURNCredentials(config.Secret, "UnknownApp", time.Minute)
+
+	if err := allocate("team-a", "passa"); err != nil {
+		t.Fatalf("Unscoped user should be accepted: %v", err)
+	}
+
+	if err := allocate("app1-user", "pass1"); err != nil {
+		t.Fatalf("User scoped to TestApp1 should be accepted: %v", err)
+	}
+
+	if err := allocate(app1Username, app1Password); err != nil {
+		t.Fatalf("Ephemeral credentials of TestApp1 should be accepted: %v", err)
+	}
+
+	if err := allocate(unknownUsername, unknownPassword); err == nil {
+		t.Fatalf("Ephemeral credentials of an unregistered app should not be accepted")
+	}
+
+	// Revoking an application invalidates its credentials, but not those of
+	// other applications
+
+	if err := apps.RevokeApp("TestApp1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := allocate("app1-user", "pass1"); err == nil {
+		t.Fatalf("User scoped to a revoked app should not be accepted")
+	}
+
+	if err := allocate(app1Username, app1Password); err == nil {
+		t.Fatalf("Ephemeral credentials of a revoked app should not be accepted")
+	}
+
+	if err := allocate("app2-user", "pass2"); err != nil {
+		t.Fatalf("User scoped to TestApp2 should be accepted: %v", err)
+	}
+
+	if err := allocate(app2Username, app2Password); err != nil {
+		t.Fatalf("Ephemeral credentials of TestApp2 should be accepted: %v", err)
+	}
+
+	if err := allocate("team-a", "passa"); err != nil {
+		t.Fatalf("Unscoped user should still be accepted: %v", err)
+	}
+
+	// The usage of scoped users and ephemeral credentials records their AppID
+
+	expectedAppIDs := map[string]string{
+		"team-a":    "",
+		"app1-user": "TestApp1",
+		"app2-user": "TestApp2",
+		"TestApp1":  "TestApp1",
+		"TestApp2":  "TestApp2",
+	}
+
+	usage := quotas.usage()
+
+	for account, appID := range expectedAppIDs {
+		u, ok := usage[account]
+		if !ok {
+			t.Fatalf("Usage of %s should be recorded", account)
+		}
+
+		if u.AppID != appID {
+			t.Fatalf("AppID of %s should be %q, not %q", account, appID, u.AppID)
+		}
+	}
+}
+
+// Test that the credentials endpoint returns ephemeral credentials for the
+// authenticated application.
+func TestGetTURNCredentials(t *testing.T) {
+	s := NewDiscoServer(
+		nil,
+		nil,
+		"",
+		TURNConfig{
+			Address:        "1.2.3.4:3478",
+			Realm:          "main",
+			Secret:         "secret",
+			CredentialsTTL: time.Hour,
+		},
+		TLSConfig{},
+		logrus.New().WithField("component", "disco-server"),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/turn/credentials", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, app.NewApp("TestApp", "")))
+
+	w := httptest.NewRecorder()
+	s.getTURNCredentials(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Response status should be %d, not %d", http.StatusOK, w.Code)
+	}
+
+	// The keys are those of the TURN REST API
+	var raw map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &raw); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"username", "password", "ttl", "uris"} {
+		if _, ok := raw[key]; !ok {
+			t.Fatalf("Credentials should contain %q, not %v", key, raw)
+		}
+	}
+
+	var creds TURNCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasSuffix(creds.Username, ":TestApp") {
+		t.Fatalf("Username should end with the AppID, not %s", creds.Username)
+	}
+
+	if creds.Password != ephemeralPassword("secret", creds.Username) {
+		t.Fatalf("Password does not match username")
+	}
+
+	if creds.TTL != 3600 {
+		t.Fatalf("TTL should be 3600, not %d", creds.TTL)
+	}
+
+	if len(creds.URIs) != 1 || creds.URIs[0] != "turn:1.2.3.4:3478?transport=udp" {
+		t.Fatalf("Unexpected URIs %v", creds.URIs)
+	}
+}
+
+// Test allocating relays through the UDP, TCP, and TLS listeners of the TURN
+// server.
+func TestTURNServerListeners(t *testing.T) {
+	config := TURNConfig{
+		Address:   "127.0.0.1:34780",
+		AddressV6: "::1",
+		TCPPort:   "34781",
+		TLSPort:   "34782",
+		Realm:     "main",
+		Username:  "test",
+		Password:  "test",
+	}
+
+	authenticator, err := newTURNAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.LoadX509KeyPair("../test_data/cert.pem", "../test_data/key.pem")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	turnServer, err := createAndStartTURNServer(
+		config,
+		authenticator.authenticate,
+		newTURNQuotas(config, logrus.New().WithField("component", "turn-quotas")),
+		&tls.Config{Certificates: []tls.Certificate{cert}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+
+	expectedURIs := []string{
+		"turn:127.0.0.1:34780?transport=udp",
+		"turn:127.0.0.1:34781?transport=tcp",
+		"turns:127.0.0.1:34782?transport=tcp",
+		"turn:[::1]:34780?transport=udp",
+		"turn:[::1]:34781?transport=tcp",
+		"turns:[::1]:34782?transport=tcp",
+	}
+
+	if !reflect.DeepEqual(config.URIs(), expectedURIs) {
+		t.Fatalf("URIs should be %v, not %v", expectedURIs, config.URIs())
+	}
+
+	udpConn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcpConn, err := net.Dial("tcp4", "127.0.0.1:34781")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConn, err := tls.Dial("tcp4", "127.0.0.1:34782", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conns := map[string]struct {
+		addr string
+		conn net.PacketConn
+	}{
+		"udp": {"127.0.0.1:34780", udpConn},
+		"tcp": {"127.0.0.1:34781", turn.NewSTUNConn(tcpConn)},
+		"tls": {"127.0.0.1:34782", turn.NewSTUNConn(tlsConn)},
+	}
+
+	for transport, c := range conns {
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: c.addr,
+			TURNServerAddr: c.addr,
+			Conn:           c.conn,
+			Username:       "test",
+			Password:       "test",
+			Realm:          "main",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+
+		relayConn, err := client.Allocate()
+		if err != nil {
+			t.Fatalf("Allocating relay over %s: %v", transport, err)
+		}
+
+		relayConn.Close()
+		client.Close()
+		c.conn.Close()
+	}
+}
+
+// Test that relays are allocated in the address family of the public IP, and
+// advertised at the public IP.
+func TestRelayAddressGenerator(t *testing.T) {
+	for _, publicIP := range []string{"1.2.3.4", "2001:db8::1"} {
+		g := newRelayAddressGenerator(net.ParseIP(publicIP), nil, 0, 0, nil)
+
+		if err := g.Validate(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The TURN server always requests udp4
+		conn, relayAddr, err := g.AllocatePacketConn("udp4", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		localAddr := conn.LocalAddr().(*net.UDPAddr)
+		conn.Close()
+
+		if (localAddr.IP.To4() == nil) != (net.ParseIP(publicIP).To4() == nil) {
+			t.Fatalf("Relay for %s should be allocated in the same address family, not %s", publicIP, localAddr)
+		}
+
+		udpRelayAddr := relayAddr.(*net.UDPAddr)
+
+		if !udpRelayAddr.IP.Equal(net.ParseIP(publicIP)) {
+			t.Fatalf("Relay IP should be %s, not %s", publicIP, udpRelayAddr.IP)
+		}
+
+		if udpRelayAddr.Port != localAddr.Port {
+			t.Fatalf("Relay port should be %d, not %d", localAddr.Port, udpRelayAddr.Port)
+		}
+	}
+}
+
+// Test that allocation limits and bytes quotas are enforced per user, and
+// globally, over UDP and TCP.
+func TestTURNQuotas(t *testing.T) {
+	config := TURNConfig{
+		Address:            "127.0.0.1:34800",
+		TCPPort:            "34801",
+		Realm:              "main",
+		Secret:             "secret",
+		CredentialsTTL:     time.Hour,
+		MaxAllocations:     2,
+		MaxUserAllocations: 1,
+		UserQuota:          1000,
+	}
+
+	authenticator, err := newTURNAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := newTURNQuotas(config, logrus.New().WithField("component", "turn-quotas"))
+
+	turnServer, err := createAndStartTURNServer(config, authenticator.authenticate, quotas, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+
+	// allocate allocates a relay over UDP or TCP with new ephemeral
+	// credentials for user
+	allocate := func(transport string, user string) (net.PacketConn, func(), error) {
+		var conn net.PacketConn
+		var addr string
+
+		if transport == "tcp" {
+			addr = "127.0.0.1:34801"
+			tcpConn, err := net.Dial("tcp4", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn = turn.NewSTUNConn(tcpConn)
+		} else {
+			addr = "127.0.0.1:34800"
+			conn, err = net.ListenPacket("udp4", "0.0.0.0:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		username, password := generateTURNCredentials(config.Secret, user, config.CredentialsTTL)
+
+		client, err := turn.NewClient(&turn.ClientConfig{
+			STUNServerAddr: addr,
+			TURNServerAddr: addr,
+			Conn:           conn,
+			Username:       username,
+			Password:       password,
+			Realm:          config.Realm,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := client.Listen(); err != nil {
+			t.Fatal(err)
+		}
+
+		closeAll := func() {
+			client.Close()
+			conn.Close()
+		}
+
+		relayConn, err := client.Allocate()
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+
+		return relayConn, func() {
+			relayConn.Close()
+			closeAll()
+		}, nil
+	}
+
+	// Requests which fail authentication do not create an account
+
+	validSecret := config.Secret
+	config.Secret = "invalid"
+
+	if _, _, err := allocate("udp", "mallory"); err == nil {
+		t.Fatalf("Allocation with invalid credentials should be rejected")
+	}
+
+	config.Secret = validSecret
+
+	if _, ok := quotas.usage()["mallory"]; ok {
+		t.Fatalf("Allocation with invalid credentials should not create an account")
+	}
+
+	// Per-user allocation limit, with different credentials of the same user
+
+	aliceRelay, closeAlice, err := allocate("udp", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeAlice()
+
+	if _, _, err := allocate("tcp", "alice"); err == nil {
+		t.Fatalf("Second allocation of alice should be rejected")
+	}
+
+	// Global allocation limit
+
+	_, closeBob, err := allocate("tcp", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := allocate("udp", "carol"); err == nil {
+		t.Fatalf("Allocation beyond the global limit should be rejected")
+	}
+
+	// Releasing an allocation makes room for another one
+
+	closeBob()
+
+	_, closeCarol, err := allocate("udp", "carol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeCarol()
+
+	// Bytes quota
+
+	peer, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := aliceRelay.WriteTo(make([]byte, 500), peer.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Wait for the TURN server to relay the data
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		quotas.Lock()
+		relayed := quotas.account("alice").BytesSent
+		quotas.Unlock()
+
+		if relayed >= config.UserQuota {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("alice should have relayed at least %d bytes, not %d", config.UserQuota, relayed)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	closeAlice()
+
+	if _, _, err := allocate("udp", "alice"); err == nil {
+		t.Fatalf("Allocation of alice should be rejected once over quota")
+	}
+
+	// Rejections are counted by reason
+
+	expectedRejections := map[string]uint64{
+		rejectUserAllocationLimit: 1,
+		rejectAllocationLimit:     1,
+		rejectUserQuota:           1,
+	}
+
+	if !reflect.DeepEqual(quotas.rejections(), expectedRejections) {
+		t.Fatalf("Rejections should be %v, not %v", expectedRejections, quotas.rejections())
+	}
+
+	// Usage is accounted for under the AppID of ephemeral credentials
+
+	aliceUsage := quotas.usage()["alice"]
+
+	if aliceUsage.AppID != "alice" {
+		t.Fatalf("alice AppID should be alice, not %q", aliceUsage.AppID)
+	}
+
+	if aliceUsage.Allocations != 1 || aliceUsage.ActiveAllocations != 0 {
+		t.Fatalf("alice should have 1 allocation and 0 active allocations, not %d and %d", aliceUsage.Allocations, aliceUsage.ActiveAllocations)
+	}
+}
+
+// Test that TURN usage is saved to and restored from the usage file, and
+// returned by the admin endpoint
+func TestTURNUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turn-usage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := TURNConfig{
+		Address:   "1.2.3.4:3478",
+		UsageFile: filepath.Join(dir, "usage.json"),
+	}
+
+	logger := logrus.New().WithField("component", "disco-server")
+
+	s := NewDiscoServer(nil, nil, "", config, TLSConfig{}, logger)
+
+	// Loading a missing usage file is not an error
+
+	if err := s.turnQuotas.loadUsage(config.UsageFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// Record some usage
+
+	s.turnQuotas.Lock()
+	usage := s.turnQuotas.account("TestApp")
+	usage.AppID = "TestApp"
+	usage.Allocations = 2
+	usage.Duration = 60
+	s.turnQuotas.Unlock()
+
+	s.turnQuotas.consume("TestApp", 100, true)
+	s.turnQuotas.consume("TestApp", 200, false)
+
+	expectedUsage := TURNUsage{
+		Username:      "TestApp",
+		AppID:         "TestApp",
+		Allocations:   2,
+		Duration:      60,
+		BytesSent:     100,
+		BytesReceived: 200,
+	}
+
+	// Save and restore
+
+	if err := s.turnQuotas.saveUsage(config.UsageFile); err != nil {
+		t.Fatal(err)
+	}
+
+	restored := NewDiscoServer(nil, nil, "", config, TLSConfig{}, logger)
+
+	if err := restored.turnQuotas.loadUsage(config.UsageFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := restored.turnQuotas.usage()["TestApp"]; u != expectedUsage {
+		t.Fatalf("Restored usage should be %#v, not %#v", expectedUsage, u)
+	}
+
+	// Admin endpoint
+
+	w := httptest.NewRecorder()
+	restored.getTURNUsage(w, httptest.NewRequest(http.MethodGet, "/admin/turn/usage", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Response status should be %d, not %d", http.StatusOK, w.Code)
+	}
+
+	var report TURNUsageReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := report.Users["TestApp"]; u != expectedUsage {
+		t.Fatalf("Reported usage should be %#v, not %#v", expectedUsage, u)
+	}
+
+	// The usage is saved when the server is closed, even if it was not saved
+	// periodically yet
+
+	started := NewDiscoServer(
+		group.NewInmemGroupRepository(),
+		app.NewInmemAppRepository(),
+		"",
+		TURNConfig{
+			Address:       "127.0.0.1:0",
+			Realm:         "main",
+			UsageFile:     config.UsageFile,
+			UsageInterval: time.Hour,
+		},
+		TLSConfig{
+			CertFile: "../test_data/cert.pem",
+			KeyFile:  "../test_data/key.pem",
+		},
+		logger,
+	)
+
+	if err := started.Start("127.0.0.1:0", "127.0.0.1:0", "", 5*time.Minute, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	started.turnQuotas.consume("TestApp", 50, true)
+
+	if err := started.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	closed := NewDiscoServer(nil, nil, "", config, TLSConfig{}, logger)
+
+	if err := closed.turnQuotas.loadUsage(config.UsageFile); err != nil {
+		t.Fatal(err)
+	}
+
+	if u := closed.turnQuotas.usage()["TestApp"]; u.BytesSent != expectedUsage.BytesSent+50 {
+		t.Fatalf("Usage saved on close should include %d bytes sent, not %d", expectedUsage.BytesSent+50, u.BytesSent)
+	}
+}
+
+// Test that the ICE servers are returned in the WebRTC format, with ephemeral
+// credentials when they are enabled, and without TURN in STUN-only mode
+func TestGetICEServers(t *testing.T) {
+	getICEServers := func(config TURNConfig) []map[string]interface{} {
+		s := NewDiscoServer(nil, nil, "", config, TLSConfig{}, logrus.New().WithField("component", "disco-server"))
+
+		req := httptest.NewRequest(http.MethodGet, "/ice-servers", nil)
+		req = req.WithContext(context.WithValue(req.Context(), appContextKey, app.NewApp("TestApp", "")))
+
+		w := httptest.NewRecorder()
+		s.getICEServers(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Response status should be %d, not %d", http.StatusOK, w.Code)
+		}
+
+		var servers []map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &servers); err != nil {
+			t.Fatal(err)
+		}
+
+		return servers
+	}
+
+	config := TURNConfig{
+		Address:        "1.2.3.4:3478",
+		TLSPort:        "5349",
+		Secret:         "secret",
+		CredentialsTTL: time.Hour,
+	}
+
+	// Ephemeral credentials
+
+	servers := getICEServers(config)
+
+	if len(servers) != 2 {
+		t.Fatalf("There should be 2 ICE servers, not %d", len(servers))
+	}
+
+	if !reflect.DeepEqual(servers[0], map[string]interface{}{"urls": []interface{}{"stun:1.2.3.4:3478"}}) {
+		t.Fatalf("Unexpected STUN server %v", servers[0])
+	}
+
+	expectedURLs := []interface{}{
+		"turn:1.2.3.4:3478?transport=udp",
+		"turns:1.2.3.4:5349?transport=tcp",
+	}
+
+	if !reflect.DeepEqual(servers[1]["urls"], expectedURLs) {
+		t.Fatalf("TURN urls should be %v, not %v", expectedURLs, servers[1]["urls"])
+	}
+
+	username, _ := servers[1]["username"].(string)
+	if !strings.HasSuffix(username, ":TestApp") {
+		t.Fatalf("TURN username should end with the AppID, not %s", username)
+	}
+
+	if servers[1]["credential"] != ephemeralPassword("secret", username) {
+		t.Fatalf("TURN credential does not match username")
+	}
+
+	// STUN-only
+
+	config.STUNOnly = true
+
+	servers = getICEServers(config)
+
+	if len(servers) != 1 {
+		t.Fatalf("There should be 1 ICE server in STUN-only mode, not %d", len(servers))
+	}
+}
+
+// Test that a STUN-only server answers binding requests but refuses
+// allocations, and only advertises STUN URIs.
+func TestSTUNOnly(t *testing.T) {
+	config := TURNConfig{
+		Address:  "127.0.0.1:34810",
+		Realm:    "main",
+		Username: "test",
+		Password: "test",
+		STUNOnly: true,
+	}
+
+	authenticator, err := newTURNAuthenticator(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	quotas := newTURNQuotas(config, logrus.New().WithField("component", "turn-quotas"))
+
+	turnServer, err := createAndStartTURNServer(config, authenticator.authenticate, quotas, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer turnServer.Close()
+
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	client, err := turn.NewClient(&turn.ClientConfig{
+		STUNServerAddr: config.Address,
+		TURNServerAddr: config.Address,
+		Conn:           conn,
+		Username:       "test",
+		Password:       "test",
+		Realm:          "main",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	if err := client.Listen(); err != nil {
+		t.Fatal(err)
+	}
+
+	mappedAddr, err := client.SendBindingRequest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mappedAddr.(*net.UDPAddr).Port != conn.LocalAddr().(*net.UDPAddr).Port {
+		t.Fatalf("Mapped port should be %d, not %s", conn.LocalAddr().(*net.UDPAddr).Port, mappedAddr)
+	}
+
+	if _, err := client.Allocate(); err == nil {
+		t.Fatalf("Allocation should be refused in STUN-only mode")
+	}
+
+	if quotas.rejections()[rejectSTUNOnly] != 1 {
+		t.Fatalf("1 allocation should be rejected, not %d", quotas.rejections()[rejectSTUNOnly])
+	}
+
+	// Only STUN URIs are advertised, without credentials
+
+	s := NewDiscoServer(nil, nil, "", config, TLSConfig{}, logrus.New().WithField("component", "disco-server"))
+
+	req := httptest.NewRequest(http.MethodGet, "/turn/credentials", nil)
+	req = req.WithContext(context.WithValue(req.Context(), appContextKey, app.NewApp("TestApp", "")))
+
+	w := httptest.NewRecorder()
+	s.getTURNCredentials(w, req)
+
+	var creds TURNCredentials
+	if err := json.Unmarshal(w.Body.Bytes(), &creds); err != nil {
+		t.Fatal(err)
+	}
+
+	expectedURIs := []string{"stun:127.0.0.1:34810"}
+
+	if creds.Username != "" || !reflect.DeepEqual(creds.URIs, expectedURIs) {
+		t.Fatalf("Response should only contain URIs %v, not %#v", expectedURIs, creds)
+	}
+}
+
+// Test that the rate limiter allows bursts of up to one second of traffic
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1000)
+
+	if !l.allow(600) || !l.allow(400) {
+		t.Fatalf("Rate limiter should allow a burst of 1000 bytes")
+	}
+
+	if l.allow(100) {
+		t.Fatalf("Rate limiter should not allow more than 1000 bytes")
+	}
+
+	l.last = l.last.Add(-100 * time.Millisecond)
+
+	if !l.allow(100) {
+		t.Fatalf("Rate limiter should allow 100 bytes after 100ms")
+	}
+}
+
+// Test that relays are only allocated on ports within the configured range, and
+// on the configured bind address
+func TestRelayAddressGeneratorPortRange(t *testing.T) {
+	minPort, maxPort := 34790, 34792
+
+	g := newRelayAddressGenerator(net.ParseIP("1.2.3.4"),
+		net.ParseIP("127.0.0.1"),
+		minPort,
+		maxPort,
+		nil)
+
+	if err := g.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Allocate every port in the range
+
+	conns := []net.PacketConn{}
+	defer func() {
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	for i := minPort; i <= maxPort; i++ {
+		conn, _, err := g.AllocatePacketConn("udp4", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, conn)
+
+		localAddr := conn.LocalAddr().(*net.UDPAddr)
+
+		if localAddr.Port < minPort || localAddr.Port > maxPort {
+			t.Fatalf("Relay port should be within %d-%d, not %d", minPort, maxPort, localAddr.Port)
+		}
+
+		if !localAddr.IP.Equal(net.ParseIP("127.0.0.1")) {
+			t.Fatalf("Relay should be bound to 127.0.0.1, not %s", localAddr.IP)
+		}
+	}
+
+	// The range is exhausted
+
+	if _, _, err := g.AllocatePacketConn("udp4", 0); err == nil {
+		t.Fatalf("Allocating a relay when the range is exhausted should fail")
+	}
+
+	// Requested ports must be within the range
+
+	if _, _, err := g.AllocatePacketConn("udp4", maxPort+1); err == nil {
+		t.Fatalf("Allocating a relay outside of the range should fail")
+	}
+}
+
+// Test validating the relay port range and allocation limits
+func TestTURNConfigValidate(t *testing.T) {
+	valid := []TURNConfig{
+		{},
+		{RelayMinPort: 49152, RelayMaxPort: 65535},
+		{RelayMinPort: 50000, RelayMaxPort: 50000},
+		{RelayMinPort: 50000, RelayMaxPort: 50009, MaxAllocations: 10, MaxUserAllocations: 2},
+		{MaxUserAllocations: 2},
+		{AllocationBandwidth: 1500},
+	}
+
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Fatalf("Config %#v should be valid: %v", c, err)
+		}
+	}
+
+	invalid := []TURNConfig{
+		{RelayMinPort: 50000},
+		{RelayMaxPort: 50000},
+		{RelayMinPort: 50001, RelayMaxPort: 50000},
+		{RelayMinPort: 50000, RelayMaxPort: 70000},
+		{RelayMinPort: 50000, RelayMaxPort: 50009, MaxAllocations: 11},
+		{RelayMinPort: 50000, RelayMaxPort: 50009, MaxUserAllocations: 11},
+		{MaxAllocations: 1, MaxUserAllocations: 2},
+		{UserQuota: -1},
+		{AllocationBandwidth: 1499},
+	}
+
+	for _, c := range invalid {
+		if err := c.validate(); err == nil {
+			t.Fatalf("Config %#v should be invalid", c)
+		}
+	}
+}
+
+// Test parsing the public addresses of the TURN server
+func TestTURNConfigPublicIPs(t *testing.T) {
+	invalid := []TURNConfig{
+		{Address: "1.2.3.4"},
+		{Address: "localhost:3478"},
+		{Address: "1.2.3.4:3478", AddressV6: "5.6.7.8"},
+		{Address: "[2001:db8::1]:3478", AddressV6: "2001:db8::2"},
+	}
+
+	for _, c := range invalid {
+		if _, _, err := c.publicIPs(); err == nil {
+			t.Fatalf("Config %#v should be invalid", c)
+		}
+	}
+
+	ips, port, err := TURNConfig{Address: "[2001:db8::1]:3478"}.publicIPs()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || !ips[0].Equal(net.ParseIP("2001:db8::1")) || port != "3478" {
+		t.Fatalf("Unexpected public IPs %v and port %s", ips, port)
+	}
+}
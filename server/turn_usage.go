@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// TURNUsage is the relay usage of a TURN user. Users authenticated with
+// ephemeral credentials are accounted for under the AppID the credentials were
+// issued to.
+type TURNUsage struct {
+	Username string
+	AppID    string // empty unless the user is ephemeral, or scoped to an app in the users file
+
+	Allocations       int64 // number of successful allocations
+	ActiveAllocations int   // number of current allocations
+	Duration          int64 // total duration of the allocations, in seconds
+
+	BytesSent     int64 // bytes relayed from the user to its peers
+	BytesReceived int64 // bytes relayed from the peers to the user
+}
+
+// TURNUsageReport is returned by the /admin/turn/usage endpoint
+type TURNUsageReport struct {
+	Users      map[string]TURNUsage // [account] => usage
+	Rejections map[string]uint64    // [reason] => number of rejected allocations
+}
+
+// bytes returns the total number of bytes relayed for the user
+func (u *TURNUsage) bytes() int64 {
+	return u.BytesSent + u.BytesReceived
+}
+
+// seconds rounds a duration to the nearest second
+func seconds(d time.Duration) int64 {
+	return int64(d.Round(time.Second) / time.Second)
+}
+
+// usage returns a copy of the usage of every account. The duration of active
+// allocations is counted up to now.
+func (q *turnQuotas) usage() map[string]TURNUsage {
+	q.Lock()
+	defer q.Unlock()
+
+	res := make(map[string]TURNUsage, len(q.accounts))
+	for account, usage := range q.accounts {
+		res[account] = *usage
+	}
+
+	for _, relay := range q.relays {
+		if relay.account == "" {
+			continue
+		}
+
+		usage := res[relay.account]
+		usage.Duration += seconds(time.Since(relay.assigned))
+		res[relay.account] = usage
+	}
+
+	return res
+}
+
+// loadUsage restores the usage saved in a file by saveUsage. It does nothing if
+// the file does not exist.
+func (q *turnQuotas) loadUsage(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading TURN usage file: %v", err)
+	}
+
+	var saved map[string]TURNUsage
+	if err := json.Unmarshal(raw, &saved); err != nil {
+		return fmt.Errorf("Error parsing TURN usage file: %v", err)
+	}
+
+	q.Lock()
+	defer q.Unlock()
+
+	// Active allocations do not survive a restart, so only the totals are
+	// restored
+	for account, usage := range saved {
+		current := q.account(account)
+		current.AppID = usage.AppID
+		current.Allocations += usage.Allocations
+		current.Duration += usage.Duration
+		current.BytesSent += usage.BytesSent
+		current.BytesReceived += usage.BytesReceived
+	}
+
+	return nil
+}
+
+// saveUsage writes the usage of every account to a file. The file is replaced
+// atomically, so that it is never left half-written.
+func (q *turnQuotas) saveUsage(path string) error {
+	raw, err := json.MarshalIndent(q.usage(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+
+	if err := ioutil.WriteFile(tmp, raw, 0600); err != nil {
+		return fmt.Errorf("Error writing TURN usage file: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("Error writing TURN usage file: %v", err)
+	}
+
+	return nil
+}
+
+// persistTURNUsage saves the TURN usage to the usage file at every interval,
+// until the server is closed
+func (s *DiscoServer) persistTURNUsage(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+
+		if err := s.turnQuotas.saveUsage(s.turn.UsageFile); err != nil {
+			s.logger.WithError(err).Error("Failed to save TURN usage")
+		}
+	}
+}
+
+// getTURNUsage returns the TURN usage of every user, and the number of
+// rejected allocations.
+func (s *DiscoServer) getTURNUsage(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(TURNUsageReport{
+		Users:      s.turnQuotas.usage(),
+		Rejections: s.turnQuotas.rejections(),
+	})
+}